@@ -0,0 +1,70 @@
+package cacheddownloader
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows a
+// response in encoding, either by name or through "*", with a non-zero
+// quality.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	accepted := false
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(header, ",") {
+			name, q := parseAcceptEncoding(part)
+			if strings.EqualFold(name, encoding) {
+				// An explicit entry overrides "*"
+				return q > 0
+			}
+			if name == "*" {
+				accepted = q > 0
+			}
+		}
+	}
+	return accepted
+}
+
+// parseAcceptEncoding splits an Accept-Encoding entry such as "gzip;q=0.5"
+// into its coding and quality. The quality defaults to 1.
+func parseAcceptEncoding(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	name := strings.TrimSpace(params[0])
+
+	q := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			parsed, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil {
+				q = parsed
+			}
+		}
+	}
+	return name, q
+}
+
+// serveGunzipped decodes a file stored gzip-encoded for a client that does
+// not accept gzip. The decoded length is unknown up front, so the whole file
+// is sent without a Content-Length, whatever Range was asked for, and
+// without the ETag, which belongs to the encoded bytes.
+func serveGunzipped(w http.ResponseWriter, r *http.Request, reader io.Reader, modTime time.Time) {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer gz.Close()
+
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		io.Copy(w, gz)
+	}
+}
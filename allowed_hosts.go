@@ -0,0 +1,64 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrHostNotAllowed is returned instead of downloading from, or following a
+// redirect to, a host that is not allowed by WithAllowedHosts.
+var ErrHostNotAllowed = errors.New("Download failed: host is not allowed")
+
+// maxRedirects is how many redirects are followed, as by http.Client when
+// CheckRedirect is not set.
+const maxRedirects = 10
+
+// hostAllowlist lists the hosts downloads may come from. An entry of the
+// form "*.example.com" allows any subdomain of example.com, but not
+// example.com itself. A nil hostAllowlist allows every host, and an empty
+// one none.
+type hostAllowlist []string
+
+func newHostAllowlist(hosts []string) hostAllowlist {
+	if hosts == nil {
+		return nil
+	}
+
+	allowlist := hostAllowlist{}
+	for _, host := range hosts {
+		allowlist = append(allowlist, strings.ToLower(host))
+	}
+	return allowlist
+}
+
+// allows reports whether host, without a port, may be downloaded from.
+func (a hostAllowlist) allows(host string) bool {
+	if a == nil {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range a {
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRedirect refuses redirects to hosts that are not allowed, and
+// otherwise follows http.Client's default policy.
+func (a hostAllowlist) checkRedirect(req *http.Request, via []*http.Request) error {
+	if !a.allows(req.URL.Hostname()) {
+		return ErrHostNotAllowed
+	}
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
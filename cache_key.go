@@ -0,0 +1,53 @@
+package cacheddownloader
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeCacheKey returns a cache key for u that is the same for URLs that
+// differ only in the order of query parameters, the case of the scheme and
+// host, an explicit default port, a trailing slash or a fragment. Queries
+// that net/url cannot parse are not reordered.
+//
+// Only use it when those differences are known not to matter for the resource:
+// some servers treat the order of repeated query parameters, or a trailing
+// slash, as significant. Keys are never normalized unless the caller does so.
+func NormalizeCacheKey(u *url.URL) string {
+	normalized := *u
+	normalized.Scheme = strings.ToLower(u.Scheme)
+	normalized.Host = strings.ToLower(u.Host)
+	normalized.Fragment = ""
+
+	host, port, err := net.SplitHostPort(normalized.Host)
+	if err == nil && port == defaultPorts[normalized.Scheme] {
+		normalized.Host = host
+		if strings.Contains(host, ":") {
+			normalized.Host = "[" + host + "]"
+		}
+	}
+
+	if len(normalized.Path) > 1 {
+		normalized.Path = strings.TrimRight(normalized.Path, "/")
+		normalized.RawPath = ""
+	}
+	if normalized.Path == "" && normalized.Host != "" {
+		normalized.Path = "/"
+	}
+
+	// A query that does not parse, e.g. one with ";" or a bad escape, is kept
+	// as is: parsing drops the offending pairs, which would give different
+	// resources the same key.
+	query, err := url.ParseQuery(normalized.RawQuery)
+	if err == nil {
+		normalized.RawQuery = query.Encode()
+	}
+
+	return normalized.String()
+}
@@ -0,0 +1,53 @@
+package cacheddownloader_test
+
+import (
+	Url "net/url"
+
+	. "github.com/pivotal-golang/cacheddownloader"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("NormalizeCacheKey", func() {
+	normalize := func(rawURL string) string {
+		u, err := Url.Parse(rawURL)
+		Ω(err).ShouldNot(HaveOccurred())
+		return NormalizeCacheKey(u)
+	}
+
+	It("sorts query parameters", func() {
+		Ω(normalize("http://example.com/file?b=2&a=1")).Should(Equal(normalize("http://example.com/file?a=1&b=2")))
+	})
+
+	It("lowercases the scheme and host but not the path", func() {
+		Ω(normalize("HTTP://Example.COM/File")).Should(Equal("http://example.com/File"))
+	})
+
+	It("removes default ports", func() {
+		Ω(normalize("http://example.com:80/file")).Should(Equal("http://example.com/file"))
+		Ω(normalize("https://example.com:443/file")).Should(Equal("https://example.com/file"))
+		Ω(normalize("https://[::1]:443/file")).Should(Equal("https://[::1]/file"))
+	})
+
+	It("keeps other ports", func() {
+		Ω(normalize("http://example.com:8080/file")).Should(Equal("http://example.com:8080/file"))
+		Ω(normalize("https://example.com:80/file")).Should(Equal("https://example.com:80/file"))
+	})
+
+	It("removes trailing slashes and fragments", func() {
+		Ω(normalize("http://example.com/dir/#top")).Should(Equal("http://example.com/dir"))
+		Ω(normalize("http://example.com")).Should(Equal("http://example.com/"))
+	})
+
+	It("keeps the values of repeated parameters in order", func() {
+		Ω(normalize("http://example.com/file?b=2&a=3&a=1")).Should(Equal("http://example.com/file?a=3&a=1&b=2"))
+	})
+
+	It("keeps queries it cannot parse as they are", func() {
+		Ω(normalize("https://h/p?a=1;b=2")).Should(Equal("https://h/p?a=1;b=2"))
+		Ω(normalize("https://h/p?a=1;b=2")).ShouldNot(Equal(normalize("https://h/p?a=1;b=3")))
+		Ω(normalize("https://h/p?x=%zz")).Should(Equal("https://h/p?x=%zz"))
+		Ω(normalize("https://h/p?x=%zz")).ShouldNot(Equal(normalize("https://h/p?x=%yy")))
+	})
+})
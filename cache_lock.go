@@ -0,0 +1,7 @@
+package cacheddownloader
+
+import "errors"
+
+// ErrCacheLocked is returned by New when another live downloader already owns
+// the cache directory.
+var ErrCacheLocked = errors.New("Cache directory is locked by another downloader")
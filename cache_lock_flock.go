@@ -0,0 +1,34 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cacheddownloader
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive flock on the directory itself, so no lock file
+// needs to live alongside the cached files. The lock is released when the
+// returned file is closed or the process exits.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrCacheLocked
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func unlockDir(f *os.File) error {
+	return f.Close()
+}
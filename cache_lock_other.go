@@ -0,0 +1,46 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package cacheddownloader
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Without flock only downloaders within this process can be detected.
+var lockedDirs = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+func lockDir(dir string) (*os.File, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedDirs.Lock()
+	defer lockedDirs.Unlock()
+
+	if lockedDirs.paths[absDir] {
+		return nil, ErrCacheLocked
+	}
+
+	f, err := os.Open(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedDirs.paths[absDir] = true
+	return f, nil
+}
+
+func unlockDir(f *os.File) error {
+	lockedDirs.Lock()
+	delete(lockedDirs.paths, f.Name())
+	lockedDirs.Unlock()
+
+	return f.Close()
+}
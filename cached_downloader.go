@@ -1,106 +1,1328 @@
 package cacheddownloader
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 )
 
+// ErrTooLargeForCache is returned by Put when the contents exceed the size of
+// the cache.
+var ErrTooLargeForCache = errors.New("File is too large for the cache")
+
+// ErrOutsideCacheSizeRange is returned by Put when the size of the contents
+// is outside the range set with WithCacheSizeRange.
+var ErrOutsideCacheSizeRange = errors.New("File size is outside the range of sizes that are cached")
+
+// ErrTooLargeForFetchBytes is returned by FetchBytes when the file exceeds the
+// limit set with WithFetchBytesLimit.
+var ErrTooLargeForFetchBytes = errors.New("File is too large to fetch into memory")
+
+// ErrTooManyOpenFiles is returned by fetches while as many readers as allowed
+// by WithMaxOpenFiles are open.
+var ErrTooManyOpenFiles = errors.New("Too many open files returned by the cache")
+
+// ErrCacheOutsideRoot is returned by New and Migrate when the cache
+// directory, with its symlinks resolved, is not inside the root set with
+// WithCacheRoot.
+var ErrCacheOutsideRoot = errors.New("Cache directory is outside the cache root")
+
+// ErrNegativeCacheSize is returned by New when maxSizeInBytes is negative.
+var ErrNegativeCacheSize = errors.New("Cache size must not be negative")
+
+// ErrTooManyWaiters is returned by fetches of a key that is already being
+// downloaded by as many other fetches as allowed by
+// WithMaxSingleflightWaiters.
+var ErrTooManyWaiters = errors.New("Too many fetches waiting for the same download")
+
+// DownloadPanicError is returned by a fetch whose download panicked, e.g. in
+// a SchemeHandler, a WithProgress callback or a sidecar verifier, once its
+// temporary file has been removed. That includes panics on the goroutines
+// fetching the chunks of a parallel download. Fetches waiting for the same download get
+// it too. See WithRepanic.
+type DownloadPanicError struct {
+	Value interface{}
+	Stack []byte
+
+	// repanic is set for the fetch that ran the download if WithRepanic
+	// was given
+	repanic bool
+}
+
+func (e *DownloadPanicError) Error() string {
+	return fmt.Sprintf("Download failed: panic: %v", e.Value)
+}
+
+// DefaultFetchBytesLimit is the largest file FetchBytes reads unless
+// WithFetchBytesLimit says otherwise.
+const DefaultFetchBytesLimit = 10 * 1024 * 1024
+
+// DefaultTempPrefix is the prefix of temporary files unless WithTempPrefix
+// says otherwise.
+const DefaultTempPrefix = "cacheddownloader-"
+
 type CachedDownloader interface {
 	Fetch(url *url.URL, cacheKey string) (io.ReadCloser, error)
+	FetchContext(ctx context.Context, url *url.URL, cacheKey string) (io.ReadCloser, error)
+	FetchInfo(url *url.URL, cacheKey string) (io.ReadCloser, FetchResult, error)
+	FetchWithAccept(url *url.URL, cacheKey string, accept string) (io.ReadCloser, error)
+	FetchWithMethod(url *url.URL, cacheKey string, method string, body []byte) (io.ReadCloser, error)
+	FetchForceRefresh(url *url.URL, cacheKey string) (io.ReadCloser, error)
+	FetchIfOlderThan(url *url.URL, cacheKey string, t time.Time) (io.ReadCloser, error)
+	BuildRequest(ctx context.Context, url *url.URL, cacheKey string) (*http.Request, error)
+	FetchWithFallbackURLs(urls []*url.URL, cacheKey string) (io.ReadCloser, error)
+	FetchVerified(url *url.URL, cacheKey string, sidecarSuffix string) (io.ReadCloser, error)
+	FetchUncachedWithChecksum(url *url.URL, checksum string) (io.ReadCloser, error)
+	FetchBytes(url *url.URL, cacheKey string) ([]byte, error)
+	FetchTo(w io.Writer, url *url.URL, cacheKey string) (int64, error)
+	FetchToPath(url *url.URL, cacheKey string, destPath string) error
+	FetchAndLinkAtomic(url *url.URL, cacheKey string, symlinkPath string) error
+	FetchMapped(url *url.URL, cacheKey string) ([]byte, func(), error)
+	ServeFile(w http.ResponseWriter, r *http.Request, url *url.URL, cacheKey string)
+	Put(cacheKey string, r io.Reader, info CachingInfoType) error
+	PutIfAbsent(cacheKey string, r io.Reader, info CachingInfoType) (bool, error)
+	PutIfMatch(cacheKey string, expectedETag string, r io.Reader, info CachingInfoType) (bool, error)
+	EntryInfo(cacheKey string) (CacheEntryInfo, bool)
+	InFlight(cacheKey string) bool
+	PutMetadata(cacheKey string, metadata map[string]string)
+	AwaitWarm(ctx context.Context, cacheKeys []string) error
+	Warm(ctx context.Context, requests []WarmRequest, maxTotalBytes int64) ([]WarmRequest, error)
+	List() []CacheEntryInfo
+	EvictionOrder() []CacheEntryInfo
+	AgeHistogram() []AgeBucket
+	SizeHistogram() []SizeBucket
+	Walk(walkFn func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error) error
+	LastResponseHeaders(cacheKey string) (http.Header, bool)
+	Verify(repair bool) (VerifyReport, error)
+	Migrate(newCachedPath string) error
+	EvictToSize(targetBytes int64) (int64, error)
+	Stats() Stats
+	Reset()
+	Events() <-chan CacheEvent
+	Namespace(name string) CachedDownloader
+	Close() error
+}
+
+// FetchResult describes the reader returned by FetchInfo.
+type FetchResult struct {
+	// FromCache is true when the bytes were served from an existing cache
+	// entry without downloading them again.
+	FromCache bool
+	// Shared is true when the reader is backed by a cache entry that later
+	// fetches may also read, and false when it is a private temporary file.
+	Shared bool
+	Size   int64
+	// CachingInfo is what the server said about the file when it was last
+	// downloaded or revalidated.
+	CachingInfo CachingInfoType
+	// Reason says why the file was downloaded, or is DownloadReasonNone if
+	// it was not.
+	Reason DownloadReason
+	// ModTime is the file's Last-Modified time, or when its bytes were
+	// written to disk if the server did not send one.
+	ModTime time.Time
+}
+
+// DownloadReason explains why a fetch went to the server for the file's bytes.
+type DownloadReason int
+
+const (
+	// DownloadReasonNone means nothing was downloaded: the entry was fresh,
+	// was revalidated with a 304 or was shared with a concurrent fetch.
+	DownloadReasonNone DownloadReason = iota
+	// DownloadReasonUncached means the fetch had no cache key.
+	DownloadReasonUncached
+	// DownloadReasonCold means there was no cache entry for the key.
+	DownloadReasonCold
+	// DownloadReasonExpired means the entry had expired and the server sent
+	// a different file.
+	DownloadReasonExpired
+	// DownloadReasonNoValidators means the entry had expired and had no ETag
+	// or Last-Modified to revalidate it with.
+	DownloadReasonNoValidators
+	// DownloadReasonConditionalIgnored means the server ignored a conditional
+	// request and sent the unchanged file again.
+	DownloadReasonConditionalIgnored
+	// DownloadReasonRefresh means the caller asked for the file to be
+	// downloaded in full with FetchForceRefresh.
+	DownloadReasonRefresh
+)
+
+func (r DownloadReason) String() string {
+	switch r {
+	case DownloadReasonNone:
+		return "none"
+	case DownloadReasonUncached:
+		return "uncached"
+	case DownloadReasonCold:
+		return "cold"
+	case DownloadReasonExpired:
+		return "expired"
+	case DownloadReasonNoValidators:
+		return "no-validators"
+	case DownloadReasonConditionalIgnored:
+		return "conditional-ignored"
+	case DownloadReasonRefresh:
+		return "refresh"
+	default:
+		return fmt.Sprintf("DownloadReason(%d)", int(r))
+	}
 }
 
 type CachingInfoType struct {
 	ETag         string
 	LastModified string
+	Vary         string
+
+	// Expires is when the response stops being fresh according to its
+	// Expires header, adjusted for the difference between the server and
+	// local clocks. It is zero if the response had no Expires header.
+	Expires time.Time
+
+	// Digest is the SHA-256 digest from the response's Digest header, as
+	// "sha-256=<base64>". Downloads are verified against it, and a download
+	// with the same digest as the cached entry is treated as unchanged.
+	Digest string
+
+	// ContentType is the response's Content-Type header.
+	ContentType string
+	// ContentEncoding is the encoding the file is stored in, e.g. gzip. It
+	// is empty if the file was not encoded or was decoded transparently,
+	// and is kept when the entry is revalidated, as the bytes do not change.
+	ContentEncoding string
+
+	// SourceURL is the URL the file was downloaded from, after redirects and
+	// without credentials. It is kept when the entry is revalidated, even
+	// against another URL.
+	SourceURL string
 }
 
 type cachedDownloader struct {
 	downloader   *Downloader
 	uncachedPath string
 	cache        *FileCache
+	dirLock      *os.File
+	stats        *stats
+
+	overflowDirLock *os.File
+	cacheRoot       string
+
+	fetchBytesLimit int64
+	tempPrefix      string
+	clock           Clock
+	openFiles       *openFileBudget
+	logger          Logger
+	warnedHosts     *hostSet
+	responseHeaders *responseHeaders
+	flights         *flightGroup
+	negativeCache   *negativeCache
+
+	events *eventStream
+
+	minContentLength      int64
+	urlRefresher          func(cacheKey string) (*url.URL, error)
+	staleWhileCircuitOpen bool
+	fetchObserver         func(cacheKey string, result FetchResult, duration time.Duration, err error)
+
+	cacheWithoutValidatorsTTL time.Duration
+
+	sidecarVerifiers map[string]SidecarVerifier
+
+	repanic bool
+
+	// cachingDisabled is set when the cache size is zero
+	cachingDisabled bool
+
+	links *linkSet
+
+	// keyPrefix starts the keys of the entries of a Namespace, and root is
+	// the downloader the namespace belongs to. Both are empty otherwise.
+	keyPrefix string
+	root      *cachedDownloader
 }
 
-func New(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloadTimeout time.Duration) *cachedDownloader {
-	os.RemoveAll(cachedPath)
-	os.MkdirAll(cachedPath, 0770)
+// New empties cachedPath and returns a downloader that caches into it. It
+// returns an error if cachedPath cannot be created or is not writable, and
+// ErrCacheLocked if another downloader that has not been closed already uses
+// cachedPath. With WithCacheRoot it returns ErrCacheOutsideRoot rather than
+// empty a cachedPath that resolves outside the root.
+//
+// A maxSizeInBytes of zero disables caching: every fetch downloads the file
+// into uncachedPath as if it had no cache key, and Put returns
+// ErrTooLargeForCache. A negative maxSizeInBytes is ErrNegativeCacheSize.
+func New(cachedPath string, uncachedPath string, maxSizeInBytes int64, downloadTimeout time.Duration, opts ...Option) (*cachedDownloader, error) {
+	if maxSizeInBytes < 0 {
+		return nil, ErrNegativeCacheSize
+	}
+
+	o := newOptions(opts)
+
+	dirLock, err := openCacheDir(cachedPath, o)
+	if err != nil {
+		return nil, err
+	}
+
+	var overflowDirLock *os.File
+	if o.overflowPath != "" {
+		overflowDirLock, err = openCacheDir(o.overflowPath, o)
+		if err != nil {
+			unlockDir(dirLock)
+			return nil, err
+		}
+	}
+
+	events := newEventStream(o.eventBufferSize)
+	cache := NewCache(cachedPath, maxSizeInBytes, opts...)
+	cache.events = events
+
 	return &cachedDownloader{
-		downloader:   NewDownloader(downloadTimeout),
+		downloader:   NewDownloader(downloadTimeout, opts...),
 		uncachedPath: uncachedPath,
-		cache:        NewCache(cachedPath, maxSizeInBytes),
+		cache:        cache,
+		dirLock:      dirLock,
+		stats:        newStats(),
+
+		overflowDirLock: overflowDirLock,
+		cacheRoot:       o.cacheRoot,
+
+		fetchBytesLimit: o.fetchBytesLimit,
+		tempPrefix:      o.tempPrefix,
+		clock:           o.clock,
+		openFiles:       &openFileBudget{max: o.maxOpenFiles},
+		logger:          o.logger,
+		warnedHosts:     &hostSet{hosts: map[string]bool{}},
+		responseHeaders: newResponseHeaders(maxResponseHeaderKeys),
+		flights:         &flightGroup{maxWaiters: o.maxSingleflightWaiters, flights: map[string]*flight{}},
+		negativeCache:   newNegativeCache(o.negativeCacheTTL, o.negativeCacheStatusCodes, o.clock, maxNegativeCacheKeys),
+
+		events: events,
+
+		minContentLength:      o.minContentLength,
+		urlRefresher:          o.urlRefresher,
+		staleWhileCircuitOpen: o.staleWhileCircuitOpen,
+		fetchObserver:         o.fetchObserver,
+
+		cacheWithoutValidatorsTTL: o.cacheWithoutValidatorsTTL,
+
+		sidecarVerifiers: newSidecarVerifiers(o.sidecarVerifiers),
+
+		repanic: o.repanic,
+
+		cachingDisabled: maxSizeInBytes == 0,
+
+		links: newLinkSet(),
+	}, nil
+}
+
+// openCacheDir creates, locks and empties a cache directory.
+func openCacheDir(cachedPath string, o options) (*os.File, error) {
+	err := os.MkdirAll(cachedPath, 0770)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkCacheRoot(cachedPath, o.cacheRoot)
+	if err != nil {
+		return nil, err
 	}
+
+	// Lock before emptying the directory so we never wipe the files of a
+	// downloader that is still using them
+	dirLock, err := lockDir(cachedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = prepareCacheDir(cachedPath, o)
+	if err != nil {
+		unlockDir(dirLock)
+		return nil, err
+	}
+
+	return dirLock, nil
+}
+
+// checkCacheRoot returns ErrCacheOutsideRoot unless cachedPath resolves to
+// root or a directory below it. Both are resolved with EvalSymlinks first, so
+// a symlink cannot point the cache, and the files New removes from it,
+// somewhere else. An empty root allows any path.
+func checkCacheRoot(cachedPath string, root string) error {
+	if root == "" {
+		return nil
+	}
+
+	resolvedPath, err := filepath.EvalSymlinks(cachedPath)
+	if err != nil {
+		return err
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(resolvedRoot, resolvedPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ErrCacheOutsideRoot
+	}
+	return nil
+}
+
+func prepareCacheDir(cachedPath string, o options) error {
+	entries, err := ioutil.ReadDir(cachedPath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		os.RemoveAll(filepath.Join(cachedPath, entry.Name()))
+	}
+
+	if o.dirMode != 0 {
+		// Chmod so the requested mode is not restricted by the umask
+		err = os.Chmod(cachedPath, o.dirMode)
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkWritable(cachedPath)
+}
+
+// Migrate moves the cache to newCachedPath, e.g. onto a new volume, and locks
+// it in place of the old directory. Unlike New it does not empty
+// newCachedPath. If some files cannot be moved it returns a *MigrateError
+// listing them, and their entries are removed, since another downloader may
+// empty the old directory once it is unlocked. It must not be called
+// concurrently with Close.
+func (c *cachedDownloader) Migrate(newCachedPath string) error {
+	if c.root != nil {
+		return c.root.Migrate(newCachedPath)
+	}
+
+	err := os.MkdirAll(newCachedPath, 0770)
+	if err != nil {
+		return err
+	}
+
+	err = checkCacheRoot(newCachedPath, c.cacheRoot)
+	if err != nil {
+		return err
+	}
+
+	dirLock, err := lockDir(newCachedPath)
+	if err != nil {
+		return err
+	}
+
+	err = checkWritable(newCachedPath)
+	if err != nil {
+		unlockDir(dirLock)
+		return err
+	}
+
+	err = c.cache.Migrate(newCachedPath)
+	if migrateErr, ok := err.(*MigrateError); ok {
+		for cacheKey := range migrateErr.Failures {
+			c.cache.RemoveEntry(cacheKey)
+		}
+	}
+	unlockDir(c.dirLock)
+	c.dirLock = dirLock
+	return err
+}
+
+// Close releases the lock on the cache directories so another downloader can
+// use them, and the files symlinked with FetchAndLinkAtomic.
+func (c *cachedDownloader) Close() error {
+	if c.root != nil {
+		return c.root.Close()
+	}
+
+	c.links.releaseAll()
+	err := unlockDir(c.dirLock)
+	if c.overflowDirLock != nil {
+		if overflowErr := unlockDir(c.overflowDirLock); err == nil {
+			err = overflowErr
+		}
+	}
+	return err
+}
+
+func checkWritable(dir string) error {
+	probe, err := ioutil.TempFile(dir, "probe-")
+	if err != nil {
+		return fmt.Errorf("Cache directory is not writable: %s", err)
+	}
+
+	probe.Close()
+	return os.RemoveAll(probe.Name())
+}
+
+// SetDownloadTimeout changes the response header timeout used by subsequent
+// downloads. Downloads already in flight are not affected.
+func (c *cachedDownloader) SetDownloadTimeout(timeout time.Duration) {
+	c.downloader.SetTimeout(timeout)
 }
 
 func (c *cachedDownloader) Fetch(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	reader, _, err := c.FetchInfo(url, cacheKey)
+	return reader, err
+}
+
+// FetchContext is Fetch, but gives up once ctx is done. A download that other
+// fetches of the same key are waiting for carries on until all of them have
+// given up too. A failed attempt is not retried if another one as slow would
+// overrun ctx's deadline; the error then matches context.DeadlineExceeded.
+func (c *cachedDownloader) FetchContext(ctx context.Context, url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{ctx: ctx})
+	return reader, err
+}
+
+func (c *cachedDownloader) FetchInfo(url *url.URL, cacheKey string) (io.ReadCloser, FetchResult, error) {
+	return c.fetch(url, cacheKey, downloadRequest{})
+}
+
+// FetchWithAccept sends accept as the request's Accept header. It is folded
+// into the cache key so each representation is cached separately.
+func (c *cachedDownloader) FetchWithAccept(url *url.URL, cacheKey string, accept string) (io.ReadCloser, error) {
+	header := http.Header{}
+	header.Set("Accept", accept)
+
+	if cacheKey != "" {
+		cacheKey = cacheKey + "\x00Accept: " + accept
+	}
+
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{header: header})
+	return reader, err
+}
+
+// FetchWithMethod sends a request with the given method and body, for
+// endpoints that serve content in response to a POST. Unless it is a GET
+// without a body, the method and a hash of the body are folded into the
+// cache key, so different bodies are cached separately.
+func (c *cachedDownloader) FetchWithMethod(url *url.URL, cacheKey string, method string, body []byte) (io.ReadCloser, error) {
+	if cacheKey != "" && (method != "GET" || len(body) > 0) {
+		cacheKey = fmt.Sprintf("%s\x00%s %x", cacheKey, method, sha256.Sum256(body))
+	}
+
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{method: method, body: body})
+	return reader, err
+}
+
+// FetchForceRefresh downloads the file in full even if the cached copy is
+// fresh or could be revalidated, and caches the result under cacheKey like
+// Fetch. It does not join a download of the same file already in flight, as
+// that may have started before the caller asked for the latest copy.
+func (c *cachedDownloader) FetchForceRefresh(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{refresh: true})
+	return reader, err
+}
+
+// FetchIfOlderThan serves the cached file without contacting the server if
+// it was downloaded after t, and otherwise revalidates or downloads it like
+// Fetch, whatever its TTL or Expires header say. It lets callers decide how
+// fresh each fetch has to be.
+func (c *cachedDownloader) FetchIfOlderThan(url *url.URL, cacheKey string, t time.Time) (io.ReadCloser, error) {
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{newerThan: t})
+	return reader, err
+}
+
+// BuildRequest returns the request a Fetch of url would send to revalidate
+// or download the file cached under cacheKey, without sending it: the URL
+// after WithURLRewriter, and the conditional headers for the cached entry.
+// Headers the transport adds as it sends the request, such as
+// Accept-Encoding, are not included.
+func (c *cachedDownloader) BuildRequest(ctx context.Context, url *url.URL, cacheKey string) (*http.Request, error) {
+	var cachingInfo CachingInfoType
+	if cacheKey != "" {
+		resourceKey := c.hashKey(cacheKey)
+		cachingInfo = c.cache.Info(varyCacheKey(resourceKey, c.cache.VaryHeaders(resourceKey), nil))
+	}
+
+	return c.downloader.newRequest(ctx, c.downloader.rewriteURL(url), cachingInfo, downloadRequest{})
+}
+
+// FetchWithFallbackURLs tries each of urls in order until one of them can be
+// fetched. Each URL is retried up to MAX_DOWNLOAD_ATTEMPTS times before
+// moving on to the next. The file is cached under cacheKey whichever URL it
+// came from, so mirrors share a cache entry. If every URL fails, the returned
+// error lists the failure for each one.
+func (c *cachedDownloader) FetchWithFallbackURLs(urls []*url.URL, cacheKey string) (io.ReadCloser, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("No URLs to fetch")
+	}
+
+	failures := make([]string, 0, len(urls))
+	for _, url := range urls {
+		reader, _, err := c.fetch(url, cacheKey, downloadRequest{})
+		if err == nil {
+			return reader, nil
+		}
+		if err == ErrTooManyOpenFiles {
+			return nil, err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %s", url, err))
+	}
+
+	return nil, fmt.Errorf("All %d URLs failed: %s", len(urls), strings.Join(failures, "; "))
+}
+
+// FetchUncachedWithChecksum downloads the file without caching it, like a
+// fetch with an empty cache key, for URLs that cannot be trusted. It returns
+// ErrChecksumMismatch unless the SHA-256 of the file is checksum, hex
+// encoded. Like every download it fails with ErrDownloadTooLarge beyond the
+// limits set with WithResponseBodyLimit and WithContentTypeSizeLimits, and
+// the temporary file is removed whenever it fails.
+func (c *cachedDownloader) FetchUncachedWithChecksum(url *url.URL, checksum string) (io.ReadCloser, error) {
+	expected, err := hex.DecodeString(checksum)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, fmt.Errorf("Invalid checksum %q", checksum)
+	}
+
+	verify := func(artifact io.Reader) error {
+		hash := sha256.New()
+		_, err := io.Copy(hash, artifact)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash.Sum(nil), expected) {
+			return ErrChecksumMismatch
+		}
+		return nil
+	}
+
+	reader, _, err := c.fetch(url, "", downloadRequest{verify: verify})
+	return reader, err
+}
+
+// FetchBytes reads the whole file into memory, for small files such as
+// configuration. It returns ErrTooLargeForFetchBytes rather than reading a
+// file larger than the configured limit.
+func (c *cachedDownloader) FetchBytes(url *url.URL, cacheKey string) ([]byte, error) {
+	reader, result, err := c.FetchInfo(url, cacheKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if result.Size > c.fetchBytesLimit {
+		return nil, ErrTooLargeForFetchBytes
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(reader, c.fetchBytesLimit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(content)) > c.fetchBytesLimit {
+		return nil, ErrTooLargeForFetchBytes
+	}
+
+	return content, nil
+}
+
+// FetchTo copies the file to w, for callers that only pipe it somewhere, and
+// returns the number of bytes written. A file that is not in the cache is
+// downloaded and cached as by Fetch first, so that w never receives the bytes
+// of a download that fails its checksum or is retried.
+func (c *cachedDownloader) FetchTo(w io.Writer, url *url.URL, cacheKey string) (int64, error) {
+	reader, _, err := c.FetchInfo(url, cacheKey)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	return io.Copy(w, reader)
+}
+
+// FetchToPath places the file at destPath, a path the caller owns, replacing
+// whatever is there in a single rename, so nothing ever sees part of the file.
+// The file is hardlinked there if destPath is on the same filesystem as the
+// cache, in which case it must be replaced rather than modified in place, and
+// copied otherwise.
+func (c *cachedDownloader) FetchToPath(url *url.URL, cacheKey string, destPath string) error {
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return placeFile(reader.(*fileCloser).file, reader, destPath)
+}
+
+// placeFile puts the file read from r, which is file, at destPath through a
+// temporary file next to it.
+func placeFile(file *os.File, r io.Reader, destPath string) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(destPath), "."+filepath.Base(destPath)+"-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	// Use os.RemoveAll because on windows, os.Remove will remove
+	// the dir of the file if the file doesn't exist and the dir of the file is
+	// empty.
+	defer os.RemoveAll(tmpPath)
+
+	// The temporary file only reserved a name for the link
+	os.RemoveAll(tmpPath)
+	if os.Link(file.Name(), tmpPath) != nil {
+		err = copyToNewFile(r, tmpPath, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+func copyToNewFile(r io.Reader, path string, mode os.FileMode) error {
+	dest, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dest, r)
+	closeErr := dest.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// FetchMapped maps the file into memory read-only, for files that are
+// consulted often, such as an index. The file stays on disk, even if it is
+// evicted, until release is called, after which data must not be used.
+// Reading data after the file was truncated behind the cache's back crashes
+// the process with SIGBUS. On platforms without mmap, such as Windows, the
+// file is read into memory instead.
+func (c *cachedDownloader) FetchMapped(url *url.URL, cacheKey string) ([]byte, func(), error) {
+	reader, _, err := c.fetch(url, cacheKey, downloadRequest{})
+	if err != nil {
+		return nil, nil, err
+	}
+	file := reader.(*fileCloser).file
+
+	info, err := file.Stat()
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+
+	data, unmap, err := mapFile(file, info.Size())
+	if err != nil {
+		reader.Close()
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			unmap()
+			reader.Close()
+		})
+	}
+	return data, release, nil
+}
+
+// ServeFile fetches the file through the cache and serves it to r with
+// http.ServeContent, which answers Range and conditional requests from the
+// local copy. Failing to fetch the file is reported as 502 Bad Gateway.
+//
+// A file stored with a Content-Encoding is served as stored, with that
+// header, so a client that accepts gzip gets the cached gzip bytes without
+// them being decoded and encoded again. Only a gzip file asked for by a
+// client that does not accept gzip is decoded on the way out.
+func (c *cachedDownloader) ServeFile(w http.ResponseWriter, r *http.Request, url *url.URL, cacheKey string) {
+	reader, result, err := c.FetchInfo(url, cacheKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer reader.Close()
+
+	if result.CachingInfo.ContentType != "" {
+		w.Header().Set("Content-Type", result.CachingInfo.ContentType)
+	}
+
+	// ServeContent ignores a zero modification time
+	modTime, _ := http.ParseTime(result.CachingInfo.LastModified)
+
+	encoding := result.CachingInfo.ContentEncoding
+	if encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if strings.EqualFold(encoding, "gzip") && !acceptsEncoding(r, "gzip") {
+		serveGunzipped(w, r, reader, modTime)
+		return
+	}
+
+	if result.CachingInfo.ETag != "" {
+		w.Header().Set("ETag", result.CachingInfo.ETag)
+	}
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
+	http.ServeContent(w, r, path.Base(url.Path), modTime, reader.(io.ReadSeeker))
+}
+
+func (c *cachedDownloader) fetch(url *url.URL, cacheKey string, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	if c.fetchObserver == nil {
+		reader, result, err := c.fetchFile(url, cacheKey, req)
+		repanic(err)
+		return reader, result, err
+	}
+
+	start := c.clock.Now()
+	reader, result, err := c.fetchFile(url, cacheKey, req)
+	c.fetchObserver(cacheKey, result, c.clock.Now().Sub(start), err)
+	repanic(err)
+	return reader, result, err
+}
+
+// repanic raises a panic WithRepanic asked to, now that it has been cleaned
+// up after.
+func repanic(err error) {
+	if panicErr, ok := err.(*DownloadPanicError); ok && panicErr.repanic {
+		panic(panicErr.Value)
+	}
+}
+
+func (c *cachedDownloader) fetchFile(url *url.URL, cacheKey string, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	if !c.openFiles.acquire() {
+		return nil, FetchResult{}, ErrTooManyOpenFiles
+	}
+
+	reader, result, err := c.fetchReader(url, cacheKey, req)
+	if err != nil && c.urlRefresher != nil && isAuthFailure(err) {
+		url, err = c.urlRefresher(cacheKey)
+		if err == nil {
+			reader, result, err = c.fetchReader(url, cacheKey, req)
+		}
+	}
+	if err != nil {
+		c.openFiles.release()
+		c.events.emit(CacheEvent{Type: EventError, CacheKey: c.eventCacheKey(cacheKey), URL: url, Err: err})
+		return nil, FetchResult{}, err
+	}
+
+	fc := reader.(*fileCloser)
+	onClose := fc.onClose
+	fc.onClose = func(path string) {
+		onClose(path)
+		c.openFiles.release()
+	}
+
+	result.ModTime = modTime(fc.file, result.CachingInfo)
+	return fc, result, nil
+}
+
+// modTime returns the Last-Modified time in cachingInfo, or the modification
+// time of file if there is none.
+func modTime(file *os.File, cachingInfo CachingInfoType) time.Time {
+	if t, err := http.ParseTime(cachingInfo.LastModified); err == nil {
+		return t
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (c *cachedDownloader) fetchReader(url *url.URL, cacheKey string, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	if cacheKey == "" || c.cachingDisabled {
+		return c.fetchUncachedFile(url, req)
+	}
+
+	reader, result, err := c.fetchCachedFileOnce(url, c.hashKey(cacheKey), req)
+	if err == nil {
+		c.stats.recordFetch(result.FromCache, result.Size)
+		if result.FromCache {
+			c.events.emit(CacheEvent{Type: EventHit, CacheKey: c.hashKey(cacheKey), URL: url, Size: result.Size})
+		}
+	}
+	return reader, result, err
+}
+
+// eventCacheKey is the key events report for a fetch of cacheKey.
+func (c *cachedDownloader) eventCacheKey(cacheKey string) string {
 	if cacheKey == "" {
-		return c.fetchUncachedFile(url)
-	} else {
-		cacheKey = fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
-		return c.fetchCachedFile(url, cacheKey)
+		return ""
+	}
+	return c.hashKey(cacheKey)
+}
+
+// Put stores the contents of r in the cache under cacheKey, as if it had been
+// downloaded with the given caching info. It returns ErrTooLargeForCache if
+// the contents do not fit in the cache, and ErrOutsideCacheSizeRange if
+// WithCacheSizeRange keeps them from being cached.
+func (c *cachedDownloader) Put(cacheKey string, r io.Reader, info CachingInfoType) error {
+	_, err := c.put(cacheKey, r, info, func(CachingInfoType, bool) bool {
+		return true
+	})
+	return err
+}
+
+// PutIfAbsent is Put, but only stores the contents if there is no entry for
+// cacheKey yet. It reports whether it stored them, so concurrent producers of
+// the same key can tell which of them won.
+func (c *cachedDownloader) PutIfAbsent(cacheKey string, r io.Reader, info CachingInfoType) (bool, error) {
+	return c.put(cacheKey, r, info, func(_ CachingInfoType, ok bool) bool {
+		return !ok
+	})
+}
+
+// PutIfMatch is Put, but only replaces the entry for cacheKey if its ETag is
+// still expectedETag, e.g. the one a producer read before computing the new
+// contents. It reports whether it stored them; if there is no entry at all
+// nothing matches.
+func (c *cachedDownloader) PutIfMatch(cacheKey string, expectedETag string, r io.Reader, info CachingInfoType) (bool, error) {
+	return c.put(cacheKey, r, info, func(current CachingInfoType, ok bool) bool {
+		return ok && current.ETag == expectedETag
+	})
+}
+
+// put copies r to a temporary file and adds it to the cache if cond holds
+// for the entry that is there by then.
+func (c *cachedDownloader) put(cacheKey string, r io.Reader, info CachingInfoType, cond func(current CachingInfoType, ok bool) bool) (bool, error) {
+	if c.cachingDisabled {
+		return false, ErrTooLargeForCache
+	}
+
+	cacheKey = c.hashKey(cacheKey)
+
+	file, err := c.tempFile(cacheKey)
+	if err != nil {
+		return false, err
+	}
+
+	// Use os.RemoveAll because on windows, os.Remove will remove
+	// the dir of the file if the file doesn't exist and the dir of the file is
+	// empty.
+	defer os.RemoveAll(file.Name())
+
+	size, err := io.Copy(file, r)
+	file.Close()
+	if err != nil {
+		return false, err
+	}
+
+	matched, movedToCache, err := c.cache.addIf(cacheKey, file.Name(), size, info, cond)
+	if err != nil || !matched {
+		return false, err
+	}
+
+	if !movedToCache {
+		if !c.cache.inSizeRange(size) {
+			return false, ErrOutsideCacheSizeRange
+		}
+		return false, ErrTooLargeForCache
+	}
+
+	return true, nil
+}
+
+// PutMetadata stores metadata with the entry for cacheKey, such as the
+// deployment it belongs to, for EntryInfo and List to return. See
+// FileCache.SetMetadata.
+func (c *cachedDownloader) PutMetadata(cacheKey string, metadata map[string]string) {
+	c.cache.SetMetadata(c.hashKey(cacheKey), metadata)
+}
+
+// AwaitWarm blocks until every one of cacheKeys is in the cache, e.g. after
+// concurrent fetches of them, and returns ctx's error if it is done first.
+// Like EntryInfo it does not see entries stored per variant because of Vary.
+func (c *cachedDownloader) AwaitWarm(ctx context.Context, cacheKeys []string) error {
+	hashedKeys := make([]string, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		hashedKeys[i] = c.hashKey(cacheKey)
+	}
+	return c.cache.AwaitEntries(ctx, hashedKeys)
+}
+
+// WarmRequest is a file for Warm to fetch into the cache.
+type WarmRequest struct {
+	URL      *url.URL
+	CacheKey string
+}
+
+// Warm fetches requests into the cache one after the other, e.g. to prefetch
+// artifacts during a maintenance window. Once the files it downloaded add up
+// to maxTotalBytes it stops and returns the requests it did not get to;
+// files served from the cache do not count. A maxTotalBytes of zero means no
+// budget. Warm stops at, and returns, the first error a fetch fails with,
+// including ctx's, along with the requests from the one that failed on, so
+// the caller can resume without fetching the earlier ones again.
+func (c *cachedDownloader) Warm(ctx context.Context, requests []WarmRequest, maxTotalBytes int64) ([]WarmRequest, error) {
+	var downloaded int64
+	for i, request := range requests {
+		if maxTotalBytes > 0 && downloaded >= maxTotalBytes {
+			return requests[i:], nil
+		}
+
+		reader, result, err := c.fetch(request.URL, request.CacheKey, downloadRequest{ctx: ctx})
+		if err != nil {
+			return requests[i:], err
+		}
+		reader.Close()
+
+		if !result.FromCache {
+			downloaded += result.Size
+		}
 	}
+	return nil, nil
+}
+
+// InFlight reports whether a fetch of cacheKey is downloading or revalidating
+// the file right now, e.g. so a prefetcher can skip it. It does not wait for
+// the download. Like EntryInfo it does not see downloads of variants stored
+// because of Vary, nor those of FetchForceRefresh and FetchVerified, which do
+// not share their downloads.
+func (c *cachedDownloader) InFlight(cacheKey string) bool {
+	resourceKey := c.hashKey(cacheKey)
+	return c.flights.inFlight(varyCacheKey(resourceKey, c.cache.VaryHeaders(resourceKey), nil))
+}
+
+// EntryInfo describes the cache entry for cacheKey, if there is one.
+func (c *cachedDownloader) EntryInfo(cacheKey string) (CacheEntryInfo, bool) {
+	return c.cache.EntryInfo(c.hashKey(cacheKey))
+}
+
+// List describes every entry currently in the cache.
+func (c *cachedDownloader) List() []CacheEntryInfo {
+	return c.inNamespace(c.cache.Entries())
+}
+
+// EvictionOrder describes every entry currently in the cache, in the order
+// they would be evicted to make room for new files.
+func (c *cachedDownloader) EvictionOrder() []CacheEntryInfo {
+	return c.inNamespace(c.cache.EvictionOrder())
+}
+
+// AgeHistogram buckets the entries by how long ago they were downloaded. See
+// WithAgeBuckets.
+func (c *cachedDownloader) AgeHistogram() []AgeBucket {
+	return c.cache.ageHistogram(c.keyPrefix)
+}
+
+// SizeHistogram buckets the entries by size. See WithSizeBuckets.
+func (c *cachedDownloader) SizeHistogram() []SizeBucket {
+	return c.cache.sizeHistogram(c.keyPrefix)
+}
+
+// Walk calls walkFn for every entry in the cache, e.g. to back it up. See
+// FileCache.Walk.
+func (c *cachedDownloader) Walk(walkFn func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error) error {
+	return c.cache.Walk(func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error {
+		if !strings.HasPrefix(entry.CacheKey, c.keyPrefix) {
+			return nil
+		}
+		return walkFn(entry, open)
+	})
 }
 
-func (c *cachedDownloader) fetchUncachedFile(url *url.URL) (io.ReadCloser, error) {
-	download, err := c.downloadFile(url, "uncached", CachingInfoType{})
+// LastResponseHeaders returns a copy of the headers of the most recent
+// download or revalidation for cacheKey, for debugging caching problems.
+// Headers are kept for the most recently downloaded keys only.
+func (c *cachedDownloader) LastResponseHeaders(cacheKey string) (http.Header, bool) {
+	return c.responseHeaders.get(c.hashKey(cacheKey))
+}
+
+// Verify reports cache entries whose file is missing and files in the cache
+// directory that belong to no entry. If repair is true, it also drops those
+// entries and deletes those files.
+func (c *cachedDownloader) Verify(repair bool) (VerifyReport, error) {
+	return c.cache.Verify(repair)
+}
+
+// EvictToSize evicts the least recently used entries until the cache holds at
+// most targetBytes, without changing its size limit. See
+// FileCache.EvictToSize.
+func (c *cachedDownloader) EvictToSize(targetBytes int64) (int64, error) {
+	return c.cache.EvictToSize(targetBytes)
+}
+
+// Stats returns a snapshot of the downloader's counters.
+func (c *cachedDownloader) Stats() Stats {
+	stats := c.stats.snapshot()
+	stats.Entries, stats.CacheBytes, stats.Evictions = c.cache.Usage()
+	stats.DroppedEvents = c.events.droppedEvents()
+	return stats
+}
+
+// Reset empties the cache, zeroes Stats and forgets negative cache entries
+// and LastResponseHeaders, e.g. between test cases that share a downloader.
+// The options, the lock on the cache directory and the files linked with
+// FetchAndLinkAtomic are left alone, and readers that are still open keep
+// their files until they are closed.
+func (c *cachedDownloader) Reset() {
+	c.cache.Reset()
+	c.stats.reset()
+	c.events.resetDropped()
+	c.negativeCache.reset()
+	c.responseHeaders.reset()
+}
+
+// Events returns the channel WithEvents delivers cache events to, or nil if
+// the option was not given.
+func (c *cachedDownloader) Events() <-chan CacheEvent {
+	return c.events.channel()
+}
+
+func hashCacheKey(cacheKey string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(cacheKey)))
+}
+
+func (c *cachedDownloader) fetchUncachedFile(url *url.URL, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	download, err := c.downloadFile(url, "uncached", CachingInfoType{}, req)
 
 	// Use os.RemoveAll because on windows, os.Remove will remove
 	// the dir of the file if the file doesn't exist and the dir of the file is
 	// empty.
 	defer os.RemoveAll(download.path)
 	if err != nil {
-		return nil, err
+		return nil, FetchResult{}, err
 	}
+	c.events.emit(CacheEvent{Type: EventDownloaded, URL: url, Size: download.size})
 
-	return tempFileCloser(download.path)
+	return tempFileCloser(download.path, FetchResult{Size: download.size, CachingInfo: download.cachingInfo, Reason: DownloadReasonUncached})
 }
 
-func (c *cachedDownloader) fetchCachedFile(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+// fetchCachedFileOnce makes concurrent fetches of the same key share one
+// download. The first fetch downloads the file and the others wait for it,
+// then open the cache entry it left. If it left none, for instance because
+// the file was not cachable, they download the file themselves.
+func (c *cachedDownloader) fetchCachedFileOnce(url *url.URL, resourceKey string, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	flightKey := varyCacheKey(resourceKey, c.cache.VaryHeaders(resourceKey), req.header)
+
+	if req.refresh || req.verify != nil {
+		return c.fetchCachedFile(url, resourceKey, req)
+	}
+
+	f, leader, err := c.flights.join(req.context(), flightKey)
+	if err != nil {
+		return nil, FetchResult{}, err
+	}
+
+	if leader {
+		// The download outlives the leader's context while others wait for
+		// it, and is cancelled once nobody does
+		stopWatching := c.flights.leaveWhenDone(req.context(), flightKey, f)
+		flightReq := req
+		flightReq.ctx = f.ctx
+		flightReq.deadline = func() (time.Time, bool) {
+			return c.flights.deadline(f)
+		}
+		reader, result, err := c.fetchCachedFile(url, resourceKey, flightReq)
+		stopWatching()
+		c.flights.land(flightKey, f, err == nil && result.Shared, err)
+		return reader, result, err
+	}
+
+	select {
+	case <-f.done:
+	case <-req.context().Done():
+		c.flights.leave(flightKey, f, false)
+		return nil, FetchResult{}, req.context().Err()
+	}
+	if panicErr, ok := f.err.(*DownloadPanicError); ok {
+		// Only the fetch that ran the download panics again
+		return nil, FetchResult{}, &DownloadPanicError{Value: panicErr.Value, Stack: panicErr.Stack}
+	}
+	if f.err != nil {
+		return nil, FetchResult{}, f.err
+	}
+
+	// The shared entry may be older than a FetchIfOlderThan wants, so that
+	// checks again itself
+	if f.shared && req.newerThan.IsZero() {
+		cacheKey := varyCacheKey(resourceKey, c.cache.VaryHeaders(resourceKey), req.header)
+		c.cache.RecordAccess(cacheKey)
+		reader, result, err := c.cachedFileCloser(cacheKey, FetchResult{FromCache: true, Shared: true})
+		if err == nil {
+			return reader, result, nil
+		}
+	}
+
+	return c.fetchCachedFile(url, resourceKey, req)
+}
+
+func (c *cachedDownloader) fetchCachedFile(url *url.URL, resourceKey string, req downloadRequest) (io.ReadCloser, FetchResult, error) {
+	cacheKey := varyCacheKey(resourceKey, c.cache.VaryHeaders(resourceKey), req.header)
 	c.cache.RecordAccess(cacheKey)
 
-	download, err := c.downloadFile(url, cacheKey, c.cache.Info(cacheKey))
+	if !req.newerThan.IsZero() {
+		info, ok := c.cache.EntryInfo(cacheKey)
+		if ok && info.Downloaded.After(req.newerThan) {
+			reader, result, err := c.cachedFileCloser(cacheKey, FetchResult{FromCache: true, Shared: true})
+			if err == nil {
+				return reader, result, nil
+			}
+		}
+	} else if !req.refresh {
+		reader, size, ok := c.cache.GetIfFresh(cacheKey)
+		if ok {
+			return reader, FetchResult{FromCache: true, Shared: true, Size: size, CachingInfo: c.cache.Info(cacheKey)}, nil
+		}
+	}
+
+	negativeKey := cacheKey + "\x00" + url.String()
+	if !req.refresh {
+		if err := c.negativeCache.get(negativeKey); err != nil {
+			return nil, FetchResult{}, err
+		}
+	}
+
+	_, hadEntry := c.cache.EntryInfo(cacheKey)
+	cachedInfo := c.cache.Info(cacheKey)
+	download, err := c.downloadFile(url, cacheKey, cachedInfo, req)
+	c.negativeCache.record(negativeKey, err)
+	if err == nil {
+		c.responseHeaders.record(resourceKey, download.header)
+	}
 
 	// Use os.RemoveAll because on windows, os.Remove will remove
 	// the dir of the file if the file doesn't exist and the dir of the file is
 	// empty.
 	defer os.RemoveAll(download.path)
+	if err == ErrCircuitOpen && c.staleWhileCircuitOpen {
+		reader, result, staleErr := c.cachedFileCloser(cacheKey, FetchResult{FromCache: true, Shared: true})
+		if staleErr == nil {
+			return reader, result, nil
+		}
+	}
 	if err != nil {
-		return nil, err
+		return nil, FetchResult{}, err
+	}
+
+	if !download.matchesCache {
+		c.events.emit(CacheEvent{Type: EventDownloaded, CacheKey: cacheKey, URL: url, Size: download.size})
+	}
+
+	reason := downloadReason(hadEntry, cachedInfo, download)
+	if req.refresh && !download.matchesCache {
+		reason = DownloadReasonRefresh
+	}
+	if !req.refresh && !download.matchesCache && sameValidators(cachedInfo, download.cachingInfo) {
+		c.stats.recordIneffectiveRevalidation()
+		if c.warnedHosts.add(url.Host) {
+			c.logger.Printf("cacheddownloader: %s ignored a conditional request and sent the unchanged file again, so it cannot be cached effectively", url.Host)
+		}
+	}
+
+	if digest := download.cachingInfo.Digest; !download.matchesCache && digest != "" && digest == c.cache.Info(cacheKey).Digest {
+		// The server sent the same bytes again, so keep the cached file,
+		// unless it has been evicted in the meantime
+		reader, result, err := c.revalidatedFileCloser(cacheKey, download.cachingInfo)
+		if err != errEntryEvicted {
+			result.Reason = reason
+			return reader, result, err
+		}
 	}
 
 	if download.matchesCache {
-		return c.cache.Get(cacheKey)
+		reader, result, err := c.revalidatedFileCloser(cacheKey, download.cachingInfo)
+		if err == errEntryEvicted {
+			// The entry was evicted while it was being revalidated, so
+			// there is nothing left to serve and the download starts over
+			return c.fetchCachedFile(url, resourceKey, req)
+		}
+		return reader, result, err
+	} else if download.size < c.minContentLength {
+		// A suspiciously small body is likely an error page sent with a 200,
+		// so keep any cached entry rather than replacing it
+		return tempFileCloser(download.path, FetchResult{Size: download.size, CachingInfo: download.cachingInfo, Reason: reason})
 	} else {
-		if download.isCachable() {
-			movedToCache, err := c.cache.Add(cacheKey, download.path, download.size, download.cachingInfo)
+		cachable := download.isCachable()
+		if !cachable && c.cacheWithoutValidatorsTTL > 0 {
+			// Without validators the entry can only be trusted until it
+			// expires, so make sure it does
+			if download.cachingInfo.Expires.IsZero() {
+				download.cachingInfo.Expires = c.clock.Now().Add(c.cacheWithoutValidatorsTTL)
+			}
+			cachable = true
+		}
+
+		varyNames, varyCachable := parseVary(download.cachingInfo.Vary)
+		if cachable && varyCachable {
+			c.cache.SetVaryHeaders(resourceKey, varyNames)
+			if variantKey := varyCacheKey(resourceKey, varyNames, req.header); variantKey != cacheKey {
+				c.cache.RemoveEntry(cacheKey)
+				cacheKey = variantKey
+			}
+
+			reader, movedToCache, err := c.cache.addAndOpen(cacheKey, download.path, download.size, download.cachingInfo)
 			if err != nil {
-				return nil, err
+				return nil, FetchResult{}, err
 			}
 
 			if movedToCache {
-				return c.cache.Get(cacheKey)
+				return reader, FetchResult{Shared: true, Size: download.size, CachingInfo: download.cachingInfo, Reason: reason}, nil
 			} else {
-				return tempFileCloser(download.path)
+				return tempFileCloser(download.path, FetchResult{Size: download.size, CachingInfo: download.cachingInfo, Reason: reason})
 			}
 		} else {
 			c.cache.RemoveEntry(cacheKey)
-			return tempFileCloser(download.path)
+			return tempFileCloser(download.path, FetchResult{Size: download.size, CachingInfo: download.cachingInfo, Reason: reason})
 		}
 	}
 }
 
-func tempFileCloser(path string) (io.ReadCloser, error) {
+func (c *cachedDownloader) cachedFileCloser(cacheKey string, result FetchResult) (io.ReadCloser, FetchResult, error) {
+	reader, size, cachingInfo, err := c.cache.open(cacheKey)
+	if err != nil {
+		return nil, FetchResult{}, err
+	}
+
+	result.Size = size
+	result.CachingInfo = cachingInfo
+	return reader, result, nil
+}
+
+func (c *cachedDownloader) revalidatedFileCloser(cacheKey string, cachingInfo CachingInfoType) (io.ReadCloser, FetchResult, error) {
+	reader, size, cachingInfo, err := c.cache.revalidatedAndOpen(cacheKey, cachingInfo)
+	if err != nil {
+		return nil, FetchResult{}, err
+	}
+
+	return reader, FetchResult{FromCache: true, Shared: true, Size: size, CachingInfo: cachingInfo}, nil
+}
+
+// tempFileCloser opens a new descriptor rather than reusing the one the
+// download was written through, so the reader always starts at offset 0.
+func tempFileCloser(path string, result FetchResult) (io.ReadCloser, FetchResult, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, FetchResult{}, err
 	}
 
 	return NewFileCloser(f, func(path string) {
 		os.RemoveAll(path)
-	}), nil
+	}), result, nil
 }
 
 type download struct {
@@ -108,29 +1330,85 @@ type download struct {
 	path         string
 	size         int64
 	cachingInfo  CachingInfoType
+	header       http.Header
+}
+
+// sameValidators reports whether a download carries the validators of the
+// entry it was meant to revalidate, i.e. whether it is the same file.
+func sameValidators(cached, downloaded CachingInfoType) bool {
+	if cached.ETag != "" {
+		return cached.ETag == downloaded.ETag
+	}
+	return cached.LastModified != "" && cached.LastModified == downloaded.LastModified
+}
+
+// downloadReason says why a cached fetch had to download the file rather
+// than serve or revalidate its entry.
+func downloadReason(hadEntry bool, cached CachingInfoType, d download) DownloadReason {
+	switch {
+	case d.matchesCache:
+		return DownloadReasonNone
+	case !hadEntry:
+		return DownloadReasonCold
+	case sameValidators(cached, d.cachingInfo), d.cachingInfo.Digest != "" && d.cachingInfo.Digest == cached.Digest:
+		return DownloadReasonConditionalIgnored
+	case cached.ETag == "" && cached.LastModified == "":
+		return DownloadReasonNoValidators
+	default:
+		return DownloadReasonExpired
+	}
 }
 
 func (d download) isCachable() bool {
 	return d.cachingInfo.ETag != "" || d.cachingInfo.LastModified != ""
 }
 
-func (c *cachedDownloader) downloadFile(url *url.URL, name string, cachingInfo CachingInfoType) (download, error) {
-	downloadedFile, err := ioutil.TempFile(c.uncachedPath, name+"-")
+// tempFile creates a file in the uncached path named after the configured
+// prefix, name and the current time.
+func (c *cachedDownloader) tempFile(name string) (*os.File, error) {
+	return ioutil.TempFile(c.uncachedPath, fmt.Sprintf("%s%s-%d-", c.tempPrefix, name, time.Now().UnixNano()))
+}
+
+func (c *cachedDownloader) downloadFile(url *url.URL, name string, cachingInfo CachingInfoType, req downloadRequest) (_ download, err error) {
+	downloadedFile, err := c.tempFile(name)
 	if err != nil {
 		return download{}, err
 	}
 
-	didDownload, size, cachingInfo, err := c.downloader.Download(url, downloadedFile, cachingInfo)
+	defer func() {
+		if p := recover(); p != nil {
+			downloadedFile.Close()
+			os.RemoveAll(downloadedFile.Name())
+			err = &DownloadPanicError{Value: p, Stack: debug.Stack(), repanic: c.repanic}
+		}
+	}()
+
+	startTime := time.Now()
+	result, err := c.downloader.download(url, downloadedFile, cachingInfo, req)
 	downloadedFile.Close()
 	if err != nil {
 		os.RemoveAll(downloadedFile.Name())
+		if panicErr, ok := err.(*DownloadPanicError); ok {
+			// A chunk of a parallel download panicked on its own goroutine
+			panicErr.repanic = c.repanic
+		}
 		return download{}, err
 	}
+	c.stats.recordDownload(time.Since(startTime), result.Size)
+
+	if result.DidDownload && req.verify != nil {
+		err = verifyFile(downloadedFile.Name(), req.verify)
+		if err != nil {
+			os.RemoveAll(downloadedFile.Name())
+			return download{}, err
+		}
+	}
 
 	return download{
-		matchesCache: !didDownload,
+		matchesCache: !result.DidDownload,
 		path:         downloadedFile.Name(),
-		size:         size,
-		cachingInfo:  cachingInfo,
+		size:         result.Size,
+		cachingInfo:  result.CachingInfo,
+		header:       result.Header,
 	}, nil
 }
@@ -1,15 +1,27 @@
 package cacheddownloader_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	Url "net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -18,6 +30,29 @@ import (
 	"github.com/pivotal-golang/cacheddownloader"
 )
 
+type fakeLogger struct {
+	messages []string
+}
+
+func (l *fakeLogger) Printf(format string, v ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+// panickingSchemeHandler copies from a reader that panics part way through,
+// like a buggy decompressor would.
+type panickingSchemeHandler struct{}
+
+func (h *panickingSchemeHandler) Download(ctx context.Context, url *Url.URL, destinationFile *os.File, cachingInfoIn cacheddownloader.CachingInfoType) (cacheddownloader.DownloadResult, error) {
+	_, err := io.Copy(destinationFile, io.MultiReader(strings.NewReader("partial"), panickingReader{}))
+	return cacheddownloader.DownloadResult{}, err
+}
+
+type panickingReader struct{}
+
+func (panickingReader) Read(p []byte) (int, error) {
+	panic("corrupt stream")
+}
+
 func computeMd5(key string) string {
 	return fmt.Sprintf("%x", md5.Sum([]byte(key)))
 }
@@ -46,7 +81,8 @@ var _ = Describe("File cache", func() {
 
 		cacheKey = "the-cache-key"
 
-		cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+		cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+		Ω(err).ShouldNot(HaveOccurred())
 		server = ghttp.NewServer()
 
 		url, err = Url.Parse(server.URL() + "/my_file")
@@ -54,6 +90,7 @@ var _ = Describe("File cache", func() {
 	})
 
 	AfterEach(func() {
+		cache.Close()
 		os.RemoveAll(cachedPath)
 		os.RemoveAll(uncachedPath)
 	})
@@ -65,23 +102,3351 @@ var _ = Describe("File cache", func() {
 
 	Describe("when the cache folder does not exist", func() {
 		It("should create it", func() {
+			cache.Close()
 			os.RemoveAll(cachedPath)
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
 			_, err := os.Stat(cachedPath)
 			Ω(err).ShouldNot(HaveOccurred())
 		})
 	})
 
+	Describe("when the cache size is zero", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, 0, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("downloads every fetch without caching it", func() {
+			url, _ := Url.Parse(server.URL() + "/my_file")
+			for i := 0; i < 2; i++ {
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					func(w http.ResponseWriter, req *http.Request) {
+						Ω(req.Header.Get("If-None-Match")).Should(BeEmpty())
+					},
+					ghttp.RespondWith(http.StatusOK, "content", http.Header{"ETag": []string{"my-etag"}}),
+				))
+
+				file, result, err := cache.FetchInfo(url, "my-key")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(result.FromCache).Should(BeFalse())
+				Ω(result.Reason).Should(Equal(cacheddownloader.DownloadReasonUncached))
+				Ω(ioutil.ReadAll(file)).Should(Equal([]byte("content")))
+				file.Close()
+			}
+
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+			Ω(filenamesInDir(cachedPath)).Should(BeEmpty())
+			Ω(cache.List()).Should(BeEmpty())
+		})
+
+		It("does not put anything in the cache", func() {
+			err := cache.Put("my-key", strings.NewReader(""), cacheddownloader.CachingInfoType{})
+			Ω(err).Should(Equal(cacheddownloader.ErrTooLargeForCache))
+			Ω(cache.List()).Should(BeEmpty())
+		})
+	})
+
+	Describe("when the cache size is negative", func() {
+		It("returns an error", func() {
+			cache.Close()
+			other, err := cacheddownloader.New(cachedPath, uncachedPath, -1, time.Second)
+			Ω(err).Should(Equal(cacheddownloader.ErrNegativeCacheSize))
+			Ω(other).Should(BeNil())
+		})
+	})
+
+	Describe("with a cache root", func() {
+		var root string
+		var elsewhere string
+
+		BeforeEach(func() {
+			cache.Close()
+
+			root, err = ioutil.TempDir("", "test_cache_root")
+			Ω(err).ShouldNot(HaveOccurred())
+			elsewhere, err = ioutil.TempDir("", "test_elsewhere")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.WriteFile(filepath.Join(elsewhere, "precious"), []byte("keep me"), 0644)).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(root)
+			os.RemoveAll(elsewhere)
+		})
+
+		It("accepts a directory below the root", func() {
+			cache, err = cacheddownloader.New(filepath.Join(root, "cache"), uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheRoot(root))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("refuses a directory outside the root", func() {
+			_, err = cacheddownloader.New(elsewhere, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheRoot(root))
+			Ω(err).Should(Equal(cacheddownloader.ErrCacheOutsideRoot))
+			Ω(filepath.Join(elsewhere, "precious")).Should(BeAnExistingFile())
+		})
+
+		It("refuses a symlink below the root that points outside it", func() {
+			if runtime.GOOS == "windows" {
+				Skip("creating symlinks needs extra privileges on Windows")
+			}
+
+			link := filepath.Join(root, "cache")
+			Ω(os.Symlink(elsewhere, link)).Should(Succeed())
+
+			_, err = cacheddownloader.New(link, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheRoot(root))
+			Ω(err).Should(Equal(cacheddownloader.ErrCacheOutsideRoot))
+			Ω(filepath.Join(elsewhere, "precious")).Should(BeAnExistingFile())
+		})
+	})
+
+	Describe("when another downloader uses the cache folder", func() {
+		It("should refuse to share it", func() {
+			filename := filepath.Join(cachedPath, "someone_elses_file")
+			ioutil.WriteFile(filename, []byte("mine"), 0666)
+
+			_, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).Should(Equal(cacheddownloader.ErrCacheLocked))
+
+			_, err = os.Stat(filename)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("should allow it to be used once the other downloader is closed", func() {
+			Ω(cache.Close()).Should(Succeed())
+
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+	})
+
+	Describe("when a directory mode is configured", func() {
+		It("should create the cache folder with that mode", func() {
+			if runtime.GOOS == "windows" {
+				Skip("directory modes are not supported on windows")
+			}
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithDirMode(0755))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			info, err := os.Stat(cachedPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0755)))
+		})
+	})
+
+	Describe("when the cache folder cannot be created", func() {
+		It("should return an error", func() {
+			filename := filepath.Join(cachedPath, "not_a_dir")
+			ioutil.WriteFile(filename, []byte("in the way"), 0666)
+			_, err := cacheddownloader.New(filepath.Join(filename, "cache"), uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("when the cache folder is not writable", func() {
+		BeforeEach(func() {
+			if runtime.GOOS == "windows" || os.Getuid() == 0 {
+				Skip("directory permissions are not enforced")
+			}
+		})
+
+		It("should return an error", func() {
+			parent := filepath.Join(cachedPath, "read-only")
+			Ω(os.MkdirAll(filepath.Join(parent, "cache"), 0770)).Should(Succeed())
+			Ω(os.Chmod(filepath.Join(parent, "cache"), 0500)).Should(Succeed())
+			Ω(os.Chmod(parent, 0500)).Should(Succeed())
+			defer os.Chmod(parent, 0700)
+
+			_, err := cacheddownloader.New(filepath.Join(parent, "cache"), uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
 	Describe("when the cache folder has stuff in it", func() {
 		It("should nuke that stuff", func() {
 			filename := filepath.Join(cachedPath, "last_nights_dinner")
 			ioutil.WriteFile(filename, []byte("leftovers"), 0666)
-			cache = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
 			_, err := os.Stat(filename)
 			Ω(err).Should(HaveOccurred())
 		})
 	})
 
+	Describe("when a URL rewriter is configured", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second,
+				cacheddownloader.WithURLRewriter(func(u *Url.URL) *Url.URL {
+					u.Path = "/mirror" + u.Path
+					return u
+				}),
+			)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			header := http.Header{}
+			header.Set("ETag", "foo")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/mirror/my_file"),
+				ghttp.RespondWith(http.StatusOK, "from the mirror", header),
+			))
+		})
+
+		It("caches the mirrored file under the original cache key", func() {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("from the mirror")))
+			file.Close()
+
+			paths, _ := filepath.Glob(filepath.Join(cachedPath, computeMd5(cacheKey)+"*"))
+			Ω(paths).Should(HaveLen(1))
+		})
+	})
+
+	Describe("FetchInfo", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			returnedHeader.Set("Content-Type", "application/json")
+		})
+
+		respondWith := func(status int, body string, header http.Header) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(status, body, header),
+			))
+		}
+
+		It("reports the same caching info whether or not the fetch is cached", func() {
+			expectedCachingInfo := cacheddownloader.CachingInfoType{
+				ETag:        "my-original-etag",
+				ContentType: "application/json",
+				SourceURL:   url.String(),
+			}
+
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, uncachedResult, err := cache.FetchInfo(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(uncachedResult.CachingInfo).Should(Equal(expectedCachingInfo))
+
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, cachedResult, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(cachedResult.CachingInfo).Should(Equal(expectedCachingInfo))
+
+			respondWith(http.StatusNotModified, "", nil)
+			file, revalidatedResult, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(revalidatedResult.CachingInfo).Should(Equal(expectedCachingInfo))
+		})
+
+		It("reports the Last-Modified time as the modification time", func() {
+			returnedHeader.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(result.ModTime).Should(Equal(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)))
+		})
+
+		It("reports when the file was written without a Last-Modified time", func() {
+			before := time.Now().Add(-time.Second)
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, downloadedResult, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(downloadedResult.ModTime).Should(BeTemporally(">", before))
+
+			By("reporting the same time for cache hits")
+			respondWith(http.StatusNotModified, "", nil)
+			file, cachedResult, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(cachedResult.FromCache).Should(BeTrue())
+			Ω(cachedResult.ModTime).Should(Equal(downloadedResult.ModTime))
+		})
+
+		It("reports the encoding the file is stored in", func() {
+			returnedHeader.Set("Content-Encoding", "br")
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(result.CachingInfo.ContentEncoding).Should(Equal("br"))
+
+			By("keeping it when the file is revalidated")
+			respondWith(http.StatusNotModified, "", nil)
+			file, result, err = cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(result.CachingInfo.ContentEncoding).Should(Equal("br"))
+		})
+
+		It("reports no encoding for files that were decoded transparently", func() {
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				Ω(r.Header.Get("Accept-Encoding")).Should(Equal("gzip"))
+				w.Header().Set("ETag", "my-original-etag")
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write([]byte("777"))
+				gz.Close()
+			})
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+			Ω(result.CachingInfo.ContentEncoding).Should(BeEmpty())
+		})
+
+		It("reports a private file for uncached fetches", func() {
+			respondWith(http.StatusOK, "777", returnedHeader)
+
+			file, result, err := cache.FetchInfo(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.Shared).Should(BeFalse())
+			Ω(result.FromCache).Should(BeFalse())
+			Ω(result.Size).Should(Equal(int64(3)))
+		})
+
+		It("reports a shared file for downloads admitted into the cache", func() {
+			respondWith(http.StatusOK, "777", returnedHeader)
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.Shared).Should(BeTrue())
+			Ω(result.FromCache).Should(BeFalse())
+			Ω(result.Size).Should(Equal(int64(3)))
+		})
+
+		It("reports a shared file served from the cache when it was not modified", func() {
+			respondWith(http.StatusOK, "777", returnedHeader)
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			respondWith(http.StatusNotModified, "", nil)
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.Shared).Should(BeTrue())
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(result.Size).Should(Equal(int64(3)))
+		})
+
+		It("reports a private file when the download is too large to cache", func() {
+			respondWith(http.StatusOK, strings.Repeat("7", int(maxSizeInBytes*2)), returnedHeader)
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.Shared).Should(BeFalse())
+			Ω(result.Size).Should(Equal(maxSizeInBytes * 2))
+		})
+
+		It("reports a private file when the download has no caching info", func() {
+			respondWith(http.StatusOK, "777", nil)
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.Shared).Should(BeFalse())
+		})
+
+		Describe("reporting why the file was downloaded", func() {
+			fetchReason := func(key string) cacheddownloader.DownloadReason {
+				file, result, err := cache.FetchInfo(url, key)
+				Ω(err).ShouldNot(HaveOccurred())
+				file.Close()
+				return result.Reason
+			}
+
+			It("reports uncached fetches", func() {
+				respondWith(http.StatusOK, "777", returnedHeader)
+				Ω(fetchReason("")).Should(Equal(cacheddownloader.DownloadReasonUncached))
+			})
+
+			It("reports a cold cache", func() {
+				respondWith(http.StatusOK, "777", returnedHeader)
+				Ω(fetchReason(cacheKey)).Should(Equal(cacheddownloader.DownloadReasonCold))
+			})
+
+			It("reports nothing when the entry was revalidated", func() {
+				respondWith(http.StatusOK, "777", returnedHeader)
+				respondWith(http.StatusNotModified, "", nil)
+				fetchReason(cacheKey)
+				Ω(fetchReason(cacheKey)).Should(Equal(cacheddownloader.DownloadReasonNone))
+			})
+
+			It("reports an expired entry that changed on the server", func() {
+				changedHeader := http.Header{}
+				changedHeader.Set("ETag", "my-new-etag")
+				respondWith(http.StatusOK, "777", returnedHeader)
+				respondWith(http.StatusOK, "888", changedHeader)
+				fetchReason(cacheKey)
+				Ω(fetchReason(cacheKey)).Should(Equal(cacheddownloader.DownloadReasonExpired))
+			})
+
+			It("reports a server that ignored the conditional request", func() {
+				respondWith(http.StatusOK, "777", returnedHeader)
+				respondWith(http.StatusOK, "777", returnedHeader)
+				fetchReason(cacheKey)
+				Ω(fetchReason(cacheKey)).Should(Equal(cacheddownloader.DownloadReasonConditionalIgnored))
+			})
+		})
+	})
+
+	Describe("Events", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, 5, time.Second, cacheddownloader.WithEvents(10))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		fetch := func(key string, status int) error {
+			header := http.Header{}
+			header.Set("ETag", "my-etag")
+			server.AppendHandlers(ghttp.RespondWith(status, "777", header))
+
+			file, err := cache.Fetch(url, key)
+			if err == nil {
+				file.Close()
+			}
+			return err
+		}
+
+		eventTypes := func() []cacheddownloader.CacheEventType {
+			types := []cacheddownloader.CacheEventType{}
+			for {
+				select {
+				case event := <-cache.Events():
+					types = append(types, event.Type)
+				default:
+					return types
+				}
+			}
+		}
+
+		It("reports downloads, admissions, evictions, hits and errors", func() {
+			Ω(fetch("a", http.StatusOK)).Should(Succeed())
+			Ω(eventTypes()).Should(Equal([]cacheddownloader.CacheEventType{cacheddownloader.EventDownloaded, cacheddownloader.EventAdmitted}))
+
+			Ω(fetch("b", http.StatusOK)).Should(Succeed())
+			Ω(eventTypes()).Should(Equal([]cacheddownloader.CacheEventType{cacheddownloader.EventDownloaded, cacheddownloader.EventEvicted, cacheddownloader.EventAdmitted}))
+
+			Ω(fetch("b", http.StatusNotModified)).Should(Succeed())
+			Ω(eventTypes()).Should(Equal([]cacheddownloader.CacheEventType{cacheddownloader.EventHit}))
+
+			for i := 0; i < cacheddownloader.MAX_DOWNLOAD_ATTEMPTS; i++ {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusInternalServerError, ""))
+			}
+			Ω(fetch("c", http.StatusInternalServerError)).ShouldNot(Succeed())
+			Ω(eventTypes()).Should(Equal([]cacheddownloader.CacheEventType{cacheddownloader.EventError}))
+		})
+
+		It("describes the event", func() {
+			Ω(fetch("", http.StatusOK)).Should(Succeed())
+
+			var event cacheddownloader.CacheEvent
+			Ω(cache.Events()).Should(Receive(&event))
+			Ω(event.Type).Should(Equal(cacheddownloader.EventDownloaded))
+			Ω(event.URL).Should(Equal(url))
+			Ω(event.Size).Should(Equal(int64(3)))
+		})
+
+		It("drops events the consumer has no room for", func() {
+			for i := 0; i < 10; i++ {
+				Ω(fetch("", http.StatusOK)).Should(Succeed())
+			}
+
+			Ω(cache.Stats().DroppedEvents).Should(Equal(uint64(0)))
+			Ω(fetch("a", http.StatusOK)).Should(Succeed())
+			Ω(cache.Stats().DroppedEvents).Should(Equal(uint64(2)))
+		})
+	})
+
+	Describe("PutIfAbsent", func() {
+		put := func(content string) (bool, error) {
+			return cache.PutIfAbsent(cacheKey, strings.NewReader(content), cacheddownloader.CachingInfoType{ETag: content + "-etag"})
+		}
+
+		It("stores the contents when there is no entry", func() {
+			Ω(put("first")).Should(BeTrue())
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CachingInfo.ETag).Should(Equal("first-etag"))
+		})
+
+		It("keeps an existing entry", func() {
+			Ω(put("first")).Should(BeTrue())
+			Ω(put("second")).Should(BeFalse())
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.CachingInfo.ETag).Should(Equal("first-etag"))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("stores the contents of exactly one of concurrent producers", func() {
+			results := make(chan bool, 10)
+			for i := 0; i < 10; i++ {
+				go func(i int) {
+					defer GinkgoRecover()
+					wrote, err := put(fmt.Sprintf("producer-%d", i))
+					Ω(err).ShouldNot(HaveOccurred())
+					results <- wrote
+				}(i)
+			}
+
+			winners := 0
+			for i := 0; i < 10; i++ {
+				if <-results {
+					winners++
+				}
+			}
+			Ω(winners).Should(Equal(1))
+		})
+
+		It("returns ErrTooLargeForCache when the contents do not fit", func() {
+			wrote, err := cache.PutIfAbsent(cacheKey, strings.NewReader(strings.Repeat("x", int(maxSizeInBytes)+1)), cacheddownloader.CachingInfoType{})
+			Ω(err).Should(Equal(cacheddownloader.ErrTooLargeForCache))
+			Ω(wrote).Should(BeFalse())
+		})
+	})
+
+	Describe("PutIfMatch", func() {
+		BeforeEach(func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("old"), cacheddownloader.CachingInfoType{ETag: "old-etag"})).Should(Succeed())
+		})
+
+		putIfMatch := func(cacheKey string, expectedETag string) (bool, error) {
+			return cache.PutIfMatch(cacheKey, expectedETag, strings.NewReader("new"), cacheddownloader.CachingInfoType{ETag: "new-etag"})
+		}
+
+		It("replaces an entry with the expected ETag", func() {
+			Ω(putIfMatch(cacheKey, "old-etag")).Should(BeTrue())
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.CachingInfo.ETag).Should(Equal("new-etag"))
+		})
+
+		It("keeps an entry that has changed since", func() {
+			Ω(putIfMatch(cacheKey, "stale-etag")).Should(BeFalse())
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.CachingInfo.ETag).Should(Equal("old-etag"))
+		})
+
+		It("stores nothing without an entry", func() {
+			Ω(putIfMatch("other-key", "")).Should(BeFalse())
+
+			_, ok := cache.EntryInfo("other-key")
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("PutMetadata", func() {
+		BeforeEach(func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("content"), cacheddownloader.CachingInfoType{ETag: "etag"})).Should(Succeed())
+		})
+
+		It("returns the metadata with the entry", func() {
+			metadata := map[string]string{"deployment": "d-1"}
+			cache.PutMetadata(cacheKey, metadata)
+			metadata["deployment"] = "changed"
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.Metadata).Should(Equal(map[string]string{"deployment": "d-1"}))
+			Ω(cache.List()[0].Metadata).Should(Equal(map[string]string{"deployment": "d-1"}))
+		})
+
+		It("keeps the metadata when the entry is revalidated", func() {
+			cache.PutMetadata(cacheKey, map[string]string{"deployment": "d-1"})
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotModified, ""))
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.Metadata).Should(HaveKeyWithValue("deployment", "d-1"))
+		})
+
+		It("stores nothing without an entry", func() {
+			cache.PutMetadata("other-key", map[string]string{"deployment": "d-1"})
+			_, ok := cache.EntryInfo("other-key")
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("Migrate", func() {
+		var newCachedPath string
+
+		BeforeEach(func() {
+			newCachedPath, err = ioutil.TempDir("", "new-cached")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(cache.Put(cacheKey, strings.NewReader("content"), cacheddownloader.CachingInfoType{ETag: "etag"})).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(newCachedPath)
+		})
+
+		It("serves the entries from the new directory", func() {
+			Ω(cache.Migrate(newCachedPath)).Should(Succeed())
+			Ω(filenamesInDir(newCachedPath)).Should(HaveLen(1))
+			Ω(filenamesInDir(cachedPath)).Should(BeEmpty())
+
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotModified, ""))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal("content"))
+		})
+
+		It("moves the directory lock", func() {
+			Ω(cache.Migrate(newCachedPath)).Should(Succeed())
+
+			_, err := cacheddownloader.New(newCachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).Should(Equal(cacheddownloader.ErrCacheLocked))
+
+			other, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
+			other.Close()
+		})
+
+		It("removes the entries it could not move before unlocking the old directory", func() {
+			var failMoves int32
+			rename := func(oldpath, newpath string) error {
+				if atomic.LoadInt32(&failMoves) == 1 {
+					return errors.New("rename failed")
+				}
+				return os.Rename(oldpath, newpath)
+			}
+			copyFile := func(dst io.Writer, src io.Reader) (int64, error) {
+				if atomic.LoadInt32(&failMoves) == 1 {
+					return 0, errors.New("copy failed")
+				}
+				return io.Copy(dst, src)
+			}
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithFileOps(rename, copyFile))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(cache.Put(cacheKey, strings.NewReader("content"), cacheddownloader.CachingInfoType{ETag: "etag"})).Should(Succeed())
+
+			atomic.StoreInt32(&failMoves, 1)
+			err := cache.Migrate(newCachedPath)
+			Ω(err).Should(BeAssignableToTypeOf(&cacheddownloader.MigrateError{}))
+			Ω(err.(*cacheddownloader.MigrateError).Failures).Should(HaveLen(1))
+
+			_, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeFalse())
+			Ω(filenamesInDir(cachedPath)).Should(BeEmpty())
+
+			other, err := cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second)
+			Ω(err).ShouldNot(HaveOccurred())
+			other.Close()
+		})
+	})
+
+	Describe("Namespace", func() {
+		var tenantA, tenantB cacheddownloader.CachedDownloader
+
+		BeforeEach(func() {
+			tenantA = cache.Namespace("tenant-a")
+			tenantB = cache.Namespace("tenant-b")
+		})
+
+		put := func(c cacheddownloader.CachedDownloader, key string, content string) {
+			Ω(c.Put(key, strings.NewReader(content), cacheddownloader.CachingInfoType{ETag: content + "-etag"})).Should(Succeed())
+		}
+
+		It("keeps the entries of each namespace apart", func() {
+			put(tenantA, cacheKey, "a")
+			put(tenantB, cacheKey, "b")
+
+			info, ok := tenantA.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CachingInfo.ETag).Should(Equal("a-etag"))
+
+			info, ok = tenantB.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CachingInfo.ETag).Should(Equal("b-etag"))
+
+			_, ok = cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("downloads the file once for each namespace", func() {
+			returnedHeader := http.Header{}
+			returnedHeader.Set("ETag", "my-etag")
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "content", returnedHeader),
+				ghttp.RespondWith(http.StatusOK, "content", returnedHeader),
+			)
+
+			for _, c := range []cacheddownloader.CachedDownloader{tenantA, tenantB} {
+				file, err := c.Fetch(url, cacheKey)
+				Ω(err).ShouldNot(HaveOccurred())
+				file.Close()
+			}
+
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+			Ω(tenantA.List()).Should(HaveLen(1))
+		})
+
+		It("only lists, walks and buckets the entries of the namespace", func() {
+			put(tenantA, "one", "a")
+			put(tenantA, "two", "a")
+			put(tenantB, "one", "b")
+
+			Ω(cache.List()).Should(HaveLen(3))
+			Ω(tenantA.List()).Should(HaveLen(2))
+			Ω(tenantA.EvictionOrder()).Should(HaveLen(2))
+			Ω(tenantB.List()).Should(HaveLen(1))
+
+			walked := 0
+			Ω(tenantB.Walk(func(entry cacheddownloader.CacheEntryInfo, open func() (io.ReadCloser, error)) error {
+				walked++
+				Ω(entry.CachingInfo.ETag).Should(Equal("b-etag"))
+				return nil
+			})).Should(Succeed())
+			Ω(walked).Should(Equal(1))
+
+			entries := 0
+			for _, bucket := range tenantA.SizeHistogram() {
+				entries += bucket.Entries
+			}
+			Ω(entries).Should(Equal(2))
+		})
+
+		It("keeps variants of a response that varies in the namespace", func() {
+			returnedHeader := http.Header{}
+			returnedHeader.Set("ETag", "my-etag")
+			returnedHeader.Set("Vary", "Accept")
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "rendered", returnedHeader))
+
+			file, err := tenantA.FetchWithAccept(url, cacheKey, "application/json")
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			Ω(tenantA.List()).Should(HaveLen(1))
+			Ω(tenantB.List()).Should(BeEmpty())
+		})
+
+		It("shares the size limit with the rest of the cache", func() {
+			put(tenantA, cacheKey, strings.Repeat("a", 600))
+			put(tenantB, cacheKey, strings.Repeat("b", 600))
+
+			Ω(tenantA.List()).Should(BeEmpty())
+			Ω(tenantB.List()).Should(HaveLen(1))
+		})
+
+		It("nests namespaces of a namespace", func() {
+			put(tenantA.Namespace("team"), cacheKey, "team")
+
+			Ω(tenantA.Namespace("team").List()).Should(HaveLen(1))
+			_, ok := tenantA.EntryInfo(cacheKey)
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("AwaitWarm", func() {
+		put := func(cacheKey string) {
+			Ω(cache.Put(cacheKey, strings.NewReader("content"), cacheddownloader.CachingInfoType{ETag: "etag"})).Should(Succeed())
+		}
+
+		It("returns at once when the keys are already cached", func() {
+			put("a")
+			Ω(cache.AwaitWarm(context.Background(), []string{"a"})).Should(Succeed())
+		})
+
+		It("blocks until every key has been cached", func() {
+			put("a")
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- cache.AwaitWarm(context.Background(), []string{"a", "b", "c"})
+			}()
+
+			put("b")
+			Consistently(errs).ShouldNot(Receive())
+
+			put("c")
+			Eventually(errs).Should(Receive(BeNil()))
+		})
+
+		It("gives up when the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- cache.AwaitWarm(ctx, []string{"a"})
+			}()
+
+			Consistently(errs).ShouldNot(Receive())
+			cancel()
+			Eventually(errs).Should(Receive(Equal(context.Canceled)))
+		})
+	})
+
+	Describe("Warm", func() {
+		var requests []cacheddownloader.WarmRequest
+
+		BeforeEach(func() {
+			requests = nil
+			for _, name := range []string{"a", "b", "c"} {
+				server.RouteToHandler("GET", "/"+name, ghttp.RespondWith(http.StatusOK, "12345", http.Header{"ETag": []string{name + "-etag"}}))
+				url, _ := Url.Parse(server.URL() + "/" + name)
+				requests = append(requests, cacheddownloader.WarmRequest{URL: url, CacheKey: name})
+			}
+		})
+
+		It("fetches every request into the cache", func() {
+			skipped, err := cache.Warm(context.Background(), requests, 0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(skipped).Should(BeEmpty())
+			Ω(cache.List()).Should(HaveLen(3))
+		})
+
+		It("stops once the downloads add up to the budget", func() {
+			skipped, err := cache.Warm(context.Background(), requests, 6)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(skipped).Should(Equal(requests[2:]))
+			Ω(cache.List()).Should(HaveLen(2))
+		})
+
+		It("does not count files served from the cache", func() {
+			Ω(cache.Put("a", strings.NewReader("12345"), cacheddownloader.CachingInfoType{ETag: "a-etag"})).Should(Succeed())
+			server.RouteToHandler("GET", "/a", ghttp.RespondWith(http.StatusNotModified, ""))
+
+			skipped, err := cache.Warm(context.Background(), requests, 6)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(skipped).Should(BeEmpty())
+		})
+
+		It("returns the first error", func() {
+			server.RouteToHandler("GET", "/b", ghttp.RespondWith(http.StatusNotFound, ""))
+
+			skipped, err := cache.Warm(context.Background(), requests, 0)
+			Ω(err).Should(HaveOccurred())
+			Ω(skipped).Should(Equal(requests[1:]))
+			Ω(cache.List()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("EntryInfo", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+		})
+
+		fetchWithStatus := func(status int) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(status, "777", returnedHeader),
+			))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		}
+
+		It("does not describe keys that are not cached", func() {
+			_, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeFalse())
+			Ω(cache.List()).Should(BeEmpty())
+		})
+
+		It("describes the cached entry", func() {
+			fetchWithStatus(http.StatusOK)
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CacheKey).Should(Equal(computeMd5(cacheKey)))
+			Ω(info.Size).Should(Equal(int64(3)))
+			Ω(info.CachingInfo.ETag).Should(Equal("my-original-etag"))
+			Ω(info.Downloaded).ShouldNot(BeZero())
+			Ω(cache.List()).Should(ConsistOf(info))
+		})
+
+		It("keeps the download time when the entry is revalidated", func() {
+			fetchWithStatus(http.StatusOK)
+			before, _ := cache.EntryInfo(cacheKey)
+
+			time.Sleep(10 * time.Millisecond)
+			fetchWithStatus(http.StatusNotModified)
+
+			after, _ := cache.EntryInfo(cacheKey)
+			Ω(after.Downloaded).Should(Equal(before.Downloaded))
+			Ω(after.LastAccess).Should(BeTemporally(">", before.LastAccess))
+		})
+
+		It("updates the download time when the entry is downloaded again", func() {
+			fetchWithStatus(http.StatusOK)
+			before, _ := cache.EntryInfo(cacheKey)
+
+			time.Sleep(10 * time.Millisecond)
+			fetchWithStatus(http.StatusOK)
+
+			after, _ := cache.EntryInfo(cacheKey)
+			Ω(after.Downloaded).Should(BeTemporally(">", before.Downloaded))
+		})
+
+		It("records the URL the file was downloaded from after redirects", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusFound, "", http.Header{"Location": []string{"/moved?version=2"}}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/moved", "version=2"),
+					ghttp.RespondWith(http.StatusOK, "777", returnedHeader),
+				),
+			)
+			userURL, _ := Url.Parse(server.URL() + "/my_file")
+			userURL.User = Url.UserPassword("user", "secret")
+			file, err := cache.Fetch(userURL, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.SourceURL).Should(Equal(server.URL() + "/moved?version=2"))
+			Ω(info.CachingInfo.SourceURL).Should(Equal(info.SourceURL))
+
+			By("keeping it when the entry is revalidated")
+			fetchWithStatus(http.StatusNotModified)
+			info, _ = cache.EntryInfo(cacheKey)
+			Ω(info.SourceURL).Should(Equal(server.URL() + "/moved?version=2"))
+		})
+	})
+
+	Describe("when a TTL is configured", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(50*time.Millisecond))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "777", returnedHeader),
+			))
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		It("serves fresh entries without contacting the server", func() {
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("revalidates entries once the TTL has expired", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+
+			time.Sleep(60 * time.Millisecond)
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+
+			By("restarting the TTL after a successful revalidation")
+			file, err = cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("when a minimum revalidation interval is configured", func() {
+		var clock *fakeClock
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithMinRevalidationInterval(time.Minute), cacheddownloader.WithClock(clock))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "777", http.Header{
+				"ETag":    []string{"my-original-etag"},
+				"Expires": []string{clock.Now().Add(-time.Hour).Format(http.TimeFormat)},
+			}))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		fetch := func() cacheddownloader.FetchResult {
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			return result
+		}
+
+		It("serves the entry without revalidating it within the interval, even if it has expired", func() {
+			clock.Step(59 * time.Second)
+			Ω(fetch().FromCache).Should(BeTrue())
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("revalidates the entry once the interval has passed", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+
+			clock.Step(time.Minute)
+			Ω(fetch().FromCache).Should(BeTrue())
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+
+			By("restarting the interval after the revalidation")
+			clock.Step(30 * time.Second)
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("still revalidates for FetchForceRefresh", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusNotModified, ""))
+
+			file, err := cache.FetchForceRefresh(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("when the response has an Expires header", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+		})
+
+		fetch := func() {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		}
+
+		respondWith := func(status int, header http.Header) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(status, "777", header),
+			))
+		}
+
+		It("serves the entry without revalidation until it expires", func() {
+			returnedHeader.Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			respondWith(http.StatusOK, returnedHeader)
+
+			fetch()
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CachingInfo.Expires).Should(BeTemporally("~", time.Now().Add(time.Hour), 5*time.Second))
+		})
+
+		It("measures the expiry against the server's Date header", func() {
+			serverNow := time.Now().Add(-24 * time.Hour)
+			returnedHeader.Set("Date", serverNow.UTC().Format(http.TimeFormat))
+			returnedHeader.Set("Expires", serverNow.Add(time.Hour).UTC().Format(http.TimeFormat))
+			respondWith(http.StatusOK, returnedHeader)
+
+			fetch()
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("revalidates entries that have already expired", func() {
+			returnedHeader.Set("Expires", "0")
+			respondWith(http.StatusOK, returnedHeader)
+			fetch()
+
+			notModifiedHeader := http.Header{}
+			notModifiedHeader.Set("Expires", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			respondWith(http.StatusNotModified, notModifiedHeader)
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+
+			By("taking the new expiry from the revalidation")
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("prefers an expiry in the past over the TTL", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			returnedHeader.Set("Expires", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+			respondWith(http.StatusOK, returnedHeader)
+			respondWith(http.StatusNotModified, nil)
+
+			fetch()
+			fetch()
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("when there is an overflow tier", func() {
+		var overflowPath string
+
+		BeforeEach(func() {
+			overflowPath, err = ioutil.TempDir("", "test_file_overflow")
+			Ω(err).ShouldNot(HaveOccurred())
+			ioutil.WriteFile(filepath.Join(overflowPath, "stale_file"), []byte("stale"), 0666)
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, 5, time.Second, cacheddownloader.WithOverflowTier(overflowPath, maxSizeInBytes))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(overflowPath)
+		})
+
+		fetch := func(path string, status int, body string) io.ReadCloser {
+			header := http.Header{}
+			header.Set("ETag", path+"-etag")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", path),
+				ghttp.RespondWith(status, body, header),
+			))
+
+			fileURL, err := Url.Parse(server.URL() + path)
+			Ω(err).ShouldNot(HaveOccurred())
+			file, err := cache.Fetch(fileURL, path)
+			Ω(err).ShouldNot(HaveOccurred())
+			return file
+		}
+
+		It("empties the overflow directory", func() {
+			Ω(filenamesInDir(overflowPath)).ShouldNot(ContainElement("stale_file"))
+		})
+
+		It("revalidates entries from the overflow tier rather than downloading them again", func() {
+			fetch("/a", http.StatusOK, "aaa").Close()
+			fetch("/b", http.StatusOK, "bbb").Close()
+
+			file := fetch("/a", http.StatusNotModified, "")
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("aaa")))
+		})
+	})
+
+	Describe("when downloads without validators are cached", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheWithoutValidators(50*time.Millisecond))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "777"),
+			))
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		It("serves them from the cache until the TTL expires", func() {
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			Ω(filenamesInDir(cachedPath)).Should(HaveLen(1))
+		})
+
+		It("downloads them again in full once the TTL has expired", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				func(w http.ResponseWriter, r *http.Request) {
+					Ω(r.Header.Get("If-None-Match")).Should(BeEmpty())
+					Ω(r.Header.Get("If-Modified-Since")).Should(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusOK, "888"),
+			))
+
+			time.Sleep(60 * time.Millisecond)
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("888")))
+			Ω(result.FromCache).Should(BeFalse())
+			Ω(result.Reason).Should(Equal(cacheddownloader.DownloadReasonNoValidators))
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("when the response has a Digest header", func() {
+		var digest string
+
+		respondWith := func(etag string) {
+			header := http.Header{}
+			header.Set("ETag", etag)
+			header.Set("Digest", digest)
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "777", header),
+			))
+		}
+
+		BeforeEach(func() {
+			sum := sha256.Sum256([]byte("777"))
+			digest = "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+			respondWith("my-original-etag")
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		It("exposes the digest through FetchInfo", func() {
+			respondWith("my-original-etag")
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(result.CachingInfo.Digest).Should(Equal(digest))
+		})
+
+		It("keeps the cached file when a download has the same digest", func() {
+			cachedFiles := filenamesInDir(cachedPath)
+			respondWith("my-new-etag")
+
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(filenamesInDir(cachedPath)).Should(Equal(cachedFiles))
+
+			By("storing the new validators")
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.CachingInfo.ETag).Should(Equal("my-new-etag"))
+		})
+	})
+
+	Describe("the warm hit path", func() {
+		BeforeEach(func() {
+			returnedHeader := http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("If-None-Match") == "my-original-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				ghttp.RespondWith(http.StatusOK, "777", returnedHeader)(w, req)
+			})
+		})
+
+		fetch := func() {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		}
+
+		Measure("revalidates with the server without a TTL", func(b Benchmarker) {
+			fetch()
+			b.Time("fetch", fetch)
+		}, 100)
+
+		Measure("only opens the cached file within the TTL", func(b Benchmarker) {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fetch()
+			b.Time("fetch", fetch)
+		}, 100)
+	})
+
+	Describe("FetchWithAccept", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("ETag", req.Header.Get("Accept"))
+				fmt.Fprintf(w, "rendered as %s", req.Header.Get("Accept"))
+			})
+		})
+
+		fetchWithAccept := func(accept string) string {
+			file, err := cache.FetchWithAccept(url, cacheKey, accept)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("sends the Accept header", func() {
+			Ω(fetchWithAccept("application/json")).Should(Equal("rendered as application/json"))
+		})
+
+		It("caches each representation separately", func() {
+			Ω(fetchWithAccept("application/json")).Should(Equal("rendered as application/json"))
+			Ω(fetchWithAccept("text/yaml")).Should(Equal("rendered as text/yaml"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(2))
+
+			Ω(fetchWithAccept("application/json")).Should(Equal("rendered as application/json"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(2))
+		})
+	})
+
+	Describe("with a negative cache", func() {
+		var clock *fakeClock
+		var status int
+		var requests int
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithNegativeCache(time.Minute), cacheddownloader.WithClock(clock))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			status = http.StatusNotFound
+			requests = 0
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				requests++
+				w.Header().Set("ETag", "the-etag")
+				w.WriteHeader(status)
+				if status == http.StatusOK {
+					fmt.Fprint(w, "content")
+				}
+			})
+		})
+
+		fetch := func() error {
+			file, err := cache.Fetch(url, cacheKey)
+			if err == nil {
+				file.Close()
+			}
+			return err
+		}
+
+		It("fails with the remembered error without a request", func() {
+			firstErr := fetch()
+			Ω(firstErr).Should(MatchError("Download failed: Status code 404"))
+			Ω(requests).Should(Equal(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+
+			Ω(fetch()).Should(Equal(firstErr))
+			Ω(requests).Should(Equal(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+		})
+
+		It("asks the server again once the TTL has passed", func() {
+			fetch()
+			clock.Step(time.Minute)
+			status = http.StatusOK
+
+			Ω(fetch()).Should(Succeed())
+			Ω(requests).Should(Equal(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS + 1))
+		})
+
+		It("forgets the failure once a download succeeds", func() {
+			fetch()
+			status = http.StatusOK
+			file, err := cache.FetchForceRefresh(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			status = http.StatusNotFound
+			clock.Step(time.Second)
+			Ω(fetch()).Should(HaveOccurred())
+			Ω(requests).Should(Equal(2*cacheddownloader.MAX_DOWNLOAD_ATTEMPTS + 1))
+		})
+
+		It("does not remember other failures", func() {
+			status = http.StatusForbidden
+			fetch()
+			fetch()
+			Ω(requests).Should(Equal(2 * cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+		})
+
+		It("remembers the given status codes", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithNegativeCache(time.Minute, http.StatusNotFound, http.StatusForbidden), cacheddownloader.WithClock(clock))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			status = http.StatusForbidden
+			fetch()
+			fetch()
+			Ω(requests).Should(Equal(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+		})
+	})
+
+	Describe("retrying within a deadline", func() {
+		var requests int32
+		var delay time.Duration
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&requests, 0)
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				time.Sleep(delay)
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+		})
+
+		It("stops retrying when another attempt would overrun the deadline", func() {
+			delay = 150 * time.Millisecond
+			ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+			defer cancel()
+
+			started := time.Now()
+			_, err := cache.FetchContext(ctx, url, cacheKey)
+			Ω(errors.Is(err, context.DeadlineExceeded)).Should(BeTrue())
+			Ω(err.Error()).Should(ContainSubstring("500"))
+			Ω(time.Since(started)).Should(BeNumerically("<", 250*time.Millisecond))
+			Ω(atomic.LoadInt32(&requests)).Should(BeEquivalentTo(1))
+		})
+
+		It("keeps retrying while there is time left", func() {
+			delay = 0
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			_, err := cache.FetchContext(ctx, url, cacheKey)
+			Ω(err).Should(HaveOccurred())
+			Ω(errors.Is(err, context.DeadlineExceeded)).Should(BeFalse())
+			Ω(atomic.LoadInt32(&requests)).Should(BeEquivalentTo(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+		})
+	})
+
+	Describe("with a fetch observer", func() {
+		type observation struct {
+			cacheKey string
+			result   cacheddownloader.FetchResult
+			duration time.Duration
+			err      error
+		}
+
+		var clock *fakeClock
+		var observations []observation
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			observations = nil
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithClock(clock), cacheddownloader.WithFetchObserver(func(cacheKey string, result cacheddownloader.FetchResult, duration time.Duration, err error) {
+				observations = append(observations, observation{cacheKey, result, duration, err})
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("observes downloads and cache hits with how long they took", func() {
+			header := http.Header{}
+			header.Set("ETag", "my-etag")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					func(http.ResponseWriter, *http.Request) { clock.Step(3 * time.Second) },
+					ghttp.RespondWith(http.StatusOK, "content", header),
+				),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			)
+
+			for i := 0; i < 2; i++ {
+				file, err := cache.Fetch(url, cacheKey)
+				Ω(err).ShouldNot(HaveOccurred())
+				file.Close()
+			}
+
+			Ω(observations).Should(HaveLen(2))
+			Ω(observations[0].cacheKey).Should(Equal(cacheKey))
+			Ω(observations[0].result.FromCache).Should(BeFalse())
+			Ω(observations[0].duration).Should(Equal(3 * time.Second))
+			Ω(observations[0].err).ShouldNot(HaveOccurred())
+			Ω(observations[1].result.FromCache).Should(BeTrue())
+			Ω(observations[1].duration).Should(BeZero())
+		})
+
+		It("observes failed fetches", func() {
+			server.AllowUnhandledRequests = true
+			server.UnhandledRequestStatusCode = http.StatusNotFound
+
+			_, err := cache.FetchContext(context.Background(), url, cacheKey)
+			Ω(err).Should(HaveOccurred())
+
+			Ω(observations).Should(HaveLen(1))
+			Ω(observations[0].err).Should(Equal(err))
+		})
+	})
+
+	Describe("BuildRequest", func() {
+		It("builds an unconditional GET for an uncached key", func() {
+			req, err := cache.BuildRequest(context.Background(), url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(req.Method).Should(Equal("GET"))
+			Ω(req.URL.String()).Should(Equal(url.String()))
+			Ω(req.Header.Get("If-None-Match")).Should(BeEmpty())
+			Ω(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("adds the conditional headers of the cached entry", func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("content"), cacheddownloader.CachingInfoType{ETag: "etag", LastModified: "Mon, 02 Jan 2006 15:04:05 GMT"})).Should(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, err := cache.BuildRequest(ctx, url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(req.Context()).Should(Equal(ctx))
+			Ω(req.Header.Get("If-None-Match")).Should(Equal("etag"))
+			Ω(req.Header.Get("If-Modified-Since")).Should(Equal("Mon, 02 Jan 2006 15:04:05 GMT"))
+		})
+
+		It("uses the rewritten URL", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithURLRewriter(func(u *Url.URL) *Url.URL {
+				u.Host = "mirror.example.com"
+				return u
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			req, err := cache.BuildRequest(context.Background(), url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(req.URL.Host).Should(Equal("mirror.example.com"))
+			Ω(url.Host).ShouldNot(Equal("mirror.example.com"))
+		})
+	})
+
+	Describe("FetchIfOlderThan", func() {
+		var clock *fakeClock
+		var conditionalHeaders []string
+		var downloadedAt time.Time
+
+		BeforeEach(func() {
+			downloadedAt = time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+			clock = &fakeClock{now: downloadedAt}
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(time.Hour), cacheddownloader.WithClock(clock))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			conditionalHeaders = nil
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				conditionalHeaders = append(conditionalHeaders, req.Header.Get("If-None-Match"))
+				if req.Header.Get("If-None-Match") == "the-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "the-etag")
+				fmt.Fprint(w, "content")
+			})
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			clock.Step(time.Minute)
+		})
+
+		read := func(file io.ReadCloser, err error) string {
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("serves a copy downloaded after t without asking the server", func() {
+			Ω(read(cache.FetchIfOlderThan(url, cacheKey, downloadedAt.Add(-time.Second)))).Should(Equal("content"))
+			Ω(conditionalHeaders).Should(Equal([]string{""}))
+		})
+
+		It("revalidates an older copy even though it is fresh", func() {
+			Ω(read(cache.FetchIfOlderThan(url, cacheKey, downloadedAt.Add(time.Second)))).Should(Equal("content"))
+			Ω(conditionalHeaders).Should(Equal([]string{"", "the-etag"}))
+		})
+
+		It("downloads the file when nothing is cached", func() {
+			Ω(read(cache.FetchIfOlderThan(url, "other-key", downloadedAt))).Should(Equal("content"))
+			Ω(conditionalHeaders).Should(Equal([]string{"", ""}))
+		})
+	})
+
+	Describe("when the file is empty", func() {
+		var conditionalHeaders []string
+		var content string
+
+		BeforeEach(func() {
+			conditionalHeaders = nil
+			content = ""
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				conditionalHeaders = append(conditionalHeaders, req.Header.Get("If-None-Match"))
+				etag := fmt.Sprintf(`"%d"`, len(content))
+				w.Header().Set("ETag", etag)
+				if req.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprint(w, content)
+			})
+		})
+
+		fetch := func() (string, cacheddownloader.FetchResult) {
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			body, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(body), result
+		}
+
+		It("caches it", func() {
+			body, result := fetch()
+			Ω(body).Should(BeEmpty())
+			Ω(result.FromCache).Should(BeFalse())
+			Ω(result.Size).Should(BeZero())
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.Size).Should(BeZero())
+			Ω(cache.Stats().Entries).Should(Equal(1))
+			Ω(cache.Stats().CacheBytes).Should(BeZero())
+		})
+
+		It("serves it from the cache once revalidated", func() {
+			fetch()
+			body, result := fetch()
+			Ω(body).Should(BeEmpty())
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(conditionalHeaders).Should(Equal([]string{"", `"0"`}))
+		})
+
+		It("serves it from the cache without a request", func() {
+			fetch()
+			file, err := cache.FetchIfOlderThan(url, cacheKey, time.Now().Add(-time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(BeEmpty())
+			Ω(conditionalHeaders).Should(HaveLen(1))
+		})
+
+		It("maps it", func() {
+			fetch()
+			data, release, err := cache.FetchMapped(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer release()
+			Ω(data).Should(BeEmpty())
+		})
+
+		It("replaces it when the file gets content", func() {
+			fetch()
+			content = "now with content"
+			body, result := fetch()
+			Ω(body).Should(Equal("now with content"))
+			Ω(result.FromCache).Should(BeFalse())
+			Ω(cache.Stats().CacheBytes).Should(BeEquivalentTo(len("now with content")))
+		})
+
+		It("takes up no room", func() {
+			fetch()
+			Ω(cache.Put("full", strings.NewReader(strings.Repeat("x", int(maxSizeInBytes))), cacheddownloader.CachingInfoType{})).Should(Succeed())
+
+			_, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(cache.Stats().CacheBytes).Should(Equal(maxSizeInBytes))
+		})
+	})
+
+	Describe("FetchForceRefresh", func() {
+		var conditionalHeaders []string
+		var content string
+
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			conditionalHeaders = nil
+			content = "old"
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				conditionalHeaders = append(conditionalHeaders, req.Header.Get("If-None-Match"))
+				w.Header().Set("ETag", content+"-etag")
+				fmt.Fprint(w, content)
+			})
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		read := func(file io.ReadCloser, err error) string {
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("downloads the file unconditionally even when the cached copy is fresh", func() {
+			content = "new"
+			Ω(read(cache.FetchForceRefresh(url, cacheKey))).Should(Equal("new"))
+			Ω(conditionalHeaders).Should(Equal([]string{"", ""}))
+		})
+
+		It("caches the fresh copy", func() {
+			content = "new"
+			read(cache.FetchForceRefresh(url, cacheKey))
+
+			Ω(read(cache.Fetch(url, cacheKey))).Should(Equal("new"))
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+		})
+	})
+
+	Describe("when the circuit of a host is open", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second,
+				cacheddownloader.WithCircuitBreaker(1, time.Minute, time.Hour),
+				cacheddownloader.WithStaleWhileCircuitOpen(),
+			)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			header := http.Header{}
+			header.Set("ETag", "my-etag")
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "stale content", header),
+				ghttp.RespondWith(http.StatusServiceUnavailable, ""),
+			)
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			_, err = cache.Fetch(url, "")
+			Ω(err).Should(Equal(cacheddownloader.ErrCircuitOpen))
+		})
+
+		It("serves the cached entry however stale", func() {
+			file, result, err := cache.FetchInfo(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("stale content")))
+			Ω(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("fails when there is no entry", func() {
+			_, err := cache.Fetch(url, "other-key")
+			Ω(err).Should(Equal(cacheddownloader.ErrCircuitOpen))
+		})
+	})
+
+	Describe("refreshing signed URLs", func() {
+		var refreshedKeys []string
+		var signature string
+
+		BeforeEach(func() {
+			refreshedKeys = nil
+			signature = "valid"
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Query().Get("signature") != signature {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Header().Set("ETag", "my-etag")
+				if req.Header.Get("If-None-Match") == "my-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fmt.Fprint(w, "signed content")
+			})
+
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithURLRefresher(func(cacheKey string) (*Url.URL, error) {
+				refreshedKeys = append(refreshedKeys, cacheKey)
+				return Url.Parse(server.URL() + "/my_file?signature=" + signature)
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		signedURL := func(signature string) *Url.URL {
+			signedURL, err := Url.Parse(server.URL() + "/my_file?signature=" + signature)
+			Ω(err).ShouldNot(HaveOccurred())
+			return signedURL
+		}
+
+		It("retries with a refreshed URL when the signature is rejected", func() {
+			file, err := cache.Fetch(signedURL("expired"), cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("signed content")))
+			Ω(refreshedKeys).Should(Equal([]string{cacheKey}))
+		})
+
+		It("revalidates the entry under the same cache key", func() {
+			file, err := cache.Fetch(signedURL("valid"), cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			signature = "rotated"
+			file, result, err := cache.FetchInfo(signedURL("valid"), cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			Ω(result.FromCache).Should(BeTrue())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("signed content")))
+		})
+
+		It("returns the error of the refresher", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithURLRefresher(func(cacheKey string) (*Url.URL, error) {
+				return nil, errors.New("cannot sign")
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err := cache.Fetch(signedURL("expired"), cacheKey)
+			Ω(err).Should(MatchError("cannot sign"))
+		})
+
+		It("does not refresh the URL for other errors", func() {
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := cache.Fetch(signedURL("valid"), cacheKey)
+			Ω(err).Should(HaveOccurred())
+			Ω(refreshedKeys).Should(BeEmpty())
+		})
+	})
+
+	Describe("FetchWithMethod", func() {
+		var conditionalHeaders []string
+
+		BeforeEach(func() {
+			conditionalHeaders = nil
+			server.RouteToHandler("POST", "/my_file", func(w http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				conditionalHeaders = append(conditionalHeaders, req.Header.Get("If-None-Match"))
+				w.Header().Set("ETag", "my-etag")
+				fmt.Fprintf(w, "posted %s", body)
+			})
+		})
+
+		fetchWithMethod := func(method string, body string) string {
+			file, err := cache.FetchWithMethod(url, cacheKey, method, []byte(body))
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("sends the method and body", func() {
+			Ω(fetchWithMethod("POST", "query-a")).Should(Equal("posted query-a"))
+		})
+
+		It("caches each body separately", func() {
+			Ω(fetchWithMethod("POST", "query-a")).Should(Equal("posted query-a"))
+			Ω(fetchWithMethod("POST", "query-b")).Should(Equal("posted query-b"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(2))
+		})
+
+		It("does not send conditional headers", func() {
+			fetchWithMethod("POST", "query-a")
+			Ω(fetchWithMethod("POST", "query-a")).Should(Equal("posted query-a"))
+			Ω(conditionalHeaders).Should(Equal([]string{"", ""}))
+		})
+
+		It("shares the cache entry of Fetch for a GET without a body", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "got", http.Header{"ETag": []string{"my-etag"}}),
+			))
+			Ω(fetchWithMethod("GET", "")).Should(Equal("got"))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("got")))
+		})
+	})
+
+	Describe("FetchVerified", func() {
+		sidecarFor := func(content string) string {
+			return fmt.Sprintf("%x  my_file\n", sha256.Sum256([]byte(content)))
+		}
+
+		var header http.Header
+
+		BeforeEach(func() {
+			header = http.Header{}
+			header.Set("ETag", "my-etag")
+		})
+
+		read := func(file io.ReadCloser) string {
+			defer file.Close()
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("caches and returns a file that matches its sidecar", func() {
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file.sha256"),
+					ghttp.RespondWith(http.StatusOK, sidecarFor("the-content")),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, "the-content", header),
+				),
+			)
+
+			file, err := cache.FetchVerified(url, cacheKey, ".sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(read(file)).Should(Equal("the-content"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+		})
+
+		It("neither caches nor returns a file that does not match", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, sidecarFor("the-content")),
+				ghttp.RespondWith(http.StatusOK, "tampered", header),
+			)
+
+			_, err := cache.FetchVerified(url, cacheKey, ".sha256")
+			Ω(err).Should(Equal(cacheddownloader.ErrSidecarMismatch))
+			Ω(ioutil.ReadDir(cachedPath)).Should(BeEmpty())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("downloads a cached file again once it no longer matches the sidecar", func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("old-content"), cacheddownloader.CachingInfoType{ETag: "my-etag"})).Should(Succeed())
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, sidecarFor("new-content")),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+				ghttp.CombineHandlers(
+					func(w http.ResponseWriter, r *http.Request) {
+						Ω(r.Header.Get("If-None-Match")).Should(BeEmpty())
+					},
+					ghttp.RespondWith(http.StatusOK, "new-content", header),
+				),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			)
+
+			file, err := cache.FetchVerified(url, cacheKey, ".sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(read(file)).Should(Equal("new-content"))
+
+			file, err = cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(read(file)).Should(Equal("new-content"))
+		})
+
+		It("rewinds a cached file it has verified", func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("the-content"), cacheddownloader.CachingInfoType{ETag: "my-etag"})).Should(Succeed())
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, sidecarFor("the-content")),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			)
+
+			file, err := cache.FetchVerified(url, cacheKey, ".sha256")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(read(file)).Should(Equal("the-content"))
+		})
+
+		It("fails for a sidecar suffix without a verifier", func() {
+			_, err := cache.FetchVerified(url, cacheKey, ".sig")
+			Ω(err).Should(HaveOccurred())
+			Ω(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("uses the verifiers it is configured with", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithSidecarVerifier(".sig", func(artifact io.Reader, sidecar []byte) error {
+				content, err := ioutil.ReadAll(artifact)
+				if err != nil {
+					return err
+				}
+				if string(sidecar) != "signed:"+string(content) {
+					return errors.New("bad signature")
+				}
+				return nil
+			}))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file.sig"),
+					ghttp.RespondWith(http.StatusOK, "signed:the-content"),
+				),
+				ghttp.RespondWith(http.StatusOK, "the-content", header),
+			)
+
+			file, err := cache.FetchVerified(url, cacheKey, ".sig")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(read(file)).Should(Equal("the-content"))
+		})
+	})
+
+	Describe("FetchWithFallbackURLs", func() {
+		var mirror *ghttp.Server
+		var mirrorURL *Url.URL
+
+		BeforeEach(func() {
+			mirror = ghttp.NewServer()
+
+			var err error
+			mirrorURL, err = Url.Parse(mirror.URL() + "/my_file")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			mirror.Close()
+		})
+
+		readAll := func(file io.ReadCloser) string {
+			defer file.Close()
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("falls back to the next URL once the first one keeps failing", func() {
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusInternalServerError, ""))
+			mirror.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "from the mirror", http.Header{"ETag": []string{"my-etag"}}))
+
+			file, err := cache.FetchWithFallbackURLs([]*Url.URL{url, mirrorURL}, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readAll(file)).Should(Equal("from the mirror"))
+
+			Ω(server.ReceivedRequests()).Should(HaveLen(cacheddownloader.MAX_DOWNLOAD_ATTEMPTS))
+			Ω(mirror.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("caches under the key whichever URL the file came from", func() {
+			mirror.AppendHandlers(ghttp.RespondWith(http.StatusOK, "from the mirror", http.Header{"ETag": []string{"my-etag"}}))
+			file, err := cache.FetchWithFallbackURLs([]*Url.URL{mirrorURL}, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readAll(file)).Should(Equal("from the mirror"))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+			file, err = cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(readAll(file)).Should(Equal("from the mirror"))
+		})
+
+		It("reports the failure for every URL when they all fail", func() {
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusInternalServerError, ""))
+			mirror.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusNotFound, ""))
+
+			_, err := cache.FetchWithFallbackURLs([]*Url.URL{url, mirrorURL}, cacheKey)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring(url.String() + ": Download failed: Status code 500"))
+			Ω(err.Error()).Should(ContainSubstring(mirrorURL.String() + ": Download failed: Status code 404"))
+		})
+
+		It("fails without any URLs", func() {
+			_, err := cache.FetchWithFallbackURLs(nil, cacheKey)
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("when the response has a Vary header", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+		})
+
+		fetch := func(accept string) string {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "rendered", returnedHeader),
+			))
+
+			file, err := cache.FetchWithAccept(url, cacheKey, accept)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("caches responses that vary on headers", func() {
+			returnedHeader.Set("Vary", "Accept")
+			fetch("application/json")
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+			file, err := cache.FetchWithAccept(url, cacheKey, "application/json")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("rendered")))
+			file.Close()
+		})
+
+		It("does not cache responses that vary on everything", func() {
+			returnedHeader.Set("Vary", "*")
+			Ω(fetch("application/json")).Should(Equal("rendered"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(0))
+		})
+
+		It("drops an existing entry once the response varies on everything", func() {
+			fetch("application/json")
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+
+			returnedHeader.Set("Vary", "Accept, *")
+			fetch("application/json")
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(0))
+		})
+	})
+
+	Describe("LastResponseHeaders", func() {
+		fetch := func() {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		}
+
+		It("is not found before anything was downloaded", func() {
+			_, ok := cache.LastResponseHeaders(cacheKey)
+			Ω(ok).Should(BeFalse())
+		})
+
+		It("returns the headers of the last download", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "content", http.Header{
+				"ETag":          []string{"my-etag"},
+				"Cache-Control": []string{"no-transform"},
+			}))
+			fetch()
+
+			header, ok := cache.LastResponseHeaders(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(header.Get("ETag")).Should(Equal("my-etag"))
+			Ω(header.Get("Cache-Control")).Should(Equal("no-transform"))
+		})
+
+		It("returns the headers of the last revalidation", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "content", http.Header{"ETag": []string{"my-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, "", http.Header{"X-Revalidated": []string{"true"}}),
+			)
+			fetch()
+			fetch()
+
+			header, ok := cache.LastResponseHeaders(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(header.Get("X-Revalidated")).Should(Equal("true"))
+		})
+
+		It("returns a copy", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "content", http.Header{"ETag": []string{"my-etag"}}))
+			fetch()
+
+			header, _ := cache.LastResponseHeaders(cacheKey)
+			header.Set("ETag", "changed")
+
+			header, _ = cache.LastResponseHeaders(cacheKey)
+			Ω(header.Get("ETag")).Should(Equal("my-etag"))
+		})
+	})
+
+	Describe("Stats", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+		})
+
+		fetch := func(name string, status int, size int) {
+			url, _ := Url.Parse(server.URL() + "/" + name)
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/"+name),
+				ghttp.RespondWith(status, strings.Repeat("7", size), returnedHeader),
+			))
+			file, err := cache.Fetch(url, name)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		}
+
+		It("counts hits, misses and downloads", func() {
+			fetch("A", http.StatusOK, 10)
+			fetch("A", http.StatusNotModified, 0)
+			fetch("B", http.StatusOK, 20)
+
+			stats := cache.Stats()
+			Ω(stats.Hits).Should(Equal(uint64(1)))
+			Ω(stats.Misses).Should(Equal(uint64(2)))
+			Ω(stats.Entries).Should(Equal(2))
+			Ω(stats.CacheBytes).Should(Equal(int64(30)))
+			Ω(stats.DownloadDurations.Count).Should(Equal(uint64(3)))
+			Ω(stats.DownloadDurations.Buckets[300]).Should(Equal(uint64(3)))
+		})
+
+		It("counts the bytes downloaded and served from the cache", func() {
+			fetch("A", http.StatusOK, 10)
+			fetch("A", http.StatusNotModified, 0)
+			fetch("A", http.StatusNotModified, 0)
+			fetch("B", http.StatusOK, 20)
+
+			stats := cache.Stats()
+			Ω(stats.BytesDownloaded).Should(BeEquivalentTo(30))
+			Ω(stats.BytesServedFromCache).Should(BeEquivalentTo(20))
+		})
+
+		It("counts and warns once about servers that ignore conditional requests", func() {
+			logger := &fakeLogger{}
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithLogger(logger))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fetch("A", http.StatusOK, 10)
+			fetch("A", http.StatusOK, 10)
+			fetch("A", http.StatusOK, 10)
+
+			Ω(cache.Stats().IneffectiveRevalidations).Should(Equal(uint64(2)))
+			Ω(logger.messages).Should(HaveLen(1))
+			Ω(logger.messages[0]).Should(ContainSubstring("ignored a conditional request"))
+
+			By("not counting downloads of a changed file")
+			returnedHeader.Set("ETag", "my-new-etag")
+			fetch("A", http.StatusOK, 10)
+			Ω(cache.Stats().IneffectiveRevalidations).Should(Equal(uint64(2)))
+		})
+
+		It("counts evictions", func() {
+			fetch("A", http.StatusOK, int(maxSizeInBytes/2))
+			fetch("B", http.StatusOK, int(maxSizeInBytes/2))
+			fetch("C", http.StatusOK, int(maxSizeInBytes/2))
+
+			stats := cache.Stats()
+			Ω(stats.Evictions).Should(Equal(uint64(1)))
+			Ω(stats.Entries).Should(Equal(2))
+		})
+	})
+
+	Describe("Reset", func() {
+		fetch := func(name string) io.ReadCloser {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/"+name),
+				func(w http.ResponseWriter, req *http.Request) {
+					Ω(req.Header.Get("If-None-Match")).Should(BeEmpty())
+				},
+				ghttp.RespondWith(http.StatusOK, name+"-content", http.Header{"ETag": []string{name + "-etag"}}),
+			))
+			url, _ := Url.Parse(server.URL() + "/" + name)
+			file, err := cache.Fetch(url, name)
+			Ω(err).ShouldNot(HaveOccurred())
+			return file
+		}
+
+		It("empties the cache and zeroes the stats", func() {
+			fetch("A").Close()
+			fetch("B").Close()
+
+			cache.Reset()
+			Ω(cache.List()).Should(BeEmpty())
+			Ω(filenamesInDir(cachedPath)).Should(BeEmpty())
+			stats := cache.Stats()
+			Ω(stats.Misses).Should(BeZero())
+			Ω(stats.Entries).Should(BeZero())
+			Ω(stats.BytesDownloaded).Should(BeZero())
+			Ω(stats.DownloadDurations.Count).Should(BeZero())
+
+			By("downloading the files again")
+			fetch("A").Close()
+			Ω(cache.Stats().Misses).Should(BeEquivalentTo(1))
+		})
+
+		It("keeps open files until they are closed", func() {
+			file := fetch("A")
+
+			cache.Reset()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("A-content")))
+			Ω(filenamesInDir(cachedPath)).Should(HaveLen(1))
+
+			file.Close()
+			Ω(filenamesInDir(cachedPath)).Should(BeEmpty())
+		})
+	})
+
+	Describe("Put", func() {
+		It("makes the contents available to subsequent fetches", func() {
+			err := cache.Put(cacheKey, strings.NewReader("locally built"), cacheddownloader.CachingInfoType{ETag: "local-etag"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(HaveLen(0))
+
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"local-etag"}}),
+				ghttp.RespondWith(http.StatusNotModified, ""),
+			))
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("locally built")))
+		})
+
+		It("replaces an existing entry", func() {
+			Ω(cache.Put(cacheKey, strings.NewReader("first"), cacheddownloader.CachingInfoType{ETag: "1"})).Should(Succeed())
+			Ω(cache.Put(cacheKey, strings.NewReader("second"), cacheddownloader.CachingInfoType{ETag: "2"})).Should(Succeed())
+
+			info, ok := cache.EntryInfo(cacheKey)
+			Ω(ok).Should(BeTrue())
+			Ω(info.Size).Should(Equal(int64(len("second"))))
+			Ω(info.CachingInfo.ETag).Should(Equal("2"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+		})
+
+		It("evicts older entries to make room", func() {
+			Ω(cache.Put("A", strings.NewReader(strings.Repeat("7", int(maxSizeInBytes/2))), cacheddownloader.CachingInfoType{})).Should(Succeed())
+			Ω(cache.Put("B", strings.NewReader(strings.Repeat("7", int(maxSizeInBytes/2))), cacheddownloader.CachingInfoType{})).Should(Succeed())
+			Ω(cache.Put("C", strings.NewReader(strings.Repeat("7", int(maxSizeInBytes/2))), cacheddownloader.CachingInfoType{})).Should(Succeed())
+
+			_, ok := cache.EntryInfo("A")
+			Ω(ok).Should(BeFalse())
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(2))
+		})
+
+		It("refuses contents larger than the cache", func() {
+			err := cache.Put(cacheKey, strings.NewReader(strings.Repeat("7", int(maxSizeInBytes*2))), cacheddownloader.CachingInfoType{})
+			Ω(err).Should(Equal(cacheddownloader.ErrTooLargeForCache))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(0))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(HaveLen(0))
+		})
+	})
+
+	Describe("FetchUncachedWithChecksum", func() {
+		var checksum string
+
+		BeforeEach(func() {
+			sum := sha256.Sum256([]byte("the-content"))
+			checksum = hex.EncodeToString(sum[:])
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "the-content"))
+		})
+
+		It("returns a file that matches the checksum without caching it", func() {
+			file, err := cache.FetchUncachedWithChecksum(url, checksum)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("the-content")))
+			file.Close()
+
+			Ω(cache.List()).Should(BeEmpty())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("removes a file that does not match the checksum", func() {
+			sum := sha256.Sum256([]byte("other-content"))
+			_, err := cache.FetchUncachedWithChecksum(url, hex.EncodeToString(sum[:]))
+			Ω(err).Should(Equal(cacheddownloader.ErrChecksumMismatch))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("rejects a malformed checksum without downloading", func() {
+			_, err := cache.FetchUncachedWithChecksum(url, "not-hex")
+			Ω(err).Should(HaveOccurred())
+			Ω(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("removes a file that exceeds the response body limit", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithResponseBodyLimit(4))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = cache.FetchUncachedWithChecksum(url, checksum)
+			Ω(err).Should(Equal(cacheddownloader.ErrDownloadTooLarge))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+	})
+
+	Describe("FetchBytes", func() {
+		BeforeEach(func() {
+			header := http.Header{}
+			header.Set("ETag", "my-original-etag")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, `{"some":"config"}`, header),
+			))
+		})
+
+		It("returns the contents of the file", func() {
+			content, err := cache.FetchBytes(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal(`{"some":"config"}`))
+		})
+
+		It("closes the reader so temporary files are removed", func() {
+			_, err := cache.FetchBytes(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("refuses files larger than the limit", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithFetchBytesLimit(8))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err := cache.FetchBytes(url, cacheKey)
+			Ω(err).Should(Equal(cacheddownloader.ErrTooLargeForFetchBytes))
+		})
+	})
+
+	Describe("FetchTo", func() {
+		BeforeEach(func() {
+			header := http.Header{}
+			header.Set("ETag", "my-original-etag")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, "the-content", header),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+					ghttp.RespondWith(http.StatusNotModified, ""),
+				),
+			)
+		})
+
+		It("writes the downloaded file and caches it", func() {
+			buffer := &bytes.Buffer{}
+			n, err := cache.FetchTo(buffer, url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(n).Should(BeEquivalentTo(len("the-content")))
+			Ω(buffer.String()).Should(Equal("the-content"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+
+			By("writing the cached file once it has been revalidated")
+			buffer.Reset()
+			n, err = cache.FetchTo(buffer, url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(n).Should(BeEquivalentTo(len("the-content")))
+			Ω(buffer.String()).Should(Equal("the-content"))
+		})
+
+		It("removes the temporary file of an uncached fetch", func() {
+			_, err := cache.FetchTo(ioutil.Discard, url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+	})
+
+	Describe("FetchToPath", func() {
+		var destDir string
+		var destPath string
+
+		BeforeEach(func() {
+			destDir, err = ioutil.TempDir("", "test_dest")
+			Ω(err).ShouldNot(HaveOccurred())
+			destPath = filepath.Join(destDir, "artifact")
+
+			header := http.Header{}
+			header.Set("ETag", "my-original-etag")
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/my_file"),
+					ghttp.RespondWith(http.StatusOK, "the-content", header),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-original-etag"}}),
+					ghttp.RespondWith(http.StatusNotModified, ""),
+				),
+			)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(destDir)
+		})
+
+		It("places the downloaded file at the path and caches it", func() {
+			Ω(cache.FetchToPath(url, cacheKey, destPath)).Should(Succeed())
+			Ω(ioutil.ReadFile(destPath)).Should(Equal([]byte("the-content")))
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+			Ω(filenamesInDir(destDir)).Should(Equal([]string{"artifact"}))
+		})
+
+		It("replaces a file that is already there", func() {
+			Ω(ioutil.WriteFile(destPath, []byte("stale"), 0644)).Should(Succeed())
+
+			Ω(cache.FetchToPath(url, cacheKey, destPath)).Should(Succeed())
+			Ω(ioutil.ReadFile(destPath)).Should(Equal([]byte("the-content")))
+
+			By("placing the cached file once it has been revalidated")
+			Ω(cache.FetchToPath(url, cacheKey, destPath)).Should(Succeed())
+			Ω(ioutil.ReadFile(destPath)).Should(Equal([]byte("the-content")))
+			Ω(filenamesInDir(destDir)).Should(Equal([]string{"artifact"}))
+		})
+
+		It("keeps the cached file when the placed one is replaced", func() {
+			Ω(cache.FetchToPath(url, cacheKey, destPath)).Should(Succeed())
+			Ω(ioutil.WriteFile(destPath+".new", []byte("mine"), 0644)).Should(Succeed())
+			Ω(os.Rename(destPath+".new", destPath)).Should(Succeed())
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("the-content")))
+		})
+
+		It("places the file of an uncached fetch and removes its temporary file", func() {
+			Ω(cache.FetchToPath(url, "", destPath)).Should(Succeed())
+			Ω(ioutil.ReadFile(destPath)).Should(Equal([]byte("the-content")))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("leaves the path alone when the fetch fails", func() {
+			Ω(ioutil.WriteFile(destPath, []byte("previous"), 0644)).Should(Succeed())
+			server.Reset()
+			server.AllowUnhandledRequests = true
+			server.UnhandledRequestStatusCode = http.StatusNotFound
+
+			Ω(cache.FetchToPath(url, cacheKey, destPath)).ShouldNot(Succeed())
+			Ω(ioutil.ReadFile(destPath)).Should(Equal([]byte("previous")))
+			Ω(filenamesInDir(destDir)).Should(Equal([]string{"artifact"}))
+		})
+	})
+
+	Describe("FetchAndLinkAtomic", func() {
+		var linkDir string
+		var linkPath string
+
+		BeforeEach(func() {
+			if runtime.GOOS == "windows" {
+				Skip("creating symlinks needs extra privileges on Windows")
+			}
+
+			linkDir, err = ioutil.TempDir("", "test_link")
+			Ω(err).ShouldNot(HaveOccurred())
+			linkPath = filepath.Join(linkDir, "current")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(linkDir)
+		})
+
+		link := func(name string) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/"+name),
+				ghttp.RespondWith(http.StatusOK, name+"-content", http.Header{"ETag": []string{name + "-etag"}}),
+			))
+			url, _ := Url.Parse(server.URL() + "/" + name)
+			Ω(cache.FetchAndLinkAtomic(url, name, linkPath)).Should(Succeed())
+		}
+
+		It("points the symlink at the cached file", func() {
+			link("blue")
+
+			target, err := os.Readlink(linkPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			absCachedPath, err := filepath.Abs(cachedPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(filepath.Dir(target)).Should(Equal(absCachedPath))
+			Ω(ioutil.ReadFile(linkPath)).Should(Equal([]byte("blue-content")))
+			Ω(filenamesInDir(linkDir)).Should(Equal([]string{"current"}))
+		})
+
+		It("replaces the symlink with one to the new file", func() {
+			link("blue")
+			link("green")
+
+			Ω(ioutil.ReadFile(linkPath)).Should(Equal([]byte("green-content")))
+			Ω(filenamesInDir(linkDir)).Should(Equal([]string{"current"}))
+		})
+
+		It("keeps the linked file on disk until the symlink points elsewhere", func() {
+			link("blue")
+			_, err := cache.EvictToSize(0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(cache.List()).Should(BeEmpty())
+			Ω(ioutil.ReadFile(linkPath)).Should(Equal([]byte("blue-content")))
+
+			target, err := os.Readlink(linkPath)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(target).Should(BeAnExistingFile())
+			link("green")
+			Ω(target).ShouldNot(BeAnExistingFile())
+		})
+
+		It("refuses to link a file that was not cached", func() {
+			link("blue")
+
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "no-validators"))
+			url, _ := Url.Parse(server.URL() + "/no-validators")
+			err := cache.FetchAndLinkAtomic(url, "no-validators", linkPath)
+			Ω(err).Should(Equal(cacheddownloader.ErrNotCached))
+			Ω(ioutil.ReadFile(linkPath)).Should(Equal([]byte("blue-content")))
+			Ω(filenamesInDir(linkDir)).Should(Equal([]string{"current"}))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("leaves the symlink alone if the fetch fails", func() {
+			link("blue")
+
+			url, _ := Url.Parse(server.URL() + "/missing")
+			server.RouteToHandler("GET", "/missing", ghttp.RespondWith(http.StatusNotFound, ""))
+			Ω(cache.FetchAndLinkAtomic(url, "missing", linkPath)).ShouldNot(Succeed())
+			Ω(ioutil.ReadFile(linkPath)).Should(Equal([]byte("blue-content")))
+		})
+	})
+
+	Describe("FetchMapped", func() {
+		BeforeEach(func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "the-content", http.Header{"ETag": []string{"my-etag"}}),
+				ghttp.RespondWith(http.StatusOK, "the-new-content", http.Header{"ETag": []string{"my-new-etag"}}),
+			)
+		})
+
+		It("returns the contents of the file", func() {
+			data, release, err := cache.FetchMapped(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer release()
+			Ω(string(data)).Should(Equal("the-content"))
+		})
+
+		It("keeps a replaced file on disk until it is released", func() {
+			data, release, err := cache.FetchMapped(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(2))
+			Ω(string(data)).Should(Equal("the-content"))
+
+			release()
+			Ω(ioutil.ReadDir(cachedPath)).Should(HaveLen(1))
+
+			By("tolerating a second release")
+			release()
+		})
+
+		It("removes the temporary file of an uncached fetch once it is released", func() {
+			_, release, err := cache.FetchMapped(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			release()
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+	})
+
+	Describe("ServeFile", func() {
+		var returnedHeader http.Header
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", `"my-original-etag"`)
+			returnedHeader.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(http.StatusOK, "0123456789", returnedHeader),
+			))
+		})
+
+		serve := func(header http.Header) *httptest.ResponseRecorder {
+			request, err := http.NewRequest("GET", "/proxied", nil)
+			Ω(err).ShouldNot(HaveOccurred())
+			request.Header = header
+
+			recorder := httptest.NewRecorder()
+			cache.ServeFile(recorder, request, url, cacheKey)
+			return recorder
+		}
+
+		It("serves the whole file with its length and validators", func() {
+			recorder := serve(http.Header{})
+			Ω(recorder.Code).Should(Equal(http.StatusOK))
+			Ω(recorder.Body.String()).Should(Equal("0123456789"))
+			Ω(recorder.Header().Get("Content-Length")).Should(Equal("10"))
+			Ω(recorder.Header().Get("ETag")).Should(Equal(`"my-original-etag"`))
+			Ω(recorder.Header().Get("Last-Modified")).Should(Equal("Mon, 02 Jan 2006 15:04:05 GMT"))
+		})
+
+		It("serves ranges from the cached file", func() {
+			recorder := serve(http.Header{"Range": []string{"bytes=2-5"}})
+			Ω(recorder.Code).Should(Equal(http.StatusPartialContent))
+			Ω(recorder.Body.String()).Should(Equal("2345"))
+			Ω(recorder.Header().Get("Content-Range")).Should(Equal("bytes 2-5/10"))
+		})
+
+		It("answers conditional requests", func() {
+			recorder := serve(http.Header{"If-None-Match": []string{`"my-original-etag"`}})
+			Ω(recorder.Code).Should(Equal(http.StatusNotModified))
+			Ω(recorder.Body.Len()).Should(BeZero())
+		})
+
+		It("reports a failed fetch as a bad gateway", func() {
+			server.SetHandler(0, ghttp.RespondWith(http.StatusInternalServerError, ""))
+			server.SetAllowUnhandledRequests(true)
+			server.SetUnhandledRequestStatusCode(http.StatusInternalServerError)
+
+			recorder := serve(http.Header{})
+			Ω(recorder.Code).Should(Equal(http.StatusBadGateway))
+		})
+
+		Describe("when the file is stored gzip-encoded", func() {
+			BeforeEach(func() {
+				var gzipped bytes.Buffer
+				gz := gzip.NewWriter(&gzipped)
+				gz.Write([]byte("0123456789"))
+				gz.Close()
+
+				Ω(cache.Put(cacheKey, &gzipped, cacheddownloader.CachingInfoType{ETag: `"gzipped-etag"`, ContentEncoding: "gzip"})).Should(Succeed())
+				server.SetHandler(0, ghttp.RespondWith(http.StatusNotModified, ""))
+			})
+
+			It("serves the stored bytes as they are to clients that accept gzip", func() {
+				recorder := serve(http.Header{"Accept-Encoding": []string{"br, gzip;q=0.8"}})
+				Ω(recorder.Code).Should(Equal(http.StatusOK))
+				Ω(recorder.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+				Ω(recorder.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+				Ω(recorder.Header().Get("ETag")).Should(Equal(`"gzipped-etag"`))
+
+				gz, err := gzip.NewReader(recorder.Body)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(ioutil.ReadAll(gz)).Should(Equal([]byte("0123456789")))
+			})
+
+			It("decodes them for clients that do not", func() {
+				recorder := serve(http.Header{"Accept-Encoding": []string{"*, gzip;q=0"}})
+				Ω(recorder.Code).Should(Equal(http.StatusOK))
+				Ω(recorder.Header().Get("Content-Encoding")).Should(BeEmpty())
+				Ω(recorder.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+				Ω(recorder.Header().Get("ETag")).Should(BeEmpty())
+				Ω(recorder.Body.String()).Should(Equal("0123456789"))
+			})
+
+			It("decodes them for clients that send no Accept-Encoding", func() {
+				recorder := serve(http.Header{})
+				Ω(recorder.Body.String()).Should(Equal("0123456789"))
+			})
+		})
+	})
+
+	Describe("when a minimum content length is configured", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithMinContentLength(10))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		fetch := func() string {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			content, err := ioutil.ReadAll(file)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		It("does not cache smaller files", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "oops", http.Header{"ETag": []string{"my-etag"}}))
+			Ω(fetch()).Should(Equal("oops"))
+			Ω(ioutil.ReadDir(cachedPath)).Should(BeEmpty())
+		})
+
+		It("keeps the cached file when a smaller one is downloaded", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, "the real content", http.Header{"ETag": []string{"my-etag"}}),
+				ghttp.RespondWith(http.StatusOK, "oops", http.Header{"ETag": []string{"my-other-etag"}}),
+				ghttp.CombineHandlers(
+					ghttp.VerifyHeader(http.Header{"If-None-Match": []string{"my-etag"}}),
+					ghttp.RespondWith(http.StatusNotModified, ""),
+				),
+			)
+			Ω(fetch()).Should(Equal("the real content"))
+			Ω(fetch()).Should(Equal("oops"))
+			Ω(fetch()).Should(Equal("the real content"))
+		})
+	})
+
+	Describe("when a cache size range is configured", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheSizeRange(4, 8))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		fetch := func(content string) {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, content, http.Header{"ETag": []string{"my-etag"}}))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte(content)))
+			file.Close()
+		}
+
+		It("caches files within the range", func() {
+			fetch("1234")
+			Ω(cache.List()).Should(HaveLen(1))
+			fetch("12345678")
+			Ω(cache.List()).Should(HaveLen(1))
+		})
+
+		It("serves files outside the range without caching them", func() {
+			fetch("123")
+			Ω(cache.List()).Should(BeEmpty())
+			fetch("123456789")
+			Ω(cache.List()).Should(BeEmpty())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("replaces the entry for the key with a file outside the range", func() {
+			fetch("12345")
+			fetch("123456789")
+			Ω(cache.List()).Should(BeEmpty())
+		})
+
+		It("does not put contents outside the range", func() {
+			err := cache.Put(cacheKey, strings.NewReader("123"), cacheddownloader.CachingInfoType{})
+			Ω(err).Should(Equal(cacheddownloader.ErrOutsideCacheSizeRange))
+			Ω(cache.List()).Should(BeEmpty())
+		})
+
+		It("only bounds files by the cache size if max is zero", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithCacheSizeRange(4, 0))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fetch(strings.Repeat("7", int(maxSizeInBytes)))
+			Ω(cache.List()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("with a scheme handler", func() {
+		var handler *fakeSchemeHandler
+
+		BeforeEach(func() {
+			handler = &fakeSchemeHandler{}
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithSchemeHandler("s3", handler))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("caches and revalidates files the handler downloads", func() {
+			url, _ := Url.Parse("s3://my-bucket/my-object")
+			for i := 0; i < 2; i++ {
+				file, err := cache.Fetch(url, cacheKey)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(ioutil.ReadAll(file)).Should(Equal([]byte("from my-bucket")))
+				file.Close()
+			}
+
+			Ω(handler.urls).Should(HaveLen(2))
+			Ω(cache.Stats().Hits).Should(BeEquivalentTo(1))
+		})
+
+		It("records the URL the handler downloaded the file from", func() {
+			url, _ := Url.Parse("s3://my-bucket/my-object")
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			info, _ := cache.EntryInfo(cacheKey)
+			Ω(info.SourceURL).Should(Equal("s3://my-bucket/my-object"))
+		})
+	})
+
+	Describe("when a download panics", func() {
+		var handler *panickingSchemeHandler
+		var s3URL *Url.URL
+
+		BeforeEach(func() {
+			handler = &panickingSchemeHandler{}
+			s3URL, _ = Url.Parse("s3://my-bucket/my-object")
+		})
+
+		newCache := func(opts ...cacheddownloader.Option) {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, append(opts, cacheddownloader.WithSchemeHandler("s3", handler))...)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		It("removes the partial file and returns the panic as an error", func() {
+			newCache()
+
+			_, err := cache.Fetch(s3URL, cacheKey)
+			Ω(err).Should(BeAssignableToTypeOf(&cacheddownloader.DownloadPanicError{}))
+			Ω(err.(*cacheddownloader.DownloadPanicError).Value).Should(Equal("corrupt stream"))
+			Ω(err.(*cacheddownloader.DownloadPanicError).Stack).ShouldNot(BeEmpty())
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+			Ω(ioutil.ReadDir(cachedPath)).Should(BeEmpty())
+			Ω(cache.InFlight(cacheKey)).Should(BeFalse())
+
+			_, err = cache.Fetch(s3URL, "")
+			Ω(err).Should(BeAssignableToTypeOf(&cacheddownloader.DownloadPanicError{}))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+		})
+
+		It("panics again after cleaning up with WithRepanic", func() {
+			newCache(cacheddownloader.WithRepanic())
+
+			Ω(func() { cache.Fetch(s3URL, cacheKey) }).Should(PanicWith("corrupt stream"))
+			Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+			Ω(cache.InFlight(cacheKey)).Should(BeFalse())
+
+			By("letting later fetches of the key download again")
+			Ω(func() { cache.Fetch(s3URL, cacheKey) }).Should(Panic())
+		})
+
+		Context("in a progress callback during a parallel download", func() {
+			var chunkedURL *Url.URL
+			var chunkedServer *httptest.Server
+			var progressOpts []cacheddownloader.Option
+
+			BeforeEach(func() {
+				clock := &fakeClock{now: time.Now()}
+				chunkedServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					clock.Step(time.Second)
+					http.ServeContent(w, r, "", time.Time{}, strings.NewReader(strings.Repeat("0123456789", 100)))
+				}))
+				chunkedURL, _ = Url.Parse(chunkedServer.URL + "/my_file")
+
+				progressOpts = []cacheddownloader.Option{
+					cacheddownloader.WithParallelChunks(2, 0),
+					cacheddownloader.WithClock(clock),
+					cacheddownloader.WithProgress(func(*Url.URL, cacheddownloader.Progress) {
+						panic("progress")
+					}),
+				}
+			})
+
+			AfterEach(func() {
+				chunkedServer.Close()
+			})
+
+			It("returns the panic as an error", func() {
+				newCache(progressOpts...)
+
+				_, err := cache.Fetch(chunkedURL, cacheKey)
+				Ω(err).Should(BeAssignableToTypeOf(&cacheddownloader.DownloadPanicError{}))
+				Ω(err.(*cacheddownloader.DownloadPanicError).Value).Should(Equal("progress"))
+				Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+				Ω(ioutil.ReadDir(cachedPath)).Should(BeEmpty())
+			})
+
+			It("panics again with WithRepanic", func() {
+				newCache(append(progressOpts, cacheddownloader.WithRepanic())...)
+
+				Ω(func() { cache.Fetch(chunkedURL, cacheKey) }).Should(PanicWith("progress"))
+				Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+			})
+		})
+	})
+
+	Describe("when the number of open files is limited", func() {
+		BeforeEach(func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithMaxOpenFiles(1))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "777", http.Header{"ETag": []string{"my-original-etag"}}))
+		})
+
+		It("refuses fetches while the limit is reached", func() {
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = cache.Fetch(url, cacheKey)
+			Ω(err).Should(Equal(cacheddownloader.ErrTooManyOpenFiles))
+
+			By("allowing fetches again once a reader is closed")
+			file.Close()
+			file, err = cache.Fetch(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+
+		It("does not count fetches that fail", func() {
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusInternalServerError, ""))
+			_, err := cache.Fetch(url, cacheKey)
+			Ω(err).Should(HaveOccurred())
+			Ω(err).ShouldNot(Equal(cacheddownloader.ErrTooManyOpenFiles))
+
+			server.RouteToHandler("GET", "/my_file", ghttp.RespondWith(http.StatusOK, "777"))
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+		})
+	})
+
+	Describe("concurrent fetches of the same key", func() {
+		var requests chan struct{}
+		var release chan struct{}
+
+		BeforeEach(func() {
+			requests = make(chan struct{}, 10)
+			release = make(chan struct{})
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, r *http.Request) {
+				requests <- struct{}{}
+				<-release
+				w.Header().Set("ETag", "my-etag")
+				w.Write([]byte("777"))
+			})
+		})
+
+		fetchInBackground := func() chan error {
+			errs := make(chan error, 1)
+			go func() {
+				defer GinkgoRecover()
+				file, err := cache.Fetch(url, cacheKey)
+				if err == nil {
+					Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+					file.Close()
+				}
+				errs <- err
+			}()
+			return errs
+		}
+
+		It("share one download", func() {
+			leader := fetchInBackground()
+			Eventually(requests).Should(Receive())
+
+			waiters := []chan error{fetchInBackground(), fetchInBackground()}
+			Eventually(func() int { return cacheddownloader.FetchWaiters(cache, cacheKey) }).Should(Equal(2))
+
+			close(release)
+			Eventually(leader).Should(Receive(BeNil()))
+			for _, waiter := range waiters {
+				Eventually(waiter).Should(Receive(BeNil()))
+			}
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("reports the key as in flight while it is downloaded", func() {
+			Ω(cache.InFlight(cacheKey)).Should(BeFalse())
+
+			leader := fetchInBackground()
+			Eventually(requests).Should(Receive())
+			Ω(cache.InFlight(cacheKey)).Should(BeTrue())
+			Ω(cache.InFlight("another-key")).Should(BeFalse())
+
+			close(release)
+			Eventually(leader).Should(Receive(BeNil()))
+			Ω(cache.InFlight(cacheKey)).Should(BeFalse())
+		})
+
+		Context("when the number of waiters is limited", func() {
+			BeforeEach(func() {
+				cache.Close()
+				cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithMaxSingleflightWaiters(1))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("refuses fetches beyond the limit", func() {
+				leader := fetchInBackground()
+				Eventually(requests).Should(Receive())
+
+				waiter := fetchInBackground()
+				Eventually(func() int { return cacheddownloader.FetchWaiters(cache, cacheKey) }).Should(Equal(1))
+
+				_, err := cache.Fetch(url, cacheKey)
+				Ω(err).Should(Equal(cacheddownloader.ErrTooManyWaiters))
+
+				close(release)
+				Eventually(leader).Should(Receive(BeNil()))
+				Eventually(waiter).Should(Receive(BeNil()))
+			})
+		})
+
+		Context("when fetches give up", func() {
+			var cancelled chan struct{}
+
+			BeforeEach(func() {
+				cancelled = make(chan struct{}, 1)
+				server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, r *http.Request) {
+					requests <- struct{}{}
+					select {
+					case <-release:
+					case <-r.Context().Done():
+						cancelled <- struct{}{}
+						return
+					}
+					w.Header().Set("ETag", "my-etag")
+					w.Write([]byte("777"))
+				})
+			})
+
+			fetchWithContext := func(ctx context.Context) chan error {
+				errs := make(chan error, 1)
+				go func() {
+					defer GinkgoRecover()
+					file, err := cache.FetchContext(ctx, url, cacheKey)
+					if err == nil {
+						Ω(ioutil.ReadAll(file)).Should(Equal([]byte("777")))
+						file.Close()
+					}
+					errs <- err
+				}()
+				return errs
+			}
+
+			It("cancels the download once every fetch has given up", func() {
+				leaderCtx, cancelLeader := context.WithCancel(context.Background())
+				defer cancelLeader()
+				waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+				defer cancelWaiter()
+
+				leader := fetchWithContext(leaderCtx)
+				Eventually(requests).Should(Receive())
+				waiter := fetchWithContext(waiterCtx)
+				Eventually(func() int { return cacheddownloader.FetchWaiters(cache, cacheKey) }).Should(Equal(1))
+
+				cancelWaiter()
+				Eventually(waiter).Should(Receive(Equal(context.Canceled)))
+				Consistently(cancelled, 100*time.Millisecond).ShouldNot(Receive())
+
+				cancelLeader()
+				Eventually(cancelled).Should(Receive())
+				Eventually(leader).Should(Receive(MatchError(context.Canceled)))
+				Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+				Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+
+			It("keeps downloading while a waiter still wants the file", func() {
+				leaderCtx, cancelLeader := context.WithCancel(context.Background())
+				defer cancelLeader()
+
+				leader := fetchWithContext(leaderCtx)
+				Eventually(requests).Should(Receive())
+				waiter := fetchWithContext(context.Background())
+				Eventually(func() int { return cacheddownloader.FetchWaiters(cache, cacheKey) }).Should(Equal(1))
+
+				cancelLeader()
+				Consistently(cancelled, 100*time.Millisecond).ShouldNot(Receive())
+
+				close(release)
+				Eventually(waiter).Should(Receive(BeNil()))
+				Eventually(leader).Should(Receive())
+				Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("when entries are evicted while they are fetched", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("GET", "/my_file", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") == "my-etag" {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", "my-etag")
+				w.Write([]byte(strings.Repeat("7", 400)))
+			})
+		})
+
+		It("does not fail fetches", func() {
+			errs := make(chan error, 200)
+			wg := sync.WaitGroup{}
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for j := 0; j < 25; j++ {
+						cacheKey := fmt.Sprintf("key-%d", (i+j)%6)
+						if j%5 == 0 {
+							err := cache.Put(cacheKey, strings.NewReader(strings.Repeat("7", 400)), cacheddownloader.CachingInfoType{ETag: "my-etag"})
+							if err != nil {
+								errs <- err
+							}
+							continue
+						}
+
+						file, err := cache.Fetch(url, cacheKey)
+						if err != nil {
+							errs <- err
+							continue
+						}
+						content, err := ioutil.ReadAll(file)
+						file.Close()
+						if err != nil || len(content) != 400 {
+							errs <- fmt.Errorf("read %d bytes: %v", len(content), err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				Fail(err.Error())
+			}
+		})
+	})
+
+	Describe("temporary file names", func() {
+		var tempNames []string
+
+		BeforeEach(func() {
+			tempNames = nil
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				entries, err := ioutil.ReadDir(uncachedPath)
+				Ω(err).ShouldNot(HaveOccurred())
+				for _, entry := range entries {
+					tempNames = append(tempNames, entry.Name())
+				}
+				w.Write([]byte("777"))
+			})
+		})
+
+		creationTime := func(name string) time.Time {
+			parts := strings.Split(name, "-")
+			Ω(len(parts)).Should(BeNumerically(">=", 2))
+			nanos, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+			Ω(err).ShouldNot(HaveOccurred())
+			return time.Unix(0, nanos)
+		}
+
+		It("start with the default prefix and record when they were created", func() {
+			file, err := cache.Fetch(url, "")
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			Ω(tempNames).Should(HaveLen(1))
+			Ω(tempNames[0]).Should(HavePrefix(cacheddownloader.DefaultTempPrefix + "uncached-"))
+			Ω(creationTime(tempNames[0])).Should(BeTemporally("~", time.Now(), 10*time.Second))
+		})
+
+		It("use the configured prefix and the hashed cache key", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTempPrefix("my-app-"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			file, err := cache.Fetch(url, cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			file.Close()
+
+			Ω(tempNames).Should(HaveLen(1))
+			Ω(tempNames[0]).Should(HavePrefix("my-app-" + computeMd5(cacheKey) + "-"))
+		})
+	})
+
+	Describe("the position of returned readers", func() {
+		var returnedHeader http.Header
+		var content string
+
+		BeforeEach(func() {
+			returnedHeader = http.Header{}
+			returnedHeader.Set("ETag", "my-original-etag")
+			content = "START" + strings.Repeat("7", int(maxSizeInBytes/2))
+		})
+
+		respondWith := func(status int, body string, header http.Header) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/my_file"),
+				ghttp.RespondWith(status, body, header),
+			))
+		}
+
+		expectReaderAtStart := func(file io.ReadCloser, err error) {
+			Ω(err).ShouldNot(HaveOccurred())
+			defer file.Close()
+
+			start := make([]byte, 5)
+			_, err = io.ReadFull(file, start)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(start)).Should(Equal("START"))
+		}
+
+		It("is at the start for uncached fetches", func() {
+			respondWith(http.StatusOK, content, returnedHeader)
+			expectReaderAtStart(cache.Fetch(url, ""))
+		})
+
+		It("is at the start for downloads admitted into the cache", func() {
+			respondWith(http.StatusOK, content, returnedHeader)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+		})
+
+		It("is at the start for files that were not modified", func() {
+			respondWith(http.StatusOK, content, returnedHeader)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+
+			respondWith(http.StatusNotModified, "", nil)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+		})
+
+		It("is at the start for files that are too large to cache", func() {
+			respondWith(http.StatusOK, content+strings.Repeat("7", int(maxSizeInBytes)), returnedHeader)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+		})
+
+		It("is at the start for downloads without caching info", func() {
+			respondWith(http.StatusOK, content, nil)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+		})
+
+		It("is at the start for entries served within the TTL", func() {
+			cache.Close()
+			cache, err = cacheddownloader.New(cachedPath, uncachedPath, maxSizeInBytes, time.Second, cacheddownloader.WithTTL(time.Hour))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			respondWith(http.StatusOK, content, returnedHeader)
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+			expectReaderAtStart(cache.Fetch(url, cacheKey))
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
 	Describe("When providing a file that should not be cached", func() {
 		Context("when the download succeeds", func() {
 			BeforeEach(func() {
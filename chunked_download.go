@@ -0,0 +1,148 @@
+package cacheddownloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+func (downloader *Downloader) canDownloadInChunks(resp *http.Response) bool {
+	return downloader.parallelChunks > 1 &&
+		resp.Request.Method == "GET" &&
+		resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.ContentLength > downloader.parallelChunkMinSize
+}
+
+// downloadInChunks reads the first chunk from the body of resp and fetches
+// the remaining chunks with concurrent range requests, writing each one at
+// its offset in destinationFile and to progress.
+func (downloader *Downloader) downloadInChunks(destinationFile *os.File, resp *http.Response, timeout time.Duration, progress io.Writer) (int64, error) {
+	size := resp.ContentLength
+	chunkSize := (size + int64(downloader.parallelChunks) - 1) / int64(downloader.parallelChunks)
+
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	errs := make(chan error, downloader.parallelChunks)
+	go func() {
+		defer recoverChunk(errs)
+		errs <- downloader.copyChunk(destinationFile, resp.Body, 0, chunkSize, progress)
+	}()
+
+	chunks := 1
+	for start := chunkSize; start < size; start += chunkSize {
+		length := chunkSize
+		if start+length > size {
+			length = size - start
+		}
+
+		chunks++
+		go func(start, length int64) {
+			defer recoverChunk(errs)
+			errs <- downloader.fetchChunk(resp.Request, destinationFile, start, length, validator, timeout, progress)
+		}(start, length)
+	}
+
+	var err error
+	for i := 0; i < chunks; i++ {
+		chunkErr := <-errs
+		if err == nil {
+			err = chunkErr
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := destinationFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Size() != size {
+		return 0, fmt.Errorf("Download failed: expected %d bytes, got %d", size, info.Size())
+	}
+
+	return size, nil
+}
+
+// recoverChunk reports a panic in a chunk's goroutine, e.g. in a WithProgress
+// callback, on errs as a DownloadPanicError instead of crashing the process.
+func recoverChunk(errs chan<- error) {
+	if p := recover(); p != nil {
+		errs <- &DownloadPanicError{Value: p, Stack: debug.Stack()}
+	}
+}
+
+// fetchChunk requests a byte range of the URL of original and writes it at
+// its offset in destinationFile. The bytes are also written to tee, such as a
+// checksum, unless it is nil.
+func (downloader *Downloader) fetchChunk(original *http.Request, destinationFile *os.File, start, length int64, validator string, timeout time.Duration, tee io.Writer) error {
+	req, err := http.NewRequestWithContext(original.Context(), "GET", original.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	for name, values := range original.Header {
+		req.Header[name] = values
+	}
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if validator != "" {
+		req.Header.Set("If-Range", validator)
+	}
+
+	resp, err := downloader.doWithHeaderTimeout(req, timeout)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Download failed: Status code %d for range request", resp.StatusCode)
+	}
+
+	return downloader.copyChunk(destinationFile, resp.Body, start, length, tee)
+}
+
+func (downloader *Downloader) copyChunk(destinationFile *os.File, body io.Reader, start, length int64, tee io.Writer) error {
+	var w io.Writer = &offsetWriter{file: destinationFile, offset: start}
+	if tee != nil {
+		w = io.MultiWriter(w, tee)
+	}
+
+	written, err := downloader.copy(w, io.LimitReader(body, length))
+	if err != nil {
+		return err
+	}
+
+	if written != length {
+		return fmt.Errorf("Download failed: expected %d bytes at offset %d, got %d", length, start, written)
+	}
+
+	return nil
+}
+
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func hashFile(file *os.File, hashes io.Writer) error {
+	_, err := io.Copy(hashes, io.NewSectionReader(file, 0, 1<<62))
+	return err
+}
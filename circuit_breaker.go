@@ -0,0 +1,120 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of downloading from a host that has kept
+// failing, until its cool-down has passed. See WithCircuitBreaker.
+var ErrCircuitOpen = errors.New("Download failed: circuit open for host")
+
+// hostCircuit counts the consecutive failures of one host.
+type hostCircuit struct {
+	failures     int
+	firstFailure time.Time
+
+	// openedAt is when the circuit opened, or zero while it is closed
+	openedAt time.Time
+	// probing is true while the single request allowed through a
+	// half-open circuit is in flight
+	probing bool
+}
+
+// circuitBreaker stops requests to a host after maxFailures consecutive
+// failures within window. Once cooldown has passed it lets one probe request
+// through, which closes the circuit if it succeeds and opens it again if it
+// fails. A maxFailures of 0 disables it.
+type circuitBreaker struct {
+	lock        sync.Mutex
+	maxFailures int
+	window      time.Duration
+	cooldown    time.Duration
+	clock       Clock
+	hosts       map[string]*hostCircuit
+}
+
+func newCircuitBreaker(maxFailures int, window, cooldown time.Duration, clock Clock) *circuitBreaker {
+	return &circuitBreaker{
+		maxFailures: maxFailures,
+		window:      window,
+		cooldown:    cooldown,
+		clock:       clock,
+		hosts:       map[string]*hostCircuit{},
+	}
+}
+
+// allow reports whether a request to host may be sent.
+func (b *circuitBreaker) allow(host string) bool {
+	if b.maxFailures <= 0 {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	h, ok := b.hosts[host]
+	if !ok || h.openedAt.IsZero() {
+		return true
+	}
+	if h.probing || b.clock.Now().Before(h.openedAt.Add(b.cooldown)) {
+		return false
+	}
+
+	h.probing = true
+	return true
+}
+
+// release lets go of a request to host that allow let through without
+// counting its outcome, e.g. because it was cancelled, so a half-open circuit
+// lets another probe through.
+func (b *circuitBreaker) release(host string) {
+	if b.maxFailures <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if h, ok := b.hosts[host]; ok {
+		h.probing = false
+	}
+}
+
+// record notes the outcome of a request to host that allow let through.
+func (b *circuitBreaker) record(host string, failed bool) {
+	if b.maxFailures <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if !failed {
+		delete(b.hosts, host)
+		return
+	}
+
+	now := b.clock.Now()
+	h, ok := b.hosts[host]
+	if !ok {
+		h = &hostCircuit{}
+		b.hosts[host] = h
+	}
+
+	if h.probing {
+		h.probing = false
+		h.openedAt = now
+		return
+	}
+
+	if h.failures == 0 || now.Sub(h.firstFailure) > b.window {
+		h.failures = 0
+		h.firstFailure = now
+	}
+	h.failures++
+	if h.failures >= b.maxFailures {
+		h.openedAt = now
+	}
+}
@@ -0,0 +1,15 @@
+package cacheddownloader
+
+import "time"
+
+// Clock tells the cache what time it is. It can be replaced with WithClock,
+// e.g. to control freshness and access times in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,202 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cacheddownloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+)
+
+// The daemon lets processes on one machine share a single cache. A client
+// connects to the daemon's unix socket, sends one daemonRequest and receives
+// one daemonResponse together with a descriptor for the fetched file, passed
+// with SCM_RIGHTS. Every fetch opens its own descriptor, which the daemon
+// never reads from, so clients read from offset 0 and keep their copy even if
+// the daemon evicts the file.
+
+type daemonRequest struct {
+	URL      string `json:"url"`
+	CacheKey string `json:"cache_key"`
+}
+
+type daemonResponse struct {
+	Size  int64  `json:"size"`
+	Error string `json:"error,omitempty"`
+}
+
+const maxDaemonMessageSize = 64 * 1024
+
+// Daemon serves fetches from a CachedDownloader to other processes.
+type Daemon struct {
+	downloader CachedDownloader
+}
+
+func NewDaemon(downloader CachedDownloader) *Daemon {
+	return &Daemon{downloader: downloader}
+}
+
+// Serve handles connections on listener until it is closed.
+func (d *Daemon) Serve(listener *net.UnixListener) error {
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return err
+		}
+
+		go d.handle(conn)
+	}
+}
+
+func (d *Daemon) handle(conn *net.UnixConn) {
+	defer conn.Close()
+
+	var request daemonRequest
+	err := json.NewDecoder(conn).Decode(&request)
+	if err != nil {
+		return
+	}
+
+	reader, size, err := d.fetch(request)
+	if err != nil {
+		writeDaemonResponse(conn, daemonResponse{Error: err.Error()}, nil)
+		return
+	}
+	defer reader.Close()
+
+	file := reader.file
+	if reader.shared {
+		// The client would share the file offset with every other client
+		// given the descriptor, so give it one of its own. The file is
+		// kept on disk until reader is closed.
+		file, err = os.Open(reader.file.Name())
+		if err != nil {
+			writeDaemonResponse(conn, daemonResponse{Error: err.Error()}, nil)
+			return
+		}
+		defer file.Close()
+	}
+
+	writeDaemonResponse(conn, daemonResponse{Size: size}, file)
+}
+
+func (d *Daemon) fetch(request daemonRequest) (*fileCloser, int64, error) {
+	u, err := url.Parse(request.URL)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader, result, err := d.downloader.FetchInfo(u, request.CacheKey)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fc, ok := reader.(*fileCloser)
+	if !ok {
+		reader.Close()
+		return nil, 0, errors.New("Downloader does not return files that can be shared")
+	}
+
+	return fc, result.Size, nil
+}
+
+func writeDaemonResponse(conn *net.UnixConn, response daemonResponse, file *os.File) error {
+	payload, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+
+	var rights []byte
+	if file != nil {
+		rights = syscall.UnixRights(int(file.Fd()))
+	}
+
+	_, _, err = conn.WriteMsgUnix(payload, rights, nil)
+	return err
+}
+
+// DaemonClient fetches files through a Daemon listening on a unix socket.
+type DaemonClient struct {
+	socketPath string
+}
+
+func NewDaemonClient(socketPath string) *DaemonClient {
+	return &DaemonClient{socketPath: socketPath}
+}
+
+// Fetch asks the daemon to fetch url, caching it under cacheKey, and returns
+// the file it shares.
+func (c *DaemonClient) Fetch(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: c.socketPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = json.NewEncoder(conn).Encode(daemonRequest{URL: url.String(), CacheKey: cacheKey})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, maxDaemonMessageSize)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(payload, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := receivedFile(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	var response daemonResponse
+	err = json.Unmarshal(payload[:n], &response)
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+
+	if response.Error != "" {
+		if file != nil {
+			file.Close()
+		}
+		return nil, fmt.Errorf("Daemon failed to fetch: %s", response.Error)
+	}
+
+	if file == nil {
+		return nil, errors.New("Daemon did not send a file")
+	}
+
+	return file, nil
+}
+
+func receivedFile(oob []byte) (*os.File, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			return nil, err
+		}
+		if len(fds) > 0 {
+			for _, fd := range fds[1:] {
+				syscall.Close(fd)
+			}
+			return os.NewFile(uintptr(fds[0]), "cacheddownloader-daemon"), nil
+		}
+	}
+
+	return nil, nil
+}
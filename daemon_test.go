@@ -0,0 +1,104 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cacheddownloader_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	Url "net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/pivotal-golang/cacheddownloader"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Daemon", func() {
+	var (
+		cachedPath   string
+		uncachedPath string
+		socketDir    string
+		downloader   CachedDownloader
+		listener     *net.UnixListener
+		server       *ghttp.Server
+		url          *Url.URL
+		client       *DaemonClient
+	)
+
+	BeforeEach(func() {
+		var err error
+		cachedPath, err = ioutil.TempDir("", "daemon_cached")
+		Ω(err).ShouldNot(HaveOccurred())
+		uncachedPath, err = ioutil.TempDir("", "daemon_uncached")
+		Ω(err).ShouldNot(HaveOccurred())
+		socketDir, err = ioutil.TempDir("", "daemon")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		downloader, err = New(cachedPath, uncachedPath, 1024, time.Second, WithTTL(time.Hour))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		socketPath := filepath.Join(socketDir, "sock")
+		listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+		Ω(err).ShouldNot(HaveOccurred())
+		go NewDaemon(downloader).Serve(listener)
+
+		server = ghttp.NewServer()
+		url, err = Url.Parse(server.URL() + "/my_file")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		client = NewDaemonClient(socketPath)
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		server.Close()
+		downloader.Close()
+		os.RemoveAll(cachedPath)
+		os.RemoveAll(uncachedPath)
+		os.RemoveAll(socketDir)
+	})
+
+	It("shares files from the daemon's cache", func() {
+		header := http.Header{}
+		header.Set("ETag", "my-original-etag")
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", "/my_file"),
+			ghttp.RespondWith(http.StatusOK, "shared content", header),
+		))
+
+		for i := 0; i < 2; i++ {
+			file, err := client.Fetch(url, "the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadAll(file)).Should(Equal([]byte("shared content")))
+			file.Close()
+		}
+
+		Ω(server.ReceivedRequests()).Should(HaveLen(1))
+	})
+
+	It("shares uncached files", func() {
+		server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "uncached content"))
+
+		file, err := client.Fetch(url, "")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer file.Close()
+
+		Ω(ioutil.ReadAll(file)).Should(Equal([]byte("uncached content")))
+		Ω(ioutil.ReadDir(uncachedPath)).Should(BeEmpty())
+	})
+
+	It("returns the daemon's error when the fetch fails", func() {
+		server.AllowUnhandledRequests = true
+		server.UnhandledRequestStatusCode = http.StatusInternalServerError
+
+		_, err := client.Fetch(url, "the-cache-key")
+		Ω(err).Should(HaveOccurred())
+		Ω(err.Error()).Should(ContainSubstring("Status code 500"))
+	})
+})
@@ -0,0 +1,169 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+type AddressFamily int
+
+const (
+	// AddressFamilyHappyEyeballs races IPv6 and IPv4 connections (RFC 6555).
+	AddressFamilyHappyEyeballs AddressFamily = iota
+	// AddressFamilyPreferIPv4 dials IPv4 addresses first and falls back to IPv6.
+	AddressFamilyPreferIPv4
+	// AddressFamilyPreferIPv6 dials IPv6 addresses first and falls back to IPv4.
+	AddressFamilyPreferIPv6
+)
+
+// fallbackDelay is how long Happy Eyeballs waits for the preferred family
+// before also dialing the other one. It matches the net package default.
+const fallbackDelay = 300 * time.Millisecond
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+func newDialContext(family AddressFamily, resolver ipResolver) dialContextFunc {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if family == AddressFamilyHappyEyeballs && resolver == nil {
+		return dialer.DialContext
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		preferred, fallback := family.split(ipAddrs)
+		if family == AddressFamilyHappyEyeballs {
+			return dialHappyEyeballs(ctx, dialer, network, port, preferred, fallback)
+		}
+
+		return dialSerial(ctx, dialer, network, port, append(preferred, fallback...))
+	}
+}
+
+// split returns the addresses of the preferred family and the rest, keeping
+// the resolver's order within each family. Happy Eyeballs prefers the family
+// of the first address the resolver returned.
+func (family AddressFamily) split(ipAddrs []net.IPAddr) ([]net.IP, []net.IP) {
+	preferIPv4 := family == AddressFamilyPreferIPv4
+	if family == AddressFamilyHappyEyeballs && len(ipAddrs) > 0 {
+		preferIPv4 = ipAddrs[0].IP.To4() != nil
+	}
+
+	preferred := []net.IP{}
+	fallback := []net.IP{}
+	for _, ipAddr := range ipAddrs {
+		isIPv4 := ipAddr.IP.To4() != nil
+		if isIPv4 == preferIPv4 {
+			preferred = append(preferred, ipAddr.IP)
+		} else {
+			fallback = append(fallback, ipAddr.IP)
+		}
+	}
+	return preferred, fallback
+}
+
+func dialSerial(ctx context.Context, dialer *net.Dialer, network, port string, ips []net.IP) (net.Conn, error) {
+	var err error = &net.AddrError{Err: "no suitable address found"}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// dialHappyEyeballs dials the preferred addresses and, if they have not
+// connected within fallbackDelay or have failed, races the fallback addresses
+// against them. The first connection wins and any other is closed.
+func dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, network, port string, preferred, fallback []net.IP) (net.Conn, error) {
+	if len(fallback) == 0 {
+		return dialSerial(ctx, dialer, network, port, preferred)
+	}
+	if len(preferred) == 0 {
+		return dialSerial(ctx, dialer, network, port, fallback)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	results := make(chan dialResult, 2)
+	dial := func(ips []net.IP) {
+		conn, err := dialSerial(ctx, dialer, network, port, ips)
+		results <- dialResult{conn, err}
+	}
+
+	go dial(preferred)
+	pending := 1
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+	startFallback := func() {
+		if fallback != nil {
+			go dial(fallback)
+			fallback = nil
+			pending++
+		}
+	}
+
+	var firstErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if loser := <-results; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			startFallback()
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
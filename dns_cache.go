@@ -0,0 +1,60 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+type lookupIPAddrFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// dnsCache remembers the addresses of each host for ttl. An expired entry is
+// looked up again, and if that lookup fails the entry is dropped rather than
+// served stale.
+type dnsCache struct {
+	ttl     time.Duration
+	lookup  lookupIPAddrFunc
+	lock    *sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	ipAddrs []net.IPAddr
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, lookup lookupIPAddrFunc) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  lookup,
+		lock:    &sync.Mutex{},
+		entries: map[string]dnsCacheEntry{},
+	}
+}
+
+func (d *dnsCache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	d.lock.Lock()
+	entry, ok := d.entries[host]
+	d.lock.Unlock()
+
+	if ok && time.Now().Before(entry.expires) {
+		return entry.ipAddrs, nil
+	}
+
+	ipAddrs, err := d.lookup(ctx, host)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err != nil {
+		delete(d.entries, host)
+		return nil, err
+	}
+
+	d.entries[host] = dnsCacheEntry{
+		ipAddrs: ipAddrs,
+		expires: time.Now().Add(d.ttl),
+	}
+	return ipAddrs, nil
+}
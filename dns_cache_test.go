@@ -0,0 +1,79 @@
+package cacheddownloader_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/pivotal-golang/cacheddownloader"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DNS cache", func() {
+	var lookups int
+	var lookupErr error
+	var lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	BeforeEach(func() {
+		lookups = 0
+		lookupErr = nil
+		lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			lookups++
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			return []net.IPAddr{{IP: net.IPv4(10, 0, 0, byte(lookups))}}, nil
+		}
+	})
+
+	It("serves repeated lookups from the cache until the ttl expires", func() {
+		cache := NewDNSCache(time.Hour, lookup)
+
+		first, err := cache.LookupIPAddr(context.Background(), "example.com")
+		Ω(err).ShouldNot(HaveOccurred())
+		second, err := cache.LookupIPAddr(context.Background(), "example.com")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(second).Should(Equal(first))
+		Ω(lookups).Should(Equal(1))
+	})
+
+	It("caches each host separately", func() {
+		cache := NewDNSCache(time.Hour, lookup)
+
+		cache.LookupIPAddr(context.Background(), "example.com")
+		cache.LookupIPAddr(context.Background(), "example.org")
+		Ω(lookups).Should(Equal(2))
+	})
+
+	It("refreshes expired entries", func() {
+		cache := NewDNSCache(10*time.Millisecond, lookup)
+
+		first, _ := cache.LookupIPAddr(context.Background(), "example.com")
+		time.Sleep(20 * time.Millisecond)
+		second, err := cache.LookupIPAddr(context.Background(), "example.com")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(lookups).Should(Equal(2))
+		Ω(second).ShouldNot(Equal(first))
+	})
+
+	It("does not serve stale entries when the refresh fails", func() {
+		cache := NewDNSCache(10*time.Millisecond, lookup)
+
+		cache.LookupIPAddr(context.Background(), "example.com")
+		time.Sleep(20 * time.Millisecond)
+
+		lookupErr = errors.New("no such host")
+		_, err := cache.LookupIPAddr(context.Background(), "example.com")
+		Ω(err).Should(Equal(lookupErr))
+
+		lookupErr = nil
+		_, err = cache.LookupIPAddr(context.Background(), "example.com")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(lookups).Should(Equal(3))
+	})
+})
@@ -2,107 +2,574 @@ package cacheddownloader
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 const MAX_DOWNLOAD_ATTEMPTS = 3
 
+// DefaultCopyBufferSize is the size of the buffer downloads are copied to
+// disk through, unless WithCopyBufferSize says otherwise. It is large enough
+// to keep the number of reads and writes down on fast links.
+const DefaultCopyBufferSize = 1 << 20
+
+// ErrDownloadTooLarge is returned when a response declares or sends more
+// bytes than the limit for its content type. It is not retried.
+var ErrDownloadTooLarge = errors.New("Download failed: file is too large")
+
+// ErrChecksumMismatch is returned when a download does not match the MD5
+// checksum in its ETag, or the checksum given to FetchUncachedWithChecksum.
+var ErrChecksumMismatch = errors.New("Download failed: Checksum mismatch")
+
+// retryDeadlineError is the error of the last attempt of a download that was
+// not retried because another attempt would overrun the deadline. It matches
+// context.DeadlineExceeded with errors.Is.
+type retryDeadlineError struct {
+	err error
+}
+
+func (e *retryDeadlineError) Error() string {
+	return fmt.Sprintf("Download failed: no time left to retry before the deadline: %s", e.err)
+}
+
+func (e *retryDeadlineError) Unwrap() error {
+	return e.err
+}
+
+func (e *retryDeadlineError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
 type Downloader struct {
-	client *http.Client
+	client      *http.Client
+	lock        *sync.Mutex
+	timeout     time.Duration
+	urlRewriter func(*url.URL) *url.URL
+	clock       Clock
+
+	parallelChunks       int
+	parallelChunkMinSize int64
+
+	schemeHandlers map[string]SchemeHandler
+
+	progress func(*url.URL, Progress)
+
+	responseBodyLimit     int64
+	contentTypeSizeLimits map[string]int64
+
+	circuits     *circuitBreaker
+	allowedHosts hostAllowlist
+
+	copyBuffers *sync.Pool
+
+	// logger warns about every download while insecureSkipVerify is set
+	logger             Logger
+	insecureSkipVerify bool
 }
 
-func NewDownloader(timeout time.Duration) *Downloader {
+func NewDownloader(timeout time.Duration, opts ...Option) *Downloader {
+	o := newOptions(opts)
+
+	var resolver ipResolver
+	if o.dnsCacheTTL > 0 {
+		resolver = newDNSCache(o.dnsCacheTTL, net.DefaultResolver.LookupIPAddr)
+	}
+
+	tlsConfig := &tls.Config{
+		RootCAs:            o.rootCAs,
+		InsecureSkipVerify: o.insecureSkipVerify,
+	}
+	if len(o.tlsPins) > 0 {
+		tlsConfig.VerifyConnection = verifyTLSPins(o.tlsPins)
+	}
+
 	transport := &http.Transport{
-		ResponseHeaderTimeout: timeout,
+		DialContext:       newDialContext(o.dialAddressFamily, resolver),
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: o.http2,
+		IdleConnTimeout:   o.idleConnTimeout,
+	}
+	if o.maxIdleConns > 0 {
+		transport.MaxIdleConns = o.maxIdleConns
+		transport.MaxIdleConnsPerHost = o.maxIdleConns
 	}
+	allowedHosts := newHostAllowlist(o.allowedHosts)
 	client := &http.Client{
 		Transport: transport,
 	}
+	if allowedHosts != nil {
+		client.CheckRedirect = allowedHosts.checkRedirect
+	}
+
+	schemeHandlers := map[string]SchemeHandler{}
+	for scheme, h := range o.schemeHandlers {
+		schemeHandlers[scheme] = h
+	}
 
 	return &Downloader{
-		client: client,
+		client:      client,
+		lock:        &sync.Mutex{},
+		timeout:     timeout,
+		urlRewriter: o.urlRewriter,
+		clock:       o.clock,
+
+		parallelChunks:       o.parallelChunks,
+		parallelChunkMinSize: o.parallelChunkMinSize,
+
+		schemeHandlers: schemeHandlers,
+
+		progress: o.progress,
+
+		responseBodyLimit:     o.responseBodyLimit,
+		contentTypeSizeLimits: o.contentTypeSizeLimits,
+
+		circuits:     newCircuitBreaker(o.circuitFailures, o.circuitWindow, o.circuitCooldown, o.clock),
+		allowedHosts: allowedHosts,
+
+		copyBuffers: newCopyBufferPool(o.copyBufferSize),
+
+		logger:             o.logger,
+		insecureSkipVerify: o.insecureSkipVerify,
 	}
 }
 
-func (downloader *Downloader) Download(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (didDownload bool, length int64, cachingInfoOut CachingInfoType, err error) {
+// newCopyBufferPool pools the copy buffers, so concurrent downloads share a
+// few of them rather than each allocating its own.
+func newCopyBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, size)
+			return &buf
+		},
+	}
+}
+
+// copy is io.Copy through a pooled buffer.
+func (downloader *Downloader) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := downloader.copyBuffers.Get().(*[]byte)
+	defer downloader.copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// SetTimeout changes how long subsequent downloads wait for response headers.
+// Downloads that are already in flight, including their retries, keep the
+// timeout they started with.
+func (downloader *Downloader) SetTimeout(timeout time.Duration) {
+	downloader.lock.Lock()
+	defer downloader.lock.Unlock()
+	downloader.timeout = timeout
+}
+
+func (downloader *Downloader) currentTimeout() time.Duration {
+	downloader.lock.Lock()
+	defer downloader.lock.Unlock()
+	return downloader.timeout
+}
+
+// DownloadResult describes the outcome of a successful Download.
+type DownloadResult struct {
+	// DidDownload is false if the server replied that the file was not
+	// modified, in which case nothing was written.
+	DidDownload bool
+	Size        int64
+	CachingInfo CachingInfoType
+	// Header holds the headers of the response, including a 304.
+	Header http.Header
+}
+
+func (downloader *Downloader) Download(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (DownloadResult, error) {
+	return downloader.download(url, destinationFile, cachingInfoIn, downloadRequest{})
+}
+
+// downloadRequest describes the request sent for a download when it is not a
+// plain GET, such as one with an Accept header or a POST with a body.
+type downloadRequest struct {
+	method string
+	header http.Header
+	body   []byte
+	// refresh asks for the file in full, ignoring any cached copy.
+	refresh bool
+	// newerThan, if set, serves a cached copy downloaded after it without
+	// asking the server, and revalidates older ones regardless of their TTL.
+	newerThan time.Time
+	// ctx cancels the download. It is nil for fetches without a context.
+	ctx context.Context
+	// deadline, if set, is the deadline retries have to fit in rather than
+	// ctx's, as for a download that several fetches wait for.
+	deadline func() (time.Time, bool)
+	// verify, if set, checks a downloaded file before it is cached or
+	// returned. See FetchVerified.
+	verify func(io.Reader) error
+}
+
+func (r downloadRequest) context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+func (r downloadRequest) retryDeadline() (time.Time, bool) {
+	if r.deadline != nil {
+		return r.deadline()
+	}
+	return r.context().Deadline()
+}
+
+// conditional reports whether the request may carry If-None-Match and
+// If-Modified-Since headers. Only GET and HEAD responses can be revalidated.
+func (r downloadRequest) conditional() bool {
+	return !r.refresh && (r.method == "" || r.method == "GET" || r.method == "HEAD")
+}
+
+// DownloadWithMethod is Download with the given method and request body, for
+// endpoints that serve content in response to a POST. Conditional headers
+// are only sent for GET and HEAD requests.
+func (downloader *Downloader) DownloadWithMethod(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType, method string, body []byte) (DownloadResult, error) {
+	return downloader.download(url, destinationFile, cachingInfoIn, downloadRequest{method: method, body: body})
+}
+
+// download is Download with the method, headers and body of req.
+func (downloader *Downloader) download(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType, req downloadRequest) (DownloadResult, error) {
+	url = downloader.rewriteURL(url)
+	if !downloader.allowedHosts.allows(url.Hostname()) {
+		return DownloadResult{}, ErrHostNotAllowed
+	}
+	if downloader.insecureSkipVerify {
+		downloader.logger.Printf("cacheddownloader: WARNING: downloading %s without verifying TLS certificates because WithInsecureSkipVerify is set; do not use it in production", url.Host)
+	}
+	timeout := downloader.currentTimeout()
+
+	var result DownloadResult
+	var err error
+	handler := downloader.schemeHandler(url.Scheme)
 	for attempt := 0; attempt < MAX_DOWNLOAD_ATTEMPTS; attempt++ {
-		didDownload, length, cachingInfoOut, err = downloader.fetchToFile(url, destinationFile, cachingInfoIn)
-		if err == nil {
+		if !downloader.circuits.allow(url.Host) {
+			err = ErrCircuitOpen
+			break
+		}
+
+		attemptStarted := time.Now()
+		if handler != nil {
+			result, err = downloader.fetchWithHandler(req.context(), handler, url, destinationFile, cachingInfoIn)
+		} else {
+			result, err = downloader.fetchToFile(url, destinationFile, cachingInfoIn, req, timeout)
+		}
+		if ctxErr := req.context().Err(); ctxErr != nil {
+			// The download was cancelled, which says nothing about the host
+			downloader.circuits.release(url.Host)
+			err = ctxErr
+			break
+		}
+		if errors.Is(err, ErrHostNotAllowed) {
+			// A redirect to a host that is not allowed, which the client
+			// wraps in a *url.Error
+			downloader.circuits.release(url.Host)
+			err = ErrHostNotAllowed
+			break
+		}
+		downloader.circuits.record(url.Host, upstreamFailure(err))
+		if err == nil || err == ErrDownloadTooLarge {
+			break
+		}
+
+		deadline, ok := req.retryDeadline()
+		if ok && attempt+1 < MAX_DOWNLOAD_ATTEMPTS && time.Until(deadline) < time.Since(attemptStarted) {
+			// Another attempt as slow as this one would not finish in time
+			err = &retryDeadlineError{err: err}
 			break
 		}
 	}
 
 	if err != nil {
-		return false, 0, CachingInfoType{}, err
+		return DownloadResult{}, err
+	}
+	return result, nil
+}
+
+func (downloader *Downloader) rewriteURL(url *url.URL) *url.URL {
+	if downloader.urlRewriter == nil {
+		return url
+	}
+
+	urlCopy := *url
+	rewritten := downloader.urlRewriter(&urlCopy)
+	if rewritten == nil {
+		return url
 	}
-	return
+	return rewritten
 }
 
-func (downloader *Downloader) fetchToFile(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (bool, int64, CachingInfoType, error) {
+// sourceURL is url without its user info, for CachingInfoType.SourceURL.
+func sourceURL(url *url.URL) string {
+	urlCopy := *url
+	urlCopy.User = nil
+	return urlCopy.String()
+}
+
+func (downloader *Downloader) fetchToFile(url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType, request downloadRequest, timeout time.Duration) (DownloadResult, error) {
 	_, err := destinationFile.Seek(0, 0)
 	if err != nil {
-		return false, 0, CachingInfoType{}, err
+		return DownloadResult{}, err
 	}
 
 	err = destinationFile.Truncate(0)
 	if err != nil {
-		return false, 0, CachingInfoType{}, err
+		return DownloadResult{}, err
 	}
 
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := downloader.newRequest(request.context(), url, cachingInfoIn, request)
 	if err != nil {
-		return false, 0, CachingInfoType{}, err
-	}
-
-	if cachingInfoIn.ETag != "" {
-		req.Header.Add("If-None-Match", cachingInfoIn.ETag)
-	}
-	if cachingInfoIn.LastModified != "" {
-		req.Header.Add("If-Modified-Since", cachingInfoIn.LastModified)
+		return DownloadResult{}, err
 	}
 
-	resp, err := downloader.client.Do(req)
+	started := downloader.clock.Now()
+	resp, err := downloader.doWithHeaderTimeout(req, timeout)
 	if err != nil {
-		return false, 0, CachingInfoType{}, err
+		return DownloadResult{}, err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		return false, 0, CachingInfoType{}, fmt.Errorf("Download failed: Status code %d", resp.StatusCode)
+		return DownloadResult{}, statusCodeError(resp.StatusCode)
+	}
+
+	cachingInfoOut := CachingInfoType{
+		ETag:            resp.Header.Get("ETag"),
+		LastModified:    resp.Header.Get("Last-Modified"),
+		Vary:            strings.Join(resp.Header["Vary"], ","),
+		Expires:         parseExpires(resp.Header, downloader.clock.Now()),
+		Digest:          parseDigest(resp.Header),
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+		SourceURL:       sourceURL(resp.Request.URL),
 	}
 
 	if resp.StatusCode == http.StatusNotModified {
-		return false, 0, CachingInfoType{}, nil
+		return DownloadResult{CachingInfo: cachingInfoOut, Header: resp.Header}, nil
 	}
 
-	hash := md5.New()
+	limit := downloader.bodyLimit(cachingInfoOut.ContentType)
+	if limit > 0 && resp.ContentLength > limit {
+		return DownloadResult{}, ErrDownloadTooLarge
+	}
 
-	count, err := io.Copy(io.MultiWriter(destinationFile, hash), resp.Body)
-	if err != nil {
-		return false, 0, CachingInfoType{}, err
+	md5Hash := md5.New()
+	sha256Hash := sha256.New()
+	var hashes io.Writer = md5Hash
+	if cachingInfoOut.Digest != "" {
+		hashes = io.MultiWriter(md5Hash, sha256Hash)
 	}
 
-	cachingInfoOut := CachingInfoType{
-		ETag:         resp.Header.Get("ETag"),
-		LastModified: resp.Header.Get("Last-Modified"),
+	progress := newProgressTracker(downloader.progress, url, downloader.clock, started, resp.ContentLength)
+
+	var count int64
+	if downloader.canDownloadInChunks(resp) {
+		count, err = downloader.downloadInChunks(destinationFile, resp, timeout, progress)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+
+		err = hashFile(destinationFile, hashes)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+	} else {
+		var body io.Reader = resp.Body
+		if limit > 0 {
+			body = io.LimitReader(resp.Body, limit+1)
+		}
+		count, err = downloader.copy(io.MultiWriter(destinationFile, hashes, progress), body)
+		if err != nil {
+			return DownloadResult{}, err
+		}
+		if limit > 0 && count > limit {
+			return DownloadResult{}, ErrDownloadTooLarge
+		}
 	}
+	progress.finish()
 
 	etagChecksum, ok := convertETagToChecksum(cachingInfoOut.ETag)
 
-	if ok && !bytes.Equal(etagChecksum, hash.Sum(nil)) {
-		return false, 0, CachingInfoType{}, fmt.Errorf("Download failed: Checksum mismatch")
+	if ok && !bytes.Equal(etagChecksum, md5Hash.Sum(nil)) {
+		return DownloadResult{}, ErrChecksumMismatch
+	}
+
+	if cachingInfoOut.Digest != "" && cachingInfoOut.Digest != sha256Digest(sha256Hash.Sum(nil)) {
+		return DownloadResult{}, fmt.Errorf("Download failed: Digest mismatch")
+	}
+
+	return DownloadResult{
+		DidDownload: true,
+		Size:        count,
+		CachingInfo: cachingInfoOut,
+		Header:      resp.Header,
+	}, nil
+}
+
+// newRequest builds the request fetchToFile sends for url, with conditional
+// headers for cachingInfoIn if request allows them.
+func (downloader *Downloader) newRequest(ctx context.Context, url *url.URL, cachingInfoIn CachingInfoType, request downloadRequest) (*http.Request, error) {
+	method := request.method
+	if method == "" {
+		method = "GET"
+	}
+
+	var body io.Reader
+	if request.body != nil {
+		body = bytes.NewReader(request.body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range request.header {
+		req.Header[name] = values
+	}
+
+	if request.conditional() {
+		if cachingInfoIn.ETag != "" {
+			req.Header.Add("If-None-Match", cachingInfoIn.ETag)
+		}
+		if cachingInfoIn.LastModified != "" {
+			req.Header.Add("If-Modified-Since", cachingInfoIn.LastModified)
+		}
+	}
+
+	return req, nil
+}
+
+// statusCodeError is returned when the server answers with an error status.
+type statusCodeError int
+
+func (e statusCodeError) Error() string {
+	return fmt.Sprintf("Download failed: Status code %d", int(e))
+}
+
+// isAuthFailure reports whether err is the server refusing the request as
+// unauthorized or forbidden, e.g. because a signed URL has expired.
+func isAuthFailure(err error) bool {
+	var status statusCodeError
+	return errors.As(err, &status) && (status == http.StatusUnauthorized || status == http.StatusForbidden)
+}
+
+// upstreamFailure reports whether err suggests the host is unhealthy, rather
+// than that it turned down this particular request.
+func upstreamFailure(err error) bool {
+	if err == nil || err == ErrDownloadTooLarge {
+		return false
+	}
+
+	var status statusCodeError
+	if errors.As(err, &status) {
+		return status >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// bodyLimit returns the largest body allowed for contentType, or zero if
+// there is no limit.
+func (downloader *Downloader) bodyLimit(contentType string) int64 {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if limit, ok := downloader.contentTypeSizeLimits[mediaType]; ok {
+			return limit
+		}
+	}
+	return downloader.responseBodyLimit
+}
+
+// doWithHeaderTimeout cancels the request if the response headers have not
+// arrived within timeout. A zero timeout waits forever.
+func (downloader *Downloader) doWithHeaderTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return downloader.client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	headerTimer := time.AfterFunc(timeout, cancel)
+
+	resp, err := downloader.client.Do(req.WithContext(ctx))
+	if !headerTimer.Stop() && err == nil {
+		resp.Body.Close()
+		err = fmt.Errorf("Download failed: timeout awaiting response headers")
 	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// parseExpires returns when a response received at now expires. The Expires
+// header is taken relative to the Date header, if there is one, so a skewed
+// server clock does not shift the expiry. Invalid dates such as "0" mean the
+// response has already expired.
+func parseExpires(header http.Header, now time.Time) time.Time {
+	value := header.Get("Expires")
+	if value == "" {
+		return time.Time{}
+	}
+
+	expires, err := http.ParseTime(value)
+	if err != nil {
+		return now
+	}
+
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return expires
+	}
+
+	return now.Add(expires.Sub(date))
+}
+
+// parseDigest returns the SHA-256 digest of a Digest header as
+// "sha-256=<base64>", or "" if there is none. Other algorithms are ignored.
+func parseDigest(header http.Header) string {
+	for _, value := range header["Digest"] {
+		for _, digest := range strings.Split(value, ",") {
+			parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+			if len(parts) == 2 && strings.EqualFold(parts[0], "sha-256") {
+				return "sha-256=" + parts[1]
+			}
+		}
+	}
+	return ""
+}
 
-	return true, count, cachingInfoOut, nil
+func sha256Digest(sum []byte) string {
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
 }
 
 // convertETagToChecksum returns true if ETag is a valid MD5 hash, so a checksum action was intended.
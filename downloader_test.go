@@ -1,14 +1,30 @@
 package cacheddownloader_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	Url "net/url"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/onsi/gomega/ghttp"
@@ -19,6 +35,35 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+func sha256Hex(content string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+}
+
+type fakeSchemeHandler struct {
+	lock     sync.Mutex
+	urls     []string
+	failures int
+}
+
+func (h *fakeSchemeHandler) Download(ctx context.Context, url *Url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (DownloadResult, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.urls = append(h.urls, url.String())
+	if h.failures > 0 {
+		h.failures--
+		destinationFile.WriteString("partial")
+		return DownloadResult{}, errors.New("bucket unavailable")
+	}
+
+	if cachingInfoIn.ETag == "the-etag" {
+		return DownloadResult{CachingInfo: cachingInfoIn}, nil
+	}
+
+	n, err := destinationFile.WriteString("from " + url.Host)
+	return DownloadResult{DidDownload: true, Size: int64(n), CachingInfo: CachingInfoType{ETag: "the-etag"}}, err
+}
+
 func md5HexEtag(content string) string {
 	contentHash := md5.New()
 	contentHash.Write([]byte(content))
@@ -56,13 +101,10 @@ var _ = Describe("Downloader", func() {
 
 		Context("when the download is successful", func() {
 			var (
-				downloadSize int64
-				expectedSize int64
-
-				downloadErr error
-				didDownload bool
+				downloadResult DownloadResult
+				downloadErr    error
 
-				downloadCachingInfo CachingInfoType
+				expectedSize        int64
 				expectedCachingInfo CachingInfoType
 				expectedEtag        string
 			)
@@ -70,7 +112,7 @@ var _ = Describe("Downloader", func() {
 			JustBeforeEach(func() {
 				serverUrl := testServer.URL + "/somepath"
 				url, _ = url.Parse(serverUrl)
-				didDownload, downloadSize, downloadCachingInfo, downloadErr = downloader.Download(url, file, CachingInfoType{})
+				downloadResult, downloadErr = downloader.Download(url, file, CachingInfoType{})
 			})
 
 			Context("and contains a matching MD5 Hash in the Etag", func() {
@@ -87,9 +129,12 @@ var _ = Describe("Downloader", func() {
 						expectedCachingInfo = CachingInfoType{
 							ETag:         md5HexEtag(msg),
 							LastModified: "The 70s",
+							ContentType:  "text/plain",
+							SourceURL:    url.String(),
 						}
 						w.Header().Set("ETag", expectedCachingInfo.ETag)
 						w.Header().Set("Last-Modified", expectedCachingInfo.LastModified)
+						w.Header().Set("Content-Type", expectedCachingInfo.ContentType)
 
 						bytesWritten, _ := fmt.Fprint(w, msg)
 						expectedSize = int64(bytesWritten)
@@ -105,7 +150,7 @@ var _ = Describe("Downloader", func() {
 				})
 
 				It("claims to have downloaded", func() {
-					Ω(didDownload).Should(BeTrue())
+					Ω(downloadResult.DidDownload).Should(BeTrue())
 				})
 
 				It("gets a file from a url", func() {
@@ -121,11 +166,11 @@ var _ = Describe("Downloader", func() {
 				})
 
 				It("return number of bytes it downloaded", func() {
-					Ω(downloadSize).Should(Equal(expectedSize))
+					Ω(downloadResult.Size).Should(Equal(expectedSize))
 				})
 
 				It("returns the ETag", func() {
-					Ω(downloadCachingInfo).Should(Equal(expectedCachingInfo))
+					Ω(downloadResult.CachingInfo).Should(Equal(expectedCachingInfo))
 				})
 			})
 
@@ -140,12 +185,12 @@ var _ = Describe("Downloader", func() {
 				})
 
 				It("succeeds without doing a checksum", func() {
-					Ω(didDownload).Should(BeTrue())
+					Ω(downloadResult.DidDownload).Should(BeTrue())
 					Ω(downloadErr).ShouldNot(HaveOccurred())
 				})
 
 				It("should returns the ETag in the caching info", func() {
-					Ω(downloadCachingInfo.ETag).Should(Equal(expectedEtag))
+					Ω(downloadResult.CachingInfo.ETag).Should(Equal(expectedEtag))
 				})
 			})
 
@@ -158,12 +203,13 @@ var _ = Describe("Downloader", func() {
 				})
 
 				It("succeeds without doing a checksum", func() {
-					Ω(didDownload).Should(BeTrue())
+					Ω(downloadResult.DidDownload).Should(BeTrue())
 					Ω(downloadErr).ShouldNot(HaveOccurred())
 				})
 
 				It("should returns no ETag in the caching info", func() {
-					Ω(downloadCachingInfo).Should(BeZero())
+					Ω(downloadResult.CachingInfo.ETag).Should(BeEmpty())
+					Ω(downloadResult.CachingInfo.LastModified).Should(BeEmpty())
 				})
 			})
 		})
@@ -190,9 +236,9 @@ var _ = Describe("Downloader", func() {
 				didDownloads := make(chan bool)
 
 				go func() {
-					didDownload, _, _, err := downloader.Download(url, file, CachingInfoType{})
+					result, err := downloader.Download(url, file, CachingInfoType{})
 					errs <- err
-					didDownloads <- didDownload
+					didDownloads <- result.DidDownload
 				}()
 
 				Eventually(requestInitiated).Should(Receive())
@@ -204,6 +250,46 @@ var _ = Describe("Downloader", func() {
 			})
 		})
 
+		Context("when the timeout is changed", func() {
+			var requestInitiated chan struct{}
+
+			BeforeEach(func() {
+				requestInitiated = make(chan struct{}, MAX_DOWNLOAD_ATTEMPTS)
+
+				testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					requestInitiated <- struct{}{}
+
+					time.Sleep(300 * time.Millisecond)
+					fmt.Fprint(w, "Hello, client")
+				}))
+
+				serverUrl := testServer.URL + "/somepath"
+				url, _ = url.Parse(serverUrl)
+			})
+
+			It("uses the new timeout for subsequent downloads", func() {
+				downloader.SetTimeout(time.Second)
+
+				result, err := downloader.Download(url, file, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(result.DidDownload).Should(BeTrue())
+			})
+
+			It("keeps the original timeout for downloads already in flight", func() {
+				errs := make(chan error)
+
+				go func() {
+					_, err := downloader.Download(url, file, CachingInfoType{})
+					errs <- err
+				}()
+
+				Eventually(requestInitiated).Should(Receive())
+				downloader.SetTimeout(time.Second)
+
+				Eventually(errs, 2).Should(Receive(HaveOccurred()))
+			})
+		})
+
 		Context("when the download fails with a protocol error", func() {
 			BeforeEach(func() {
 				// No server to handle things!
@@ -213,9 +299,9 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return the error", func() {
-				didDownload, _, _, err := downloader.Download(url, file, CachingInfoType{})
+				result, err := downloader.Download(url, file, CachingInfoType{})
 				Ω(err).NotTo(BeNil())
-				Ω(didDownload).Should(BeFalse())
+				Ω(result.DidDownload).Should(BeFalse())
 			})
 		})
 
@@ -228,9 +314,9 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return the error", func() {
-				didDownload, _, _, err := downloader.Download(url, file, CachingInfoType{})
+				result, err := downloader.Download(url, file, CachingInfoType{})
 				Ω(err).NotTo(BeNil())
-				Ω(didDownload).Should(BeFalse())
+				Ω(result.DidDownload).Should(BeFalse())
 			})
 		})
 
@@ -250,14 +336,950 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return an error", func() {
-				didDownload, _, cachingInfo, err := downloader.Download(url, file, CachingInfoType{})
+				result, err := downloader.Download(url, file, CachingInfoType{})
 				Ω(err).NotTo(BeNil())
-				Ω(didDownload).Should(BeFalse())
-				Ω(cachingInfo).Should(BeZero())
+				Ω(result.DidDownload).Should(BeFalse())
+				Ω(result.CachingInfo).Should(BeZero())
 			})
 		})
 	})
 
+	Describe("dialing with an address family preference", func() {
+		var url *Url.URL
+		var file *os.File
+
+		BeforeEach(func() {
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "Hello, client")
+			}))
+
+			_, port, err := net.SplitHostPort(testServer.Listener.Addr().String())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			url, _ = Url.Parse("http://localhost:" + port + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("downloads when preferring IPv4", func() {
+			downloader = NewDownloader(time.Second, WithDialAddressFamily(AddressFamilyPreferIPv4))
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+		})
+
+		It("downloads through the DNS cache", func() {
+			downloader = NewDownloader(time.Second, WithDNSCache(time.Minute))
+			for i := 0; i < 2; i++ {
+				result, err := downloader.Download(url, file, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(result.DidDownload).Should(BeTrue())
+			}
+		})
+
+		It("falls back to IPv4 when preferring IPv6 and the server only listens on IPv4", func() {
+			downloader = NewDownloader(time.Second, WithDialAddressFamily(AddressFamilyPreferIPv6))
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+		})
+	})
+
+	Describe("downloading in parallel chunks", func() {
+		var url *Url.URL
+		var file *os.File
+		var content string
+		var acceptRanges bool
+		var rangeRequests []string
+
+		BeforeEach(func() {
+			content = strings.Repeat("0123456789", 100)
+			acceptRanges = true
+			rangeRequests = []string{}
+
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				if r.Header.Get("Range") != "" {
+					rangeRequests = append(rangeRequests, r.Header.Get("Range"))
+				}
+				lock.Unlock()
+
+				if !acceptRanges {
+					fmt.Fprint(w, content)
+					return
+				}
+
+				w.Header().Set("ETag", md5HexEtag(content))
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("fetches the remaining chunks with range requests and reassembles the file", func() {
+			downloader = NewDownloader(time.Second, WithParallelChunks(4, 100))
+
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+			Ω(result.Size).Should(Equal(int64(len(content))))
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(ConsistOf("bytes=250-499", "bytes=500-749", "bytes=750-999"))
+		})
+
+		It("uses a single stream for files smaller than the minimum size", func() {
+			downloader = NewDownloader(time.Second, WithParallelChunks(4, int64(len(content))))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(BeEmpty())
+		})
+
+		It("uses a single stream when the server does not support ranges", func() {
+			acceptRanges = false
+			downloader = NewDownloader(time.Second, WithParallelChunks(4, 100))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(BeEmpty())
+		})
+	})
+
+	Describe("downloading with a chunk manifest", func() {
+		var url *Url.URL
+		var file *os.File
+		var content string
+		var manifest []ChunkHash
+		var corruptRanges map[string]int
+		var rangeRequests []string
+
+		BeforeEach(func() {
+			content = strings.Repeat("0123456789", 100)
+			manifest = []ChunkHash{
+				{Size: 400, SHA256: sha256Hex(content[:400])},
+				{Size: 400, SHA256: sha256Hex(content[400:800])},
+				{Size: 200, SHA256: sha256Hex(content[800:])},
+			}
+			corruptRanges = map[string]int{}
+			rangeRequests = []string{}
+
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				rangeRequests = append(rangeRequests, r.Header.Get("Range"))
+				corrupt := corruptRanges[r.Header.Get("Range")] > 0
+				if corrupt {
+					corruptRanges[r.Header.Get("Range")]--
+				}
+				lock.Unlock()
+
+				body := content
+				if corrupt {
+					body = strings.Repeat("X", len(content))
+				}
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+			downloader = NewDownloader(time.Second)
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("fetches and verifies every chunk", func() {
+			size, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(size).Should(Equal(int64(len(content))))
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(ConsistOf("bytes=0-399", "bytes=400-799", "bytes=800-999"))
+		})
+
+		It("fetches chunks concurrently when parallel chunks are configured", func() {
+			downloader = NewDownloader(time.Second, WithParallelChunks(2, 0))
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+		})
+
+		It("refetches only the chunk that does not match its hash", func() {
+			corruptRanges["bytes=400-799"] = 1
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(ConsistOf("bytes=0-399", "bytes=400-799", "bytes=400-799", "bytes=800-999"))
+		})
+
+		It("fails when a chunk keeps failing verification", func() {
+			corruptRanges["bytes=800-999"] = MAX_DOWNLOAD_ATTEMPTS
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("offset 800"))
+		})
+
+		It("keeps the chunks an earlier call already verified", func() {
+			corruptRanges["bytes=800-999"] = MAX_DOWNLOAD_ATTEMPTS
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).Should(HaveOccurred())
+
+			rangeRequests = []string{}
+			_, err = downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(ConsistOf("bytes=800-999"))
+		})
+
+		It("truncates a destination file that is longer than the manifest", func() {
+			_, err := file.WriteString(content + "trailing")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte(content)))
+			Ω(rangeRequests).Should(BeEmpty())
+		})
+
+		It("stops fetching chunks once the circuit opens", func() {
+			downloader = NewDownloader(time.Second, WithCircuitBreaker(1, time.Minute, time.Minute))
+			testServer.Close()
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).Should(Equal(ErrCircuitOpen))
+		})
+
+		It("rejects a manifest with a malformed hash", func() {
+			manifest[1].SHA256 = "not-a-hash"
+
+			_, err := downloader.DownloadWithManifest(url, file, manifest)
+			Ω(err).Should(HaveOccurred())
+			Ω(rangeRequests).Should(BeEmpty())
+		})
+	})
+
+	Describe("the Digest header", func() {
+		var url *Url.URL
+		var file *os.File
+		var digest string
+
+		BeforeEach(func() {
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Digest", digest)
+				fmt.Fprint(w, "Hello, digest")
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		sha256Digest := func(content string) string {
+			sum := sha256.Sum256([]byte(content))
+			return base64.StdEncoding.EncodeToString(sum[:])
+		}
+
+		It("returns the SHA-256 digest in the caching info", func() {
+			digest = "md5=ignored, SHA-256=" + sha256Digest("Hello, digest")
+
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.CachingInfo.Digest).Should(Equal("sha-256=" + sha256Digest("Hello, digest")))
+		})
+
+		It("fails when the content does not match the digest", func() {
+			digest = "sha-256=" + sha256Digest("something else")
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(HaveOccurred())
+			Ω(err.Error()).Should(ContainSubstring("Digest mismatch"))
+		})
+	})
+
+	Describe("limiting the size of downloads", func() {
+		var url *Url.URL
+		var file *os.File
+		var contentType string
+		var requests int32
+
+		BeforeEach(func() {
+			contentType = "application/json"
+			atomic.StoreInt32(&requests, 0)
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Header().Set("Content-Type", contentType)
+				if r.URL.Path == "/undeclared" {
+					// Flushing before writing the body leaves out Content-Length
+					w.(http.Flusher).Flush()
+				}
+				fmt.Fprint(w, "0123456789")
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+
+			downloader = NewDownloader(100*time.Millisecond,
+				WithResponseBodyLimit(100),
+				WithContentTypeSizeLimits(map[string]int64{"Application/JSON": 5, "image/png": 1000}),
+			)
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("fails without retrying when the declared size exceeds the limit for the type", func() {
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrDownloadTooLarge))
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(1)))
+		})
+
+		It("fails when the body exceeds the limit without declaring its size", func() {
+			url.Path = "/undeclared"
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrDownloadTooLarge))
+		})
+
+		It("ignores parameters of the content type", func() {
+			contentType = "application/json; charset=utf-8"
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrDownloadTooLarge))
+		})
+
+		It("falls back to the default limit for unlisted types", func() {
+			contentType = "text/plain"
+
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.Size).Should(Equal(int64(10)))
+
+			downloader = NewDownloader(100*time.Millisecond, WithResponseBodyLimit(5))
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrDownloadTooLarge))
+		})
+	})
+
+	Describe("the circuit breaker", func() {
+		var url *Url.URL
+		var file *os.File
+		var clock *fakeClock
+		var status int32
+		var requests int32
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&status, http.StatusInternalServerError)
+			atomic.StoreInt32(&requests, 0)
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.WriteHeader(int(atomic.LoadInt32(&status)))
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+
+			clock = &fakeClock{now: time.Now()}
+			downloader = NewDownloader(time.Second, WithClock(clock), WithCircuitBreaker(MAX_DOWNLOAD_ATTEMPTS, time.Minute, time.Minute))
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		openCircuit := func() {
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(HaveOccurred())
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(MAX_DOWNLOAD_ATTEMPTS)))
+		}
+
+		It("short-circuits downloads once the host has failed too often", func() {
+			openCircuit()
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrCircuitOpen))
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(MAX_DOWNLOAD_ATTEMPTS)))
+		})
+
+		It("lets a probe through after the cool-down and closes again if it succeeds", func() {
+			openCircuit()
+			clock.Step(time.Minute)
+			atomic.StoreInt32(&status, http.StatusOK)
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("opens again if the probe fails", func() {
+			openCircuit()
+			clock.Step(time.Minute)
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrCircuitOpen))
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(MAX_DOWNLOAD_ATTEMPTS + 1)))
+		})
+
+		It("lets another probe through if a probe is cancelled", func() {
+			openCircuit()
+			clock.Step(time.Minute)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := DownloadContext(ctx, downloader, url, file)
+			Ω(err).Should(Equal(context.Canceled))
+
+			atomic.StoreInt32(&status, http.StatusOK)
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("does not count failures that are further apart than the window", func() {
+			downloader = NewDownloader(time.Second, WithClock(clock), WithCircuitBreaker(MAX_DOWNLOAD_ATTEMPTS+1, time.Minute, time.Minute))
+			openCircuit()
+			clock.Step(2 * time.Minute)
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(Equal(ErrCircuitOpen))
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(2 * MAX_DOWNLOAD_ATTEMPTS)))
+		})
+
+		It("does not count responses that reject the request", func() {
+			atomic.StoreInt32(&status, http.StatusNotFound)
+
+			for i := 0; i < 2; i++ {
+				_, err := downloader.Download(url, file, CachingInfoType{})
+				Ω(err).ShouldNot(Equal(ErrCircuitOpen))
+			}
+			Ω(atomic.LoadInt32(&requests)).Should(Equal(int32(2 * MAX_DOWNLOAD_ATTEMPTS)))
+		})
+	})
+
+	Describe("the copy buffer", func() {
+		var url *Url.URL
+		var file *os.File
+		var content []byte
+
+		BeforeEach(func() {
+			content = bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+			testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("writes the whole file whatever its size", func() {
+			content = bytes.Repeat([]byte("0123456789abcdef"), 1000)
+			downloader = NewDownloader(time.Second, WithCopyBufferSize(7))
+
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.Size).Should(Equal(int64(len(content))))
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal(content))
+		})
+
+		Measure("downloads 64MB", func(b Benchmarker) {
+			for _, size := range []int{32 << 10, DefaultCopyBufferSize} {
+				downloader = NewDownloader(time.Second, WithCopyBufferSize(size))
+				b.Time(fmt.Sprintf("%dKB buffer", size>>10), func() {
+					_, err := downloader.Download(url, file, CachingInfoType{})
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			}
+		}, 5)
+	})
+
+	Describe("pinning TLS public keys", func() {
+		var url *Url.URL
+		var file *os.File
+		var rootCAs *x509.CertPool
+		var serverPin string
+
+		BeforeEach(func() {
+			testServer = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "Hello, pinned client")
+			}))
+
+			rootCAs = x509.NewCertPool()
+			rootCAs.AddCert(testServer.Certificate())
+
+			hash := sha256.Sum256(testServer.Certificate().RawSubjectPublicKeyInfo)
+			serverPin = base64.StdEncoding.EncodeToString(hash[:])
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("downloads from servers with a pinned public key", func() {
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs), WithTLSPins([]string{"sha256/" + serverPin}))
+
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+		})
+
+		It("fails with ErrPinMismatch for other servers", func() {
+			otherHash := sha256.Sum256([]byte("some other key"))
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs), WithTLSPins([]string{base64.StdEncoding.EncodeToString(otherHash[:])}))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(errors.Is(err, ErrPinMismatch)).Should(BeTrue())
+		})
+
+		It("ignores pinned certificates that are not part of the verified chain", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Ω(err).ShouldNot(HaveOccurred())
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "pinned intermediate"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				IsCA:         true,
+				KeyUsage:     x509.KeyUsageCertSign,
+
+				BasicConstraintsValid: true,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Ω(err).ShouldNot(HaveOccurred())
+			pinnedCert, err := x509.ParseCertificate(der)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			serverCert := testServer.TLS.Certificates[0]
+			serverCert.Certificate = append(append([][]byte{}, serverCert.Certificate...), der)
+			otherServer := httptest.NewUnstartedServer(testServer.Config.Handler)
+			otherServer.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			otherServer.StartTLS()
+			defer otherServer.Close()
+
+			hash := sha256.Sum256(pinnedCert.RawSubjectPublicKeyInfo)
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs), WithTLSPins([]string{base64.StdEncoding.EncodeToString(hash[:])}))
+
+			otherURL, _ := Url.Parse(otherServer.URL + "/somepath")
+			_, err = downloader.Download(otherURL, file, CachingInfoType{})
+			Ω(errors.Is(err, ErrPinMismatch)).Should(BeTrue())
+		})
+
+		It("fails with ErrPinMismatch when the chain is not verified", func() {
+			downloader = NewDownloader(time.Second, WithInsecureSkipVerify(), WithTLSPins([]string{"sha256/" + serverPin}))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(errors.Is(err, ErrPinMismatch)).Should(BeTrue())
+		})
+	})
+
+	Describe("WithInsecureSkipVerify", func() {
+		var url *Url.URL
+		var file *os.File
+
+		BeforeEach(func() {
+			testServer = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "Hello, self-signed client")
+			}))
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("rejects servers with untrusted certificates without it", func() {
+			downloader = NewDownloader(time.Second)
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("downloads from them, warning on every download", func() {
+			logger := &fakeLogger{}
+			downloader = NewDownloader(time.Second, WithInsecureSkipVerify(), WithLogger(logger))
+
+			for i := 0; i < 2; i++ {
+				result, err := downloader.Download(url, file, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(result.DidDownload).Should(BeTrue())
+			}
+
+			Ω(logger.messages).Should(HaveLen(2))
+			Ω(logger.messages[0]).Should(ContainSubstring("without verifying TLS certificates"))
+			Ω(logger.messages[0]).Should(ContainSubstring(url.Host))
+		})
+	})
+
+	Describe("HTTP/2", func() {
+		var url *Url.URL
+		var file *os.File
+		var rootCAs *x509.CertPool
+		var protocols chan int
+
+		BeforeEach(func() {
+			protocols = make(chan int, 1)
+			testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				protocols <- r.ProtoMajor
+				fmt.Fprint(w, "Hello, multiplexed client")
+			}))
+			testServer.EnableHTTP2 = true
+			testServer.StartTLS()
+
+			rootCAs = x509.NewCertPool()
+			rootCAs.AddCert(testServer.Certificate())
+
+			url, _ = Url.Parse(testServer.URL + "/somepath")
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			testServer.Close()
+		})
+
+		It("is used when enabled", func() {
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs), WithHTTP2(true), WithMaxIdleConns(10), WithIdleConnTimeout(time.Minute))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(protocols).Should(Receive(Equal(2)))
+		})
+
+		It("is used by default", func() {
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(protocols).Should(Receive(Equal(2)))
+		})
+
+		It("is not used when disabled", func() {
+			downloader = NewDownloader(time.Second, WithRootCAs(rootCAs), WithHTTP2(false))
+
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(protocols).Should(Receive(Equal(1)))
+		})
+	})
+
+	Describe("reporting progress", func() {
+		var server *ghttp.Server
+		var file *os.File
+		var clock *fakeClock
+		var reports chan Progress
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Now()}
+			reports = make(chan Progress, 10)
+			downloader = NewDownloader(time.Second, WithClock(clock), WithProgress(func(u *Url.URL, progress Progress) {
+				reports <- progress
+			}))
+
+			server = ghttp.NewServer()
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			server.Close()
+		})
+
+		download := func() []Progress {
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			close(reports)
+			progress := []Progress{}
+			for report := range reports {
+				progress = append(progress, report)
+			}
+			return progress
+		}
+
+		writePieces := func(w http.ResponseWriter) {
+			for i := 0; i < 3; i++ {
+				clock.Step(time.Second)
+				w.Write([]byte(strings.Repeat("x", 100)))
+				w.(http.Flusher).Flush()
+				if i < 2 {
+					Eventually(func() int { return len(reports) }).Should(Equal(i + 1))
+				}
+			}
+		}
+
+		It("reports the bytes, rate and time remaining", func() {
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "300")
+				writePieces(w)
+			})
+
+			Ω(download()).Should(Equal([]Progress{
+				{Bytes: 100, TotalBytes: 300, BytesPerSecond: 100, Remaining: 2 * time.Second},
+				{Bytes: 200, TotalBytes: 300, BytesPerSecond: 100, Remaining: time.Second},
+				{Bytes: 300, TotalBytes: 300, BytesPerSecond: 100},
+			}))
+		})
+
+		It("reports no time remaining when the size is unknown", func() {
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				writePieces(w)
+			})
+
+			progress := download()
+			Ω(progress).Should(HaveLen(3))
+			for _, report := range progress {
+				Ω(report.TotalBytes).Should(BeEquivalentTo(-1))
+				Ω(report.BytesPerSecond).Should(BeEquivalentTo(100))
+				Ω(report.Remaining).Should(BeZero())
+			}
+		})
+
+		It("reports the final byte count of a quick download", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "Hello"))
+
+			progress := download()
+			Ω(progress).Should(HaveLen(1))
+			Ω(progress[0].Bytes).Should(BeEquivalentTo(5))
+		})
+	})
+
+	Describe("rewriting URLs", func() {
+		var server *ghttp.Server
+		var file *os.File
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/mirror/somepath"),
+				ghttp.RespondWith(http.StatusOK, "Hello, mirror"),
+			))
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			server.Close()
+		})
+
+		It("downloads from the rewritten URL without modifying the original", func() {
+			downloader = NewDownloader(time.Second, WithURLRewriter(func(u *Url.URL) *Url.URL {
+				u.Path = "/mirror" + u.Path
+				return u
+			}))
+
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			Ω(url.Path).Should(Equal("/somepath"))
+		})
+
+		It("downloads from the original URL when the rewriter returns nil", func() {
+			downloader = NewDownloader(time.Second, WithURLRewriter(func(u *Url.URL) *Url.URL {
+				return nil
+			}))
+
+			url, _ := Url.Parse(server.URL() + "/mirror/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("allowing only some hosts", func() {
+		var server *ghttp.Server
+		var file *os.File
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+			server.Close()
+		})
+
+		It("downloads from an allowed host", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, "Hello"))
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"127.0.0.1"}))
+
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("refuses other hosts without a request", func() {
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"example.com"}))
+
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+			Ω(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("refuses redirects to other hosts", func() {
+			target := ghttp.NewServer()
+			defer target.Close()
+			targetURL := strings.Replace(target.URL(), "127.0.0.1", "localhost", 1)
+
+			server.AppendHandlers(ghttp.RespondWith(http.StatusFound, "", http.Header{"Location": []string{targetURL + "/elsewhere"}}))
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"127.0.0.1"}))
+
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			Ω(target.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("refuses other hosts for manifest downloads without a request", func() {
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"example.com"}))
+
+			sum := sha256.Sum256([]byte("Hello"))
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.DownloadWithManifest(url, file, []ChunkHash{{Size: 5, SHA256: hex.EncodeToString(sum[:])}})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+			Ω(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("lets another probe through if a probe is redirected to another host", func() {
+			clock := &fakeClock{now: time.Now()}
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"127.0.0.1"}), WithClock(clock), WithCircuitBreaker(1, time.Minute, time.Minute))
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusInternalServerError, ""),
+				ghttp.RespondWith(http.StatusFound, "", http.Header{"Location": []string{"http://localhost/elsewhere"}}),
+				ghttp.RespondWith(http.StatusOK, "Hello"),
+			)
+
+			url, _ := Url.Parse(server.URL() + "/somepath")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrCircuitOpen))
+
+			clock.Step(time.Minute)
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("allows subdomains of a wildcard", func() {
+			handler := &fakeSchemeHandler{}
+			downloader = NewDownloader(time.Second, WithAllowedHosts([]string{"*.example.com"}), WithSchemeHandler("s3", handler))
+
+			url, _ := Url.Parse("s3://bucket.Example.com/my-object")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			url, _ = Url.Parse("s3://example.com/my-object")
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+
+			url, _ = Url.Parse("s3://badexample.com/my-object")
+			_, err = downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(Equal(ErrHostNotAllowed))
+			Ω(handler.urls).Should(HaveLen(1))
+		})
+	})
+
+	Describe("scheme handlers", func() {
+		var handler *fakeSchemeHandler
+		var file *os.File
+
+		BeforeEach(func() {
+			handler = &fakeSchemeHandler{}
+			downloader.RegisterSchemeHandler("s3", handler)
+			file, _ = ioutil.TempFile("", "foo")
+		})
+
+		AfterEach(func() {
+			file.Close()
+			os.RemoveAll(file.Name())
+		})
+
+		It("dispatches on the scheme of the URL", func() {
+			url, _ := Url.Parse("s3://my-bucket/my-object")
+			result, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(result.DidDownload).Should(BeTrue())
+			Ω(handler.urls).Should(Equal([]string{"s3://my-bucket/my-object"}))
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte("from my-bucket")))
+		})
+
+		It("retries failed downloads into an empty file", func() {
+			handler.failures = 2
+			url, _ := Url.Parse("s3://my-bucket/my-object")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(handler.urls).Should(HaveLen(3))
+			Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte("from my-bucket")))
+		})
+
+		It("can be registered as an option", func() {
+			downloader = NewDownloader(time.Second, WithSchemeHandler("gs", handler))
+			url, _ := Url.Parse("gs://my-bucket/my-object")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(handler.urls).Should(Equal([]string{"gs://my-bucket/my-object"}))
+		})
+
+		It("leaves other schemes to the built-in downloader", func() {
+			url, _ := Url.Parse("gs://my-bucket/my-object")
+			_, err := downloader.Download(url, file, CachingInfoType{})
+			Ω(err).Should(HaveOccurred())
+			Ω(handler.urls).Should(BeEmpty())
+		})
+	})
+
 	Context("Downloading witbh caching info", func() {
 		var (
 			server     *ghttp.Server
@@ -297,9 +1319,9 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return that it did not download", func() {
-				didDownload, size, _, err := downloader.Download(url, file, cachedInfo)
-				Ω(didDownload).Should(BeFalse())
-				Ω(size).Should(Equal(int64(0)))
+				result, err := downloader.Download(url, file, cachedInfo)
+				Ω(result.DidDownload).Should(BeFalse())
+				Ω(result.Size).Should(Equal(int64(0)))
 				Ω(err).ShouldNot(HaveOccurred())
 			})
 
@@ -318,9 +1340,9 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return that it did download and the file size", func() {
-				didDownload, size, _, err := downloader.Download(url, file, cachedInfo)
-				Ω(didDownload).Should(BeTrue())
-				Ω(size).Should(Equal(int64(len(body))))
+				result, err := downloader.Download(url, file, cachedInfo)
+				Ω(result.DidDownload).Should(BeTrue())
+				Ω(result.Size).Should(Equal(int64(len(body))))
 				Ω(err).ShouldNot(HaveOccurred())
 			})
 
@@ -350,9 +1372,9 @@ var _ = Describe("Downloader", func() {
 			})
 
 			It("should return false with an error", func() {
-				didDownload, size, _, err := downloader.Download(url, file, cachedInfo)
-				Ω(didDownload).Should(BeFalse())
-				Ω(size).Should(Equal(int64(0)))
+				result, err := downloader.Download(url, file, cachedInfo)
+				Ω(result.DidDownload).Should(BeFalse())
+				Ω(result.Size).Should(Equal(int64(0)))
 				Ω(err).Should(HaveOccurred())
 			})
 
@@ -0,0 +1,104 @@
+package cacheddownloader
+
+import (
+	"fmt"
+	"net/url"
+	"sync/atomic"
+)
+
+// CacheEventType says what happened in a CacheEvent.
+type CacheEventType int
+
+const (
+	// EventDownloaded is emitted when a file was downloaded, whether or not
+	// it was then admitted into the cache. A 304 downloads nothing.
+	EventDownloaded CacheEventType = iota
+	// EventAdmitted is emitted when a file enters the cache.
+	EventAdmitted
+	// EventEvicted is emitted when an entry is evicted to make room or for
+	// being idle. Entries that are replaced or removed are not evicted.
+	EventEvicted
+	// EventHit is emitted when a fetch was served from the cache.
+	EventHit
+	// EventError is emitted when a fetch failed.
+	EventError
+)
+
+func (t CacheEventType) String() string {
+	switch t {
+	case EventDownloaded:
+		return "downloaded"
+	case EventAdmitted:
+		return "admitted"
+	case EventEvicted:
+		return "evicted"
+	case EventHit:
+		return "hit"
+	case EventError:
+		return "error"
+	default:
+		return fmt.Sprintf("CacheEventType(%d)", int(t))
+	}
+}
+
+// CacheEvent describes something that happened in the cache. CacheKey is the
+// hashed key, as in CacheEntryInfo, and is empty for uncached fetches. URL is
+// only set for events of a fetch, Size for downloads, admissions and
+// evictions, and Err for errors.
+type CacheEvent struct {
+	Type     CacheEventType
+	CacheKey string
+	URL      *url.URL
+	Size     int64
+	Err      error
+}
+
+// eventStream delivers events to a buffered channel without ever blocking:
+// when the consumer falls behind, events are dropped and counted. A nil
+// eventStream discards everything.
+type eventStream struct {
+	events  chan CacheEvent
+	dropped uint64
+}
+
+func newEventStream(bufferSize int) *eventStream {
+	if bufferSize <= 0 {
+		return nil
+	}
+	return &eventStream{events: make(chan CacheEvent, bufferSize)}
+}
+
+func (s *eventStream) emit(event CacheEvent) {
+	if s == nil {
+		return
+	}
+
+	select {
+	case s.events <- event:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// channel returns nil for a nil eventStream, which a consumer can select on
+// without ever receiving.
+func (s *eventStream) channel() <-chan CacheEvent {
+	if s == nil {
+		return nil
+	}
+	return s.events
+}
+
+func (s *eventStream) droppedEvents() uint64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *eventStream) resetDropped() {
+	if s == nil {
+		return
+	}
+	atomic.StoreUint64(&s.dropped, 0)
+}
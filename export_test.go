@@ -0,0 +1,41 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net/url"
+	"os"
+)
+
+// Exported for testing internals from cacheddownloader_test.
+
+var NewDNSCache = newDNSCache
+var WithFreeDiskSpace = withFreeDiskSpace
+var WithFileOps = withFileOps
+var WithFsync = withFsync
+
+// FetchWaiters returns how many fetches wait for a download of cacheKey that
+// is in flight.
+func FetchWaiters(cache CachedDownloader, cacheKey string) int {
+	flights := cache.(*cachedDownloader).flights
+	flights.lock.Lock()
+	defer flights.lock.Unlock()
+
+	f, ok := flights.flights[hashCacheKey(cacheKey)]
+	if !ok {
+		return 0
+	}
+	return f.waiters
+}
+
+// DownloadContext is Download, but gives up once ctx is done, as downloads
+// for FetchContext do.
+func DownloadContext(ctx context.Context, downloader *Downloader, url *url.URL, destinationFile *os.File) (DownloadResult, error) {
+	return downloader.download(url, destinationFile, CachingInfoType{}, downloadRequest{ctx: ctx})
+}
+
+// SharedDescriptors returns how many shared descriptors the cache has open.
+func SharedDescriptors(cache *FileCache) int {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	return len(cache.sharedFiles)
+}
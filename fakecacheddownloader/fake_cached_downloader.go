@@ -2,15 +2,71 @@ package fakecacheddownloader
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"time"
+
+	"github.com/pivotal-golang/cacheddownloader"
 )
 
 type FakeCachedDownloader struct {
 	FetchedURL      *url.URL
 	FetchedCacheKey string
+	FetchedURLs     []*url.URL
+	FetchedAccept   string
+	FetchedMethod   string
+	FetchedBody     []byte
+	ForcedRefresh   bool
+	OlderThan       time.Time
 	FetchedContent  []byte
+	FetchedResult   cacheddownloader.FetchResult
 	FetchError      error
+
+	PutCacheKey    string
+	PutContent     []byte
+	PutCachingInfo cacheddownloader.CachingInfoType
+	PutError       error
+
+	PutConflict     bool
+	PutExpectedETag string
+
+	MetadataCacheKey string
+	StoredMetadata   map[string]string
+
+	ResponseHeaders http.Header
+
+	AwaitedCacheKeys []string
+	AwaitWarmError   error
+
+	WarmedRequests []cacheddownloader.WarmRequest
+	WarmSkipped    []cacheddownloader.WarmRequest
+	WarmError      error
+
+	EventsChannel chan cacheddownloader.CacheEvent
+
+	MigratedTo   string
+	MigrateError error
+
+	BuildRequestError error
+
+	Namespaces []string
+
+	SidecarSuffix string
+
+	FetchedChecksum string
+
+	LinkedSymlinkPath string
+
+	InFlightKeys map[string]bool
+
+	Resets int
+
+	EvictTarget     int64
+	EvictFreedBytes int64
+	EvictError      error
 }
 
 func New() *FakeCachedDownloader {
@@ -18,6 +74,67 @@ func New() *FakeCachedDownloader {
 }
 
 func (c *FakeCachedDownloader) Fetch(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	reader, _, err := c.FetchInfo(url, cacheKey)
+	return reader, err
+}
+
+func (c *FakeCachedDownloader) FetchInfo(url *url.URL, cacheKey string) (io.ReadCloser, cacheddownloader.FetchResult, error) {
+	c.FetchedURL = url
+	c.FetchedCacheKey = cacheKey
+
+	if c.FetchError != nil {
+		return nil, cacheddownloader.FetchResult{}, c.FetchError
+	}
+
+	return &readCloser{bytes.NewBuffer(c.FetchedContent)}, c.FetchedResult, c.FetchError
+}
+
+func (c *FakeCachedDownloader) FetchContext(ctx context.Context, url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchWithAccept(url *url.URL, cacheKey string, accept string) (io.ReadCloser, error) {
+	c.FetchedAccept = accept
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchWithMethod(url *url.URL, cacheKey string, method string, body []byte) (io.ReadCloser, error) {
+	c.FetchedMethod = method
+	c.FetchedBody = body
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchForceRefresh(url *url.URL, cacheKey string) (io.ReadCloser, error) {
+	c.ForcedRefresh = true
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchIfOlderThan(url *url.URL, cacheKey string, t time.Time) (io.ReadCloser, error) {
+	c.OlderThan = t
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) BuildRequest(ctx context.Context, url *url.URL, cacheKey string) (*http.Request, error) {
+	if c.BuildRequestError != nil {
+		return nil, c.BuildRequestError
+	}
+	return http.NewRequestWithContext(ctx, "GET", url.String(), nil)
+}
+
+func (c *FakeCachedDownloader) FetchWithFallbackURLs(urls []*url.URL, cacheKey string) (io.ReadCloser, error) {
+	c.FetchedURLs = urls
+
+	var url *url.URL
+	if len(urls) > 0 {
+		url = urls[0]
+	}
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchBytes(url *url.URL, cacheKey string) ([]byte, error) {
 	c.FetchedURL = url
 	c.FetchedCacheKey = cacheKey
 
@@ -25,7 +142,170 @@ func (c *FakeCachedDownloader) Fetch(url *url.URL, cacheKey string) (io.ReadClos
 		return nil, c.FetchError
 	}
 
-	return &readCloser{bytes.NewBuffer(c.FetchedContent)}, c.FetchError
+	return c.FetchedContent, nil
+}
+
+func (c *FakeCachedDownloader) FetchTo(w io.Writer, url *url.URL, cacheKey string) (int64, error) {
+	c.FetchedURL = url
+	c.FetchedCacheKey = cacheKey
+
+	if c.FetchError != nil {
+		return 0, c.FetchError
+	}
+
+	n, err := w.Write(c.FetchedContent)
+	return int64(n), err
+}
+
+func (c *FakeCachedDownloader) FetchVerified(url *url.URL, cacheKey string, sidecarSuffix string) (io.ReadCloser, error) {
+	c.SidecarSuffix = sidecarSuffix
+	return c.Fetch(url, cacheKey)
+}
+
+func (c *FakeCachedDownloader) FetchUncachedWithChecksum(url *url.URL, checksum string) (io.ReadCloser, error) {
+	c.FetchedChecksum = checksum
+	return c.Fetch(url, "")
+}
+
+func (c *FakeCachedDownloader) FetchToPath(url *url.URL, cacheKey string, destPath string) error {
+	c.FetchedURL = url
+	c.FetchedCacheKey = cacheKey
+
+	if c.FetchError != nil {
+		return c.FetchError
+	}
+
+	return ioutil.WriteFile(destPath, c.FetchedContent, 0644)
+}
+
+func (c *FakeCachedDownloader) FetchAndLinkAtomic(url *url.URL, cacheKey string, symlinkPath string) error {
+	c.LinkedSymlinkPath = symlinkPath
+	return c.FetchToPath(url, cacheKey, symlinkPath)
+}
+
+func (c *FakeCachedDownloader) FetchMapped(url *url.URL, cacheKey string) ([]byte, func(), error) {
+	content, err := c.FetchBytes(url, cacheKey)
+	return content, func() {}, err
+}
+
+func (c *FakeCachedDownloader) ServeFile(w http.ResponseWriter, r *http.Request, url *url.URL, cacheKey string) {
+	c.FetchedURL = url
+	c.FetchedCacheKey = cacheKey
+
+	if c.FetchError != nil {
+		http.Error(w, c.FetchError.Error(), http.StatusBadGateway)
+		return
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(c.FetchedContent))
+}
+
+func (c *FakeCachedDownloader) Put(cacheKey string, r io.Reader, info cacheddownloader.CachingInfoType) error {
+	c.PutCacheKey = cacheKey
+	c.PutCachingInfo = info
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	c.PutContent = content
+
+	return c.PutError
+}
+
+func (c *FakeCachedDownloader) PutIfAbsent(cacheKey string, r io.Reader, info cacheddownloader.CachingInfoType) (bool, error) {
+	err := c.Put(cacheKey, r, info)
+	return err == nil && !c.PutConflict, err
+}
+
+func (c *FakeCachedDownloader) PutIfMatch(cacheKey string, expectedETag string, r io.Reader, info cacheddownloader.CachingInfoType) (bool, error) {
+	c.PutExpectedETag = expectedETag
+	err := c.Put(cacheKey, r, info)
+	return err == nil && !c.PutConflict, err
+}
+
+func (c *FakeCachedDownloader) EntryInfo(cacheKey string) (cacheddownloader.CacheEntryInfo, bool) {
+	return cacheddownloader.CacheEntryInfo{}, false
+}
+
+func (c *FakeCachedDownloader) PutMetadata(cacheKey string, metadata map[string]string) {
+	c.MetadataCacheKey = cacheKey
+	c.StoredMetadata = metadata
+}
+
+func (c *FakeCachedDownloader) Migrate(newCachedPath string) error {
+	c.MigratedTo = newCachedPath
+	return c.MigrateError
+}
+
+func (c *FakeCachedDownloader) AwaitWarm(ctx context.Context, cacheKeys []string) error {
+	c.AwaitedCacheKeys = cacheKeys
+	return c.AwaitWarmError
+}
+
+func (c *FakeCachedDownloader) Warm(ctx context.Context, requests []cacheddownloader.WarmRequest, maxTotalBytes int64) ([]cacheddownloader.WarmRequest, error) {
+	c.WarmedRequests = requests
+	return c.WarmSkipped, c.WarmError
+}
+
+func (c *FakeCachedDownloader) List() []cacheddownloader.CacheEntryInfo {
+	return nil
+}
+
+func (c *FakeCachedDownloader) EvictionOrder() []cacheddownloader.CacheEntryInfo {
+	return nil
+}
+
+func (c *FakeCachedDownloader) AgeHistogram() []cacheddownloader.AgeBucket {
+	return nil
+}
+
+func (c *FakeCachedDownloader) SizeHistogram() []cacheddownloader.SizeBucket {
+	return nil
+}
+
+func (c *FakeCachedDownloader) Walk(walkFn func(entry cacheddownloader.CacheEntryInfo, open func() (io.ReadCloser, error)) error) error {
+	return nil
+}
+
+func (c *FakeCachedDownloader) LastResponseHeaders(cacheKey string) (http.Header, bool) {
+	return c.ResponseHeaders, c.ResponseHeaders != nil
+}
+
+func (c *FakeCachedDownloader) Verify(repair bool) (cacheddownloader.VerifyReport, error) {
+	return cacheddownloader.VerifyReport{}, nil
+}
+
+func (c *FakeCachedDownloader) Stats() cacheddownloader.Stats {
+	return cacheddownloader.Stats{}
+}
+
+func (c *FakeCachedDownloader) Reset() {
+	c.Resets++
+}
+
+func (c *FakeCachedDownloader) Events() <-chan cacheddownloader.CacheEvent {
+	return c.EventsChannel
+}
+
+func (c *FakeCachedDownloader) EvictToSize(targetBytes int64) (int64, error) {
+	c.EvictTarget = targetBytes
+	return c.EvictFreedBytes, c.EvictError
+}
+
+func (c *FakeCachedDownloader) InFlight(cacheKey string) bool {
+	return c.InFlightKeys[cacheKey]
+}
+
+// Namespace records name and returns the fake itself, so fetches through the
+// view are recorded alongside the others.
+func (c *FakeCachedDownloader) Namespace(name string) cacheddownloader.CachedDownloader {
+	c.Namespaces = append(c.Namespaces, name)
+	return c
+}
+
+func (c *FakeCachedDownloader) Close() error {
+	return nil
 }
 
 type readCloser struct {
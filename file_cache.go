@@ -1,89 +1,593 @@
 package cacheddownloader
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
+// errEntryEvicted is returned when an entry a fetch meant to serve was evicted
+// before it could be opened.
+var errEntryEvicted = errors.New("Cache entry was evicted")
+
 type FileCache struct {
 	cachedPath     string
 	maxSizeInBytes int64
 	lock           *sync.Mutex
+	admitted       *sync.Cond
 	entries        map[string]fileCacheEntry
 	cacheFilePaths map[string]string
+	pinnedPaths    map[string]int
+	sharedFiles    map[string]*sharedFile
+	varyHeaders    map[string][]string
 	seq            uint64
+	accessSeq      uint64
+	evictions      uint64
+	fileMode       os.FileMode
+	ttl            time.Duration
+	minFreeDisk    int64
+	freeDiskSpace  func(dir string) (int64, bool, error)
+	clock          Clock
+	maxIdleTime    time.Duration
+	rename         func(oldpath, newpath string) error
+	copyFile       func(dst io.Writer, src io.Reader) (int64, error)
+	fsync          func(path string) error
+	fsyncPolicy    FsyncPolicy
+	ageBuckets     []time.Duration
+	sizeBuckets    []int64
+
+	shareDescriptors bool
+	deduplicate      bool
+
+	// minEntrySize and maxEntrySize bound the size of admitted files, see
+	// WithCacheSizeRange. A maxEntrySize of zero is no bound.
+	minEntrySize int64
+	maxEntrySize int64
+
+	// minRevalidationInterval is the least time an entry is fresh for, see
+	// WithMinRevalidationInterval.
+	minRevalidationInterval time.Duration
+
+	// events receives admissions and evictions. It is set by New, and nil
+	// for caches created on their own.
+	events *eventStream
+
+	// overflow is the slower tier entries are demoted to when they are
+	// evicted to make room, or nil if there is none.
+	overflow *FileCache
+}
+
+// sharedFile is a descriptor for a cache file that all its readers share
+// when WithSharedDescriptors is set.
+type sharedFile struct {
+	file    *os.File
+	size    int64
+	readers int
 }
 
 type fileCacheEntry struct {
 	size        int64
 	access      time.Time
+	accessSeq   uint64
+	downloaded  time.Time
+	freshUntil  time.Time
 	cachingInfo CachingInfoType
 	filePath    string
+	// contentDigest is the SHA-256 of the file when content deduplication is
+	// enabled, and empty otherwise.
+	contentDigest string
+	metadata      map[string]string
+}
+
+// CacheEntryInfo describes an entry in the cache. CacheKey is the hashed key
+// the entry is stored under.
+type CacheEntryInfo struct {
+	CacheKey    string
+	Size        int64
+	LastAccess  time.Time
+	Downloaded  time.Time
+	CachingInfo CachingInfoType
+	// Metadata is what the caller stored with SetMetadata, if anything.
+	Metadata map[string]string
+	// SourceURL is the URL the file was downloaded from, see
+	// CachingInfoType.SourceURL. It is empty for entries stored with Put
+	// unless the caller set it.
+	SourceURL string
+}
+
+func NewCache(dir string, maxSizeInBytes int64, opts ...Option) *FileCache {
+	return newFileCache(dir, maxSizeInBytes, newOptions(opts))
 }
 
-func NewCache(dir string, maxSizeInBytes int64) *FileCache {
+func newFileCache(dir string, maxSizeInBytes int64, o options) *FileCache {
+	var overflow *FileCache
+	if o.overflowPath != "" {
+		overflowOptions := o
+		overflowOptions.overflowPath = ""
+		overflow = newFileCache(o.overflowPath, o.overflowMaxBytes, overflowOptions)
+	}
+
+	lock := &sync.Mutex{}
 	return &FileCache{
 		cachedPath:     dir,
 		maxSizeInBytes: maxSizeInBytes,
-		lock:           &sync.Mutex{},
-		entries:        map[string]fileCacheEntry{},
-		cacheFilePaths: map[string]string{},
+		lock:           lock,
+		admitted:       sync.NewCond(lock),
+		entries:        make(map[string]fileCacheEntry, o.expectedEntries),
+		cacheFilePaths: make(map[string]string, o.expectedEntries),
+		pinnedPaths:    map[string]int{},
+		sharedFiles:    map[string]*sharedFile{},
+		varyHeaders:    map[string][]string{},
 		seq:            0,
+		fileMode:       o.fileMode,
+		ttl:            o.ttl,
+		minFreeDisk:    o.minFreeDisk,
+		freeDiskSpace:  o.freeDiskSpace,
+		clock:          o.clock,
+		maxIdleTime:    o.maxIdleTime,
+		rename:         o.rename,
+		copyFile:       o.copyFile,
+		fsync:          o.fsync,
+		fsyncPolicy:    o.fsyncPolicy,
+		ageBuckets:     sortedDurations(o.ageBuckets),
+		sizeBuckets:    sortedSizes(o.sizeBuckets),
+
+		shareDescriptors: o.sharedDescriptors,
+		deduplicate:      o.contentDeduplication,
+
+		minEntrySize: o.minCachedSize,
+		maxEntrySize: o.maxCachedSize,
+
+		minRevalidationInterval: o.minRevalidationInterval,
+
+		overflow: overflow,
 	}
 }
 
 func (c *FileCache) Add(cacheKey string, sourcePath string, size int64, cachingInfo CachingInfoType) (bool, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	return c.unsafelyAdd(cacheKey, sourcePath, size, cachingInfo)
+}
+
+// addIf is Add if cond, called under the lock with the caching info of the
+// entry for cacheKey in either tier and whether there is one, returns true.
+// It reports whether cond held and whether the file was added.
+func (c *FileCache) addIf(cacheKey string, sourcePath string, size int64, cachingInfo CachingInfoType, cond func(current CachingInfoType, ok bool) bool) (bool, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	current, ok := c.entries[cacheKey]
+	if !ok && c.overflow != nil {
+		info, inOverflow := c.overflow.EntryInfo(cacheKey)
+		current, ok = fileCacheEntry{cachingInfo: info.CachingInfo}, inOverflow
+	}
+	if !cond(current.cachingInfo, ok) {
+		return false, false, nil
+	}
+
+	added, err := c.unsafelyAdd(cacheKey, sourcePath, size, cachingInfo)
+	return true, added, err
+}
+
+// addAndOpen is Add followed by Get, without letting a concurrent eviction
+// remove the entry in between.
+func (c *FileCache) addAndOpen(cacheKey string, sourcePath string, size int64, cachingInfo CachingInfoType) (io.ReadCloser, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	added, err := c.unsafelyAdd(cacheKey, sourcePath, size, cachingInfo)
+	if err != nil || !added {
+		return nil, false, err
+	}
 
+	reader, err := c.unsafelyOpen(c.entries[cacheKey].filePath)
+	if err != nil {
+		return nil, false, err
+	}
+	return reader, true, nil
+}
+
+func (c *FileCache) unsafelyAdd(cacheKey string, sourcePath string, size int64, cachingInfo CachingInfoType) (bool, error) {
+	now := c.clock.Now()
+	return c.unsafelyAdmit(cacheKey, sourcePath, true, fileCacheEntry{
+		size:        size,
+		downloaded:  now,
+		freshUntil:  c.freshUntil(now, cachingInfo.Expires),
+		cachingInfo: cachingInfo,
+	})
+}
+
+// unsafelyAdmit stores the file at sourcePath under cacheKey with the
+// metadata of entry. The file is moved into the cache if move is true and
+// copied otherwise.
+func (c *FileCache) unsafelyAdmit(cacheKey string, sourcePath string, move bool, entry fileCacheEntry) (bool, error) {
 	c.unsafelyRemoveCacheEntryFor(cacheKey)
+	c.unsafelyRemoveIdleEntries()
 
-	if size > c.maxSizeInBytes {
+	if entry.size > c.maxSizeInBytes || !c.inSizeRange(entry.size) {
 		//file does not fit in cache...
 		return false, nil
 	}
 
-	c.makeRoom(size)
+	var err error
+	if c.deduplicate && entry.contentDigest == "" {
+		entry.contentDigest, err = fileDigest(sourcePath)
+		if err != nil {
+			return false, err
+		}
+	}
 
 	c.seq++
 	uniqueName := fmt.Sprintf("%s-%d-%d", cacheKey, time.Now().UnixNano(), c.seq)
 	cachePath := filepath.Join(c.cachedPath, uniqueName)
 
-	err := os.Rename(sourcePath, cachePath)
-	if err != nil {
-		return false, err
+	if !c.unsafelyLinkDuplicate(entry.contentDigest, cachePath) {
+		c.makeRoom(entry.size)
+
+		fits, err := c.makeRoomOnDisk(entry.size)
+		if err != nil || !fits {
+			return false, err
+		}
+
+		moved := false
+		if move {
+			if c.fsyncPolicy != FsyncNever {
+				err = c.fsync(sourcePath)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			if c.fileMode != 0 {
+				// Chmod before the rename so the file never appears in the
+				// cache with the wrong mode
+				err = os.Chmod(sourcePath, c.fileMode)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			moved = c.rename(sourcePath, cachePath) == nil
+		}
+		if !moved {
+			// The source may be on another device, e.g. when the uncached
+			// path is on a different filesystem, or have to stay in place for
+			// its readers
+			err = c.copyIntoCache(sourcePath, cachePath)
+			if err != nil {
+				return false, err
+			}
+		}
 	}
 
-	c.cacheFilePaths[cachePath] = cacheKey
-	c.entries[cacheKey] = fileCacheEntry{
-		size:        size,
-		filePath:    cachePath,
-		access:      time.Now(),
-		cachingInfo: cachingInfo,
+	if c.fsyncPolicy == FsyncOnAdmissionAndDir {
+		err = c.fsync(c.cachedPath)
+		if err != nil {
+			os.RemoveAll(cachePath)
+			return false, err
+		}
 	}
 
+	c.accessSeq++
+	entry.filePath = cachePath
+	entry.access = c.clock.Now()
+	entry.accessSeq = c.accessSeq
+	c.cacheFilePaths[cachePath] = cacheKey
+	c.entries[cacheKey] = entry
+	c.admitted.Broadcast()
+	c.events.emit(CacheEvent{Type: EventAdmitted, CacheKey: cacheKey, Size: entry.size})
+
 	return true, nil
 }
 
-func (c *FileCache) Get(cacheKey string) (io.ReadCloser, error) {
+// inSizeRange reports whether a file of size may be admitted according to
+// WithCacheSizeRange.
+func (c *FileCache) inSizeRange(size int64) bool {
+	return size >= c.minEntrySize && (c.maxEntrySize == 0 || size <= c.maxEntrySize)
+}
+
+// unsafelyLinkDuplicate hardlinks cachePath to the file of an entry with the
+// same content, if there is one. Every entry keeps a path of its own, so the
+// bytes stay on disk until the last of them is removed.
+func (c *FileCache) unsafelyLinkDuplicate(contentDigest string, cachePath string) bool {
+	if contentDigest == "" {
+		return false
+	}
+
+	for _, f := range c.entries {
+		if f.contentDigest == contentDigest {
+			return os.Link(f.filePath, cachePath) == nil
+		}
+	}
+	return false
+}
+
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// adopt admits an entry that leaves another tier, keeping its metadata. A
+// file that is pinned in the other tier is copied rather than moved, so it
+// stays where its readers and Walk expect it.
+func (c *FileCache) adopt(cacheKey string, entry fileCacheEntry, pinned bool) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	path := c.entries[cacheKey].filePath
-	f, err := os.Open(path)
+	added, err := c.unsafelyAdmit(cacheKey, entry.filePath, !pinned, entry)
+	return err == nil && added
+}
+
+// take removes an entry without deleting its file, so another tier can adopt
+// it. It reports whether the file is pinned.
+func (c *FileCache) take(cacheKey string) (fileCacheEntry, bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[cacheKey]
+	if !ok {
+		return fileCacheEntry{}, false, false
+	}
+
+	delete(c.cacheFilePaths, entry.filePath)
+	delete(c.entries, cacheKey)
+	return entry, c.pinnedPaths[entry.filePath] > 0, true
+}
+
+// unsafelyPromote moves an entry that was demoted to the overflow tier back
+// into this one. If it no longer fits it goes back to the overflow tier.
+func (c *FileCache) unsafelyPromote(cacheKey string) {
+	if c.overflow == nil {
+		return
+	}
+	if _, ok := c.entries[cacheKey]; ok {
+		return
+	}
+
+	entry, pinned, ok := c.overflow.take(cacheKey)
+	if !ok {
+		return
+	}
+
+	added, err := c.unsafelyAdmit(cacheKey, entry.filePath, !pinned, entry)
+	if err != nil || !added {
+		c.overflow.adopt(cacheKey, entry, pinned)
+	}
+	c.overflow.removeFileIfUntracked(entry.filePath)
+}
+
+// copyIntoCache copies sourcePath to a partial file next to cachePath and
+// only renames it into place once it is complete and synced, so an
+// interrupted copy never leaves a truncated file under a cache name.
+func (c *FileCache) copyIntoCache(sourcePath string, cachePath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	partialPath := cachePath + ".partial"
+	partial, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if c.fileMode != 0 {
+		// Chmod so the requested mode is not restricted by the umask
+		err = partial.Chmod(c.fileMode)
+	}
+	if err == nil {
+		_, err = c.copyFile(partial, source)
+	}
+	if err == nil {
+		err = partial.Sync()
+	}
+	closeErr := partial.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partialPath, cachePath)
+	}
+
+	if err != nil {
+		os.RemoveAll(partialPath)
+		return err
+	}
+
+	return nil
+}
+
+func (c *FileCache) Get(cacheKey string) (io.ReadCloser, int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafelyPromote(cacheKey)
+
+	entry := c.entries[cacheKey]
+	readCloser, err := c.unsafelyOpen(entry.filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return readCloser, entry.size, nil
+}
+
+// GetIfFresh returns a reader for the entry if it is still within its TTL.
+func (c *FileCache) GetIfFresh(cacheKey string) (io.ReadCloser, int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafelyPromote(cacheKey)
+
+	entry, ok := c.entries[cacheKey]
+	if !ok || !c.clock.Now().Before(entry.freshUntil) {
+		return nil, 0, false
+	}
+
+	readCloser, err := c.unsafelyOpen(entry.filePath)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	return readCloser, entry.size, true
+}
+
+// unsafelyOpen opens a new descriptor for every reader, since readers need
+// independent offsets that start at 0. The file is pinned until the reader is
+// closed, so an evicted file is only deleted once nothing has it open. Going
+// by the count rather than trying to delete the file on every close matters
+// on Windows, where deleting a file that is still open fails.
+func (c *FileCache) unsafelyOpen(cacheFilePath string) (io.ReadCloser, error) {
+	if c.shareDescriptors {
+		return c.unsafelyOpenShared(cacheFilePath)
+	}
+
+	f, err := os.Open(cacheFilePath)
 	if err != nil {
 		return nil, err
 	}
 
-	readCloser := NewFileCloser(f, func(filePath string) {
-		c.removeFileIfUntracked(filePath)
-	})
+	c.pinnedPaths[cacheFilePath]++
+	return NewFileCloser(f, c.unpin), nil
+}
+
+// unsafelyOpenShared returns a reader with an offset of its own over the
+// descriptor all readers of the file share, opening it for the first one.
+func (c *FileCache) unsafelyOpenShared(cacheFilePath string) (io.ReadCloser, error) {
+	shared, ok := c.sharedFiles[cacheFilePath]
+	if !ok {
+		f, err := os.Open(cacheFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
 
-	return readCloser, nil
+		shared = &sharedFile{file: f, size: info.Size()}
+		c.sharedFiles[cacheFilePath] = shared
+	}
+
+	shared.readers++
+	c.pinnedPaths[cacheFilePath]++
+	return newSharedFileCloser(shared.file, shared.size, c.releaseShared), nil
+}
+
+// releaseShared closes the shared descriptor once its last reader is closed,
+// before the file may be deleted.
+func (c *FileCache) releaseShared(cacheFilePath string) {
+	c.lock.Lock()
+	shared := c.sharedFiles[cacheFilePath]
+	shared.readers--
+	if shared.readers == 0 {
+		delete(c.sharedFiles, cacheFilePath)
+		shared.file.Close()
+	}
+	c.lock.Unlock()
+
+	c.unpin(cacheFilePath)
+}
+
+// Revalidated restarts the freshness of an entry the server confirmed is
+// unchanged. The validators of the confirmation replace the stored ones when
+// it has them, and its Expires time always does.
+func (c *FileCache) Revalidated(cacheKey string, cachingInfo CachingInfoType) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafelyRevalidated(cacheKey, cachingInfo)
+}
+
+// revalidatedAndOpen is Revalidated followed by open, without letting a
+// concurrent eviction remove the entry in between.
+func (c *FileCache) revalidatedAndOpen(cacheKey string, cachingInfo CachingInfoType) (io.ReadCloser, int64, CachingInfoType, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.unsafelyRevalidated(cacheKey, cachingInfo)
+	return c.unsafelyOpenEntry(cacheKey)
+}
+
+// open returns a reader for the entry together with its size and caching
+// info, all taken at the same time.
+func (c *FileCache) open(cacheKey string) (io.ReadCloser, int64, CachingInfoType, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.unsafelyOpenEntry(cacheKey)
+}
+
+func (c *FileCache) unsafelyOpenEntry(cacheKey string) (io.ReadCloser, int64, CachingInfoType, error) {
+	entry, ok := c.entries[cacheKey]
+	if !ok {
+		return nil, 0, CachingInfoType{}, errEntryEvicted
+	}
+
+	reader, err := c.unsafelyOpen(entry.filePath)
+	if err != nil {
+		return nil, 0, CachingInfoType{}, err
+	}
+	return reader, entry.size, entry.cachingInfo, nil
+}
+
+func (c *FileCache) unsafelyRevalidated(cacheKey string, cachingInfo CachingInfoType) {
+	f, ok := c.entries[cacheKey]
+	if !ok {
+		return
+	}
+	if cachingInfo.ETag != "" {
+		f.cachingInfo.ETag = cachingInfo.ETag
+	}
+	if cachingInfo.LastModified != "" {
+		f.cachingInfo.LastModified = cachingInfo.LastModified
+	}
+	if cachingInfo.Digest != "" {
+		f.cachingInfo.Digest = cachingInfo.Digest
+	}
+	if cachingInfo.ContentType != "" {
+		f.cachingInfo.ContentType = cachingInfo.ContentType
+	}
+	f.cachingInfo.Expires = cachingInfo.Expires
+	f.freshUntil = c.freshUntil(c.clock.Now(), cachingInfo.Expires)
+	c.entries[cacheKey] = f
+}
+
+// freshUntil prefers the Expires time the server sent over the configured
+// TTL, but never ends before the minimum revalidation interval.
+func (c *FileCache) freshUntil(now time.Time, expires time.Time) time.Time {
+	freshUntil := now.Add(c.ttl)
+	if !expires.IsZero() {
+		freshUntil = expires
+	}
+
+	if min := now.Add(c.minRevalidationInterval); freshUntil.Before(min) {
+		return min
+	}
+	return freshUntil
 }
 
 func (c *FileCache) RemoveEntry(cacheKey string) {
@@ -92,59 +596,531 @@ func (c *FileCache) RemoveEntry(cacheKey string) {
 	c.unsafelyRemoveCacheEntryFor(cacheKey)
 }
 
+// Reset removes every entry, including those of the overflow tier, and
+// zeroes the eviction count. Files that are still open are removed once they
+// have been closed.
+func (c *FileCache) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for cacheKey := range c.entries {
+		c.unsafelyRemoveCacheEntryFor(cacheKey)
+	}
+	c.varyHeaders = map[string][]string{}
+	c.evictions = 0
+
+	if c.overflow != nil {
+		c.overflow.Reset()
+	}
+}
+
 func (c *FileCache) RecordAccess(cacheKey string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	f := c.entries[cacheKey]
-	f.access = time.Now()
+	c.unsafelyRemoveIdleEntries()
+	c.unsafelyPromote(cacheKey)
+	f, ok := c.entries[cacheKey]
+	if !ok {
+		return
+	}
+	c.accessSeq++
+	f.access = c.clock.Now()
+	f.accessSeq = c.accessSeq
 	c.entries[cacheKey] = f
 }
 
+func (c *FileCache) EntryInfo(cacheKey string) (CacheEntryInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	f, ok := c.entries[cacheKey]
+	if !ok {
+		return CacheEntryInfo{}, false
+	}
+	return f.info(cacheKey), true
+}
+
+// AwaitEntries blocks until there is an entry for every one of cacheKeys, in
+// either tier, or ctx is done.
+func (c *FileCache) AwaitEntries(ctx context.Context, cacheKeys []string) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Wake the waiter below so it notices
+			c.lock.Lock()
+			c.admitted.Broadcast()
+			c.lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for !c.unsafelyHasEntries(cacheKeys) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c.admitted.Wait()
+	}
+	return nil
+}
+
+func (c *FileCache) unsafelyHasEntries(cacheKeys []string) bool {
+	for _, cacheKey := range cacheKeys {
+		if _, ok := c.entries[cacheKey]; ok {
+			continue
+		}
+		if c.overflow != nil {
+			if _, ok := c.overflow.EntryInfo(cacheKey); ok {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (c *FileCache) Entries() []CacheEntryInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	infos := make([]CacheEntryInfo, 0, len(c.entries))
+	for cacheKey, f := range c.entries {
+		infos = append(infos, f.info(cacheKey))
+	}
+	return infos
+}
+
+// EvictionOrder describes every entry in the order the cache would evict them
+// to make room, least recently accessed first.
+func (c *FileCache) EvictionOrder() []CacheEntryInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cacheKeys := make([]string, 0, len(c.entries))
+	for cacheKey := range c.entries {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Slice(cacheKeys, func(i, j int) bool {
+		return c.entries[cacheKeys[i]].accessSeq < c.entries[cacheKeys[j]].accessSeq
+	})
+
+	infos := make([]CacheEntryInfo, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		infos[i] = c.entries[cacheKey].info(cacheKey)
+	}
+	return infos
+}
+
 func (c *FileCache) removeFileIfUntracked(cacheFilePath string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	_, isTracked := c.cacheFilePaths[cacheFilePath]
-	if !isTracked {
+	if !isTracked && c.pinnedPaths[cacheFilePath] == 0 {
 		os.RemoveAll(cacheFilePath)
 	}
 }
 
+// Walk calls walkFn for a snapshot of the entries in the cache, sorted by
+// cache key. open returns a reader for the entry's file. The files of the
+// snapshot are kept on disk until walkFn has returned for them, even if their
+// entries are evicted in the meantime. Walk stops at, and returns, the first
+// error walkFn returns.
+func (c *FileCache) Walk(walkFn func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error) error {
+	c.lock.Lock()
+	cacheKeys := make([]string, 0, len(c.entries))
+	for cacheKey := range c.entries {
+		cacheKeys = append(cacheKeys, cacheKey)
+	}
+	sort.Strings(cacheKeys)
+
+	infos := make([]CacheEntryInfo, len(cacheKeys))
+	paths := make([]string, len(cacheKeys))
+	for i, cacheKey := range cacheKeys {
+		f := c.entries[cacheKey]
+		infos[i] = f.info(cacheKey)
+		paths[i] = f.filePath
+		c.pinnedPaths[f.filePath]++
+	}
+	c.lock.Unlock()
+
+	unpinned := 0
+	defer func() {
+		for _, path := range paths[unpinned:] {
+			c.unpin(path)
+		}
+	}()
+
+	for i, info := range infos {
+		path := paths[i]
+		err := walkFn(info, func() (io.ReadCloser, error) {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+			return c.unsafelyOpen(path)
+		})
+
+		c.unpin(path)
+		unpinned++
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *FileCache) unpin(cacheFilePath string) {
+	c.lock.Lock()
+	c.pinnedPaths[cacheFilePath]--
+	if c.pinnedPaths[cacheFilePath] > 0 {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.pinnedPaths, cacheFilePath)
+	c.lock.Unlock()
+
+	c.removeFileIfUntracked(cacheFilePath)
+}
+
 func (c *FileCache) Info(cacheKey string) CachingInfoType {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	return c.entries[cacheKey].cachingInfo
 }
 
+func (f fileCacheEntry) info(cacheKey string) CacheEntryInfo {
+	return CacheEntryInfo{
+		CacheKey:    cacheKey,
+		Size:        f.size,
+		LastAccess:  f.access,
+		Downloaded:  f.downloaded,
+		CachingInfo: f.cachingInfo,
+		Metadata:    copyMetadata(f.metadata),
+		SourceURL:   f.cachingInfo.SourceURL,
+	}
+}
+
+// SetMetadata stores metadata with the entry for the caller's own
+// bookkeeping, replacing what was stored before. It has no effect on eviction
+// or revalidation, and is dropped when the entry is replaced by a new
+// download. Nothing is stored if there is no entry for cacheKey.
+func (c *FileCache) SetMetadata(cacheKey string, metadata map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, ok := c.entries[cacheKey]
+	if !ok {
+		return
+	}
+	f.metadata = copyMetadata(metadata)
+	c.entries[cacheKey] = f
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	return copied
+}
+
+// VerifyReport lists the inconsistencies Verify found between the entries of
+// the cache and the files in its directory.
+type VerifyReport struct {
+	// DanglingEntries are the cache keys of entries whose file is missing.
+	DanglingEntries []string
+	// OrphanedFiles are the paths of files no entry refers to.
+	OrphanedFiles []string
+}
+
+// Verify cross-checks the entries of the cache against the files in its
+// directory. If repair is true, it drops the dangling entries and deletes the
+// orphaned files. Files kept on disk for open readers or a Walk in progress
+// are not orphans.
+func (c *FileCache) Verify(repair bool) (VerifyReport, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	files, err := ioutil.ReadDir(c.cachedPath)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{}
+	for _, file := range files {
+		cacheFilePath := filepath.Join(c.cachedPath, file.Name())
+		_, isTracked := c.cacheFilePaths[cacheFilePath]
+		if isTracked || c.pinnedPaths[cacheFilePath] > 0 {
+			continue
+		}
+
+		report.OrphanedFiles = append(report.OrphanedFiles, cacheFilePath)
+		if repair {
+			os.RemoveAll(cacheFilePath)
+		}
+	}
+
+	for cacheKey, entry := range c.entries {
+		_, err := os.Stat(entry.filePath)
+		if !os.IsNotExist(err) {
+			continue
+		}
+
+		report.DanglingEntries = append(report.DanglingEntries, cacheKey)
+		if repair {
+			delete(c.cacheFilePaths, entry.filePath)
+			delete(c.entries, cacheKey)
+		}
+	}
+	sort.Strings(report.DanglingEntries)
+
+	return report, nil
+}
+
+// MigrateError lists the entries Migrate could not move, by cache key.
+// CachedDownloader.Migrate removes them before unlocking the old directory,
+// so they are downloaded again on their next fetch. FileCache.Migrate on its
+// own leaves them where they were.
+type MigrateError struct {
+	Failures map[string]error
+}
+
+func (e *MigrateError) Error() string {
+	return fmt.Sprintf("Failed to migrate %d cache entries", len(e.Failures))
+}
+
+// Migrate moves the cached files to dir, copying them if it is on another
+// device, and admits new entries into dir from then on. Fetches wait until
+// every file has moved. Files that are open are copied rather than moved and
+// deleted from the old directory once they are closed. Entries in the
+// overflow tier stay where they are.
+func (c *FileCache) Migrate(dir string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	failures := map[string]error{}
+	for cacheKey, entry := range c.entries {
+		oldPath := entry.filePath
+		newPath := filepath.Join(dir, filepath.Base(oldPath))
+
+		var err error
+		if c.pinnedPaths[oldPath] > 0 || c.rename(oldPath, newPath) != nil {
+			err = c.copyIntoCache(oldPath, newPath)
+		}
+		if err != nil {
+			failures[cacheKey] = err
+			continue
+		}
+
+		delete(c.cacheFilePaths, oldPath)
+		c.cacheFilePaths[newPath] = cacheKey
+		entry.filePath = newPath
+		c.entries[cacheKey] = entry
+
+		if c.pinnedPaths[oldPath] == 0 {
+			os.RemoveAll(oldPath)
+		}
+	}
+	c.cachedPath = dir
+
+	if len(failures) > 0 {
+		return &MigrateError{Failures: failures}
+	}
+	return nil
+}
+
+// Usage returns the number of entries, the bytes they use and how many
+// entries have been evicted to make room so far.
+func (c *FileCache) Usage() (entries int, bytes int64, evictions uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries), c.usedSpace(), c.evictions
+}
+
+// VaryHeaders returns the request headers the last response for the resource
+// said it varies on.
+func (c *FileCache) VaryHeaders(resourceKey string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.varyHeaders[resourceKey]
+}
+
+func (c *FileCache) SetVaryHeaders(resourceKey string, names []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(names) == 0 {
+		delete(c.varyHeaders, resourceKey)
+		return
+	}
+	c.varyHeaders[resourceKey] = names
+}
+
 func (c *FileCache) makeRoom(size int64) {
 	usedSpace := c.usedSpace()
 	for c.maxSizeInBytes < usedSpace+size {
-		oldestAccessTime, oldestCacheKey := time.Now(), ""
-		for ck, f := range c.entries {
-			if f.access.Before(oldestAccessTime) {
-				oldestCacheKey = ck
-				oldestAccessTime = f.access
-			}
+		oldestCacheKey := c.unsafelyOldestCacheKey()
+
+		usedSpace -= c.unsafelyFreedBy(oldestCacheKey)
+		c.unsafelyEvict(oldestCacheKey)
+	}
+}
+
+// EvictToSize evicts the least recently accessed entries until the cache
+// uses at most targetBytes, e.g. to relieve disk pressure, and returns how many
+// bytes that freed. Unlike lowering maxSizeInBytes it leaves the limit for
+// later admissions as it is. The file of an entry that is still being read
+// stays on disk until its readers are done.
+func (c *FileCache) EvictToSize(targetBytes int64) (int64, error) {
+	if targetBytes < 0 {
+		return 0, fmt.Errorf("Cannot evict to a negative size: %d", targetBytes)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	usedSpace := c.usedSpace()
+	freed := int64(0)
+	for usedSpace > targetBytes && len(c.entries) > 0 {
+		oldestCacheKey := c.unsafelyOldestCacheKey()
+
+		bytes := c.unsafelyFreedBy(oldestCacheKey)
+		usedSpace -= bytes
+		freed += bytes
+		c.unsafelyEvict(oldestCacheKey)
+	}
+
+	return freed, nil
+}
+
+// makeRoomOnDisk evicts the least recently accessed entries until admitting
+// size bytes leaves minFreeDisk free on the cache filesystem. It reports false
+// if that cannot be achieved even with an empty cache.
+func (c *FileCache) makeRoomOnDisk(size int64) (bool, error) {
+	if c.minFreeDisk <= 0 {
+		return true, nil
+	}
+
+	free, ok, err := c.freeDiskSpace(c.cachedPath)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, nil
+	}
+
+	for free-size < c.minFreeDisk {
+		if len(c.entries) == 0 {
+			return false, nil
 		}
 
-		usedSpace -= c.entries[oldestCacheKey].size
-		c.unsafelyRemoveCacheEntryFor(oldestCacheKey)
+		oldestCacheKey := c.unsafelyOldestCacheKey()
+
+		free += c.unsafelyFreedBy(oldestCacheKey)
+		c.unsafelyEvict(oldestCacheKey)
 	}
+
+	return true, nil
 }
 
+func (c *FileCache) unsafelyRemoveIdleEntries() {
+	if c.maxIdleTime <= 0 {
+		return
+	}
+
+	idleSince := c.clock.Now().Add(-c.maxIdleTime)
+	for ck, f := range c.entries {
+		if f.access.Before(idleSince) {
+			c.unsafelyRemoveCacheEntryFor(ck)
+			c.evictions++
+			c.events.emit(CacheEvent{Type: EventEvicted, CacheKey: ck, Size: f.size})
+		}
+	}
+}
+
+// unsafelyOldestCacheKey returns the least recently accessed entry. Accesses
+// are ordered by a counter rather than by access time, so a wall clock that
+// steps backwards cannot make a recently used entry look old.
+func (c *FileCache) unsafelyOldestCacheKey() string {
+	oldestAccessSeq, oldestCacheKey := uint64(0), ""
+	for ck, f := range c.entries {
+		if oldestCacheKey == "" || f.accessSeq < oldestAccessSeq {
+			oldestCacheKey = ck
+			oldestAccessSeq = f.accessSeq
+		}
+	}
+	return oldestCacheKey
+}
+
+// unsafelyEvict removes an entry to make room, demoting it to the overflow
+// tier if there is one.
+func (c *FileCache) unsafelyEvict(cacheKey string) {
+	c.evictions++
+
+	entry := c.entries[cacheKey]
+	c.events.emit(CacheEvent{Type: EventEvicted, CacheKey: cacheKey, Size: entry.size})
+	if c.overflow == nil || entry.filePath == "" {
+		c.unsafelyRemoveCacheEntryFor(cacheKey)
+		return
+	}
+
+	delete(c.cacheFilePaths, entry.filePath)
+	delete(c.entries, cacheKey)
+
+	pinned := c.pinnedPaths[entry.filePath] > 0
+	c.overflow.adopt(cacheKey, entry, pinned)
+	if !pinned {
+		os.RemoveAll(entry.filePath)
+	}
+}
+
+// unsafelyRemoveCacheEntryFor removes the entry from every tier.
 func (c *FileCache) unsafelyRemoveCacheEntryFor(cacheKey string) {
 	fp := c.entries[cacheKey].filePath
 
 	if fp != "" {
 		delete(c.cacheFilePaths, fp)
-		os.RemoveAll(fp)
+		if c.pinnedPaths[fp] == 0 {
+			os.RemoveAll(fp)
+		}
 	}
 	delete(c.entries, cacheKey)
+
+	if c.overflow != nil {
+		c.overflow.RemoveEntry(cacheKey)
+	}
 }
 
+// unsafelyFreedBy returns how many bytes removing the entry frees, which is
+// nothing if another entry is linked to the same content.
+func (c *FileCache) unsafelyFreedBy(cacheKey string) int64 {
+	entry := c.entries[cacheKey]
+	if entry.contentDigest != "" {
+		for ck, f := range c.entries {
+			if ck != cacheKey && f.contentDigest == entry.contentDigest {
+				return 0
+			}
+		}
+	}
+	return entry.size
+}
+
+// usedSpace counts the bytes of entries linked to the same content once.
 func (c *FileCache) usedSpace() int64 {
 	space := int64(0)
+	counted := map[string]bool{}
 	for _, f := range c.entries {
+		if f.contentDigest != "" {
+			if counted[f.contentDigest] {
+				continue
+			}
+			counted[f.contentDigest] = true
+		}
 		space += f.size
 	}
 	return space
@@ -1,10 +1,17 @@
 package cacheddownloader_test
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	. "github.com/pivotal-golang/cacheddownloader"
 
@@ -42,7 +49,7 @@ var _ = Describe("FileCache", func() {
 			Ω(err).ShouldNot(HaveOccurred())
 			Ω(added).Should(BeTrue())
 
-			cacheReader, err = cache.Get("the-cache-key")
+			cacheReader, _, err = cache.Get("the-cache-key")
 			Ω(err).ShouldNot(HaveOccurred())
 		})
 
@@ -85,7 +92,7 @@ var _ = Describe("FileCache", func() {
 				_, err := cache.Add("the-cache-key", newSourceFile.Name(), 100, CachingInfoType{})
 				Ω(err).ShouldNot(HaveOccurred())
 
-				newCacheReader, err := cache.Get("the-cache-key")
+				newCacheReader, _, err := cache.Get("the-cache-key")
 				Ω(err).ShouldNot(HaveOccurred())
 
 				content, err := ioutil.ReadAll(newCacheReader)
@@ -106,16 +113,10 @@ var _ = Describe("FileCache", func() {
 				_, err := cache.Add("the-cache-key", newSourceFile.Name(), 100, CachingInfoType{})
 				Ω(err).ShouldNot(HaveOccurred())
 
-				newCacheReader, err := cache.Get("the-cache-key")
+				newCacheReader, _, err := cache.Get("the-cache-key")
 				Ω(err).ShouldNot(HaveOccurred())
 
-				if runtime.GOOS == "windows" {
-					// the file cannot be deleted while its reader is open
-					Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
-
-				} else {
-					Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
-				}
+				Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
 
 				cacheReader.Close()
 				Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
@@ -123,6 +124,1022 @@ var _ = Describe("FileCache", func() {
 				newCacheReader.Close()
 				Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
 			})
+
+			It("keeps the old file until the last of its readers is closed", func() {
+				otherCacheReader, _, err := cache.Get("the-cache-key")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, err = cache.Add("the-cache-key", newSourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				cacheReader.Close()
+				Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
+
+				content, err := ioutil.ReadAll(otherCacheReader)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(content)).Should(Equal("the-file-content"))
+
+				otherCacheReader.Close()
+				Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+
+				newCacheReader, _, err := cache.Get("the-cache-key")
+				Ω(err).ShouldNot(HaveOccurred())
+				defer newCacheReader.Close()
+				content, err = ioutil.ReadAll(newCacheReader)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(content)).Should(Equal("new-file-content"))
+			})
+		})
+	})
+
+	Describe("when a file mode is configured", func() {
+		var sourceFile *os.File
+
+		BeforeEach(func() {
+			sourceFile = nil
+			if runtime.GOOS == "windows" {
+				Skip("file modes are not supported on windows")
+			}
+
+			cache = NewCache(cacheDir, 123424, WithFileMode(0644))
+
+			sourceFile, err = ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+
+			_, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			if sourceFile != nil {
+				os.RemoveAll(sourceFile.Name())
+			}
+		})
+
+		It("applies the mode to the cached file", func() {
+			entries, err := ioutil.ReadDir(cacheDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Mode().Perm()).Should(Equal(os.FileMode(0644)))
+		})
+	})
+
+	Describe("when a minimum free disk space is configured", func() {
+		var free int64
+		var known bool
+
+		addFile := func(cacheKey string, size int64) bool {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), size, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			return added
+		}
+
+		BeforeEach(func() {
+			free = 1000
+			known = true
+			cache = NewCache(cacheDir, 123424, WithMinFreeDisk(800), WithFreeDiskSpace(func(dir string) (int64, bool, error) {
+				Ω(dir).Should(Equal(cacheDir))
+				return free, known, nil
+			}))
+		})
+
+		It("admits files that leave enough space free", func() {
+			Ω(addFile("the-cache-key", 200)).Should(BeTrue())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+		})
+
+		It("evicts the least recently accessed entries to keep space free", func() {
+			Ω(addFile("first", 100)).Should(BeTrue())
+			Ω(addFile("second", 100)).Should(BeTrue())
+			cache.RecordAccess("first")
+
+			free = 850
+			Ω(addFile("third", 100)).Should(BeTrue())
+
+			_, ok := cache.EntryInfo("second")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo("first")
+			Ω(ok).Should(BeTrue())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
+
+			_, _, evictions := cache.Usage()
+			Ω(evictions).Should(Equal(uint64(1)))
+		})
+
+		It("refuses files that would leave too little space free", func() {
+			Ω(addFile("first", 100)).Should(BeTrue())
+
+			Ω(addFile("second", 400)).Should(BeFalse())
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+
+		It("admits files when free space cannot be determined", func() {
+			known = false
+			Ω(addFile("the-cache-key", 400)).Should(BeTrue())
+		})
+
+		It("reads the free space of the cache filesystem", func() {
+			cache = NewCache(cacheDir, 123424, WithMinFreeDisk(1))
+			Ω(addFile("the-cache-key", 100)).Should(BeTrue())
+		})
+	})
+
+	Describe("when the clock steps backwards", func() {
+		var clock *fakeClock
+
+		addFile := func(cacheKey string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), 50000, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			cache = NewCache(cacheDir, 123424, WithClock(clock))
+		})
+
+		It("still evicts the least recently accessed entry", func() {
+			addFile("first")
+			clock.Step(time.Minute)
+			addFile("second")
+
+			clock.Step(-time.Hour)
+			cache.RecordAccess("first")
+
+			addFile("third")
+
+			_, ok := cache.EntryInfo("second")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo("first")
+			Ω(ok).Should(BeTrue())
+		})
+
+		It("reports the access time from the clock", func() {
+			addFile("first")
+			clock.Step(-time.Hour)
+			cache.RecordAccess("first")
+
+			info, ok := cache.EntryInfo("first")
+			Ω(ok).Should(BeTrue())
+			Ω(info.LastAccess).Should(Equal(time.Date(2016, 1, 1, 11, 0, 0, 0, time.UTC)))
+		})
+	})
+
+	Describe("with an fsync policy", func() {
+		var sourceFile *os.File
+		var synced []string
+		var syncErr error
+
+		BeforeEach(func() {
+			synced = nil
+			syncErr = nil
+
+			sourceFile, err = ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(sourceFile.Name())
+		})
+
+		newCache := func(policy FsyncPolicy) {
+			cache = NewCache(cacheDir, 123424, WithFsyncPolicy(policy), WithFsync(func(path string) error {
+				synced = append(synced, path)
+				return syncErr
+			}))
+		}
+
+		It("syncs nothing by default", func() {
+			newCache(FsyncNever)
+			_, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(synced).Should(BeEmpty())
+		})
+
+		It("syncs the file before renaming it into the cache", func() {
+			newCache(FsyncOnAdmission)
+			_, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(synced).Should(Equal([]string{sourceFile.Name()}))
+		})
+
+		It("also syncs the cache directory when asked to", func() {
+			newCache(FsyncOnAdmissionAndDir)
+			_, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(synced).Should(Equal([]string{sourceFile.Name(), cacheDir}))
+		})
+
+		It("does not admit the file when the directory cannot be synced", func() {
+			newCache(FsyncOnAdmissionAndDir)
+			syncErr = errors.New("disk unplugged")
+
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).Should(Equal(syncErr))
+			Ω(added).Should(BeFalse())
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+
+		It("syncs files for real", func() {
+			cache = NewCache(cacheDir, 123424, WithFsyncPolicy(FsyncOnAdmissionAndDir))
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		})
+	})
+
+	Describe("when the file cannot be renamed into the cache", func() {
+		var sourceFile *os.File
+		var copyFile func(dst io.Writer, src io.Reader) (int64, error)
+
+		BeforeEach(func() {
+			copyFile = io.Copy
+
+			sourceFile, err = ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+		})
+
+		JustBeforeEach(func() {
+			crossDevice := func(oldpath, newpath string) error {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+			}
+			cache = NewCache(cacheDir, 123424, WithFileOps(crossDevice, func(dst io.Writer, src io.Reader) (int64, error) {
+				return copyFile(dst, src)
+			}))
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(sourceFile.Name())
+		})
+
+		It("copies the file into the cache", func() {
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+
+			reader, _, err := cache.Get("the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer reader.Close()
+			Ω(ioutil.ReadAll(reader)).Should(Equal([]byte("the-file-content")))
+		})
+
+		It("leaves neither a partial file nor an entry when the copy is interrupted", func() {
+			copyErr := errors.New("disk unplugged")
+			copyFile = func(dst io.Writer, src io.Reader) (int64, error) {
+				n, _ := io.CopyN(dst, src, 4)
+				return n, copyErr
+			}
+
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).Should(Equal(copyErr))
+			Ω(added).Should(BeFalse())
+
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+			_, ok := cache.EntryInfo("the-cache-key")
+			Ω(ok).Should(BeFalse())
+			entries, bytes, _ := cache.Usage()
+			Ω(entries).Should(BeZero())
+			Ω(bytes).Should(BeZero())
+		})
+	})
+
+	Describe("Walk", func() {
+		addFile := func(cacheKey string, content string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString(content)
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), 50000, CachingInfoType{ETag: content})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		BeforeEach(func() {
+			addFile("b", "b-content")
+			addFile("a", "a-content")
+		})
+
+		It("visits every entry in order and opens its file", func() {
+			contents := map[string]string{}
+			keys := []string{}
+			err := cache.Walk(func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error {
+				keys = append(keys, entry.CacheKey)
+
+				reader, err := open()
+				Ω(err).ShouldNot(HaveOccurred())
+				defer reader.Close()
+
+				content, err := ioutil.ReadAll(reader)
+				Ω(err).ShouldNot(HaveOccurred())
+				contents[entry.CacheKey] = string(content)
+				return nil
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(keys).Should(Equal([]string{"a", "b"}))
+			Ω(contents).Should(Equal(map[string]string{"a": "a-content", "b": "b-content"}))
+		})
+
+		It("keeps the files of entries evicted during the walk until they are visited", func() {
+			err := cache.Walk(func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error {
+				if entry.CacheKey == "a" {
+					cache.RecordAccess("a")
+					addFile("c", "c-content")
+					_, ok := cache.EntryInfo("b")
+					Ω(ok).Should(BeFalse())
+					return nil
+				}
+
+				reader, err := open()
+				Ω(err).ShouldNot(HaveOccurred())
+				defer reader.Close()
+				Ω(ioutil.ReadAll(reader)).Should(Equal([]byte("b-content")))
+				return nil
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
+		})
+
+		It("stops at the first error", func() {
+			walkErr := errors.New("boom")
+			visited := 0
+			err := cache.Walk(func(entry CacheEntryInfo, open func() (io.ReadCloser, error)) error {
+				visited++
+				return walkErr
+			})
+			Ω(err).Should(Equal(walkErr))
+			Ω(visited).Should(Equal(1))
+		})
+	})
+
+	Describe("when entries are accessed at the same time", func() {
+		var clock *fakeClock
+
+		addFile := func(cacheKey string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), 50000, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+		})
+
+		It("evicts them in the order they were accessed", func() {
+			for i := 0; i < 10; i++ {
+				cache = NewCache(cacheDir, 123424, WithClock(clock))
+				addFile("first")
+				addFile("second")
+				cache.RecordAccess("first")
+
+				addFile("third")
+
+				_, ok := cache.EntryInfo("second")
+				Ω(ok).Should(BeFalse())
+				_, ok = cache.EntryInfo("first")
+				Ω(ok).Should(BeTrue())
+
+				for _, name := range filenamesInDir(cacheDir) {
+					os.RemoveAll(filepath.Join(cacheDir, name))
+				}
+			}
+		})
+	})
+
+	Describe("when a maximum idle time is configured", func() {
+		var clock *fakeClock
+
+		addFile := func(cacheKey string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			cache = NewCache(cacheDir, 123424, WithClock(clock), WithMaxIdleTime(time.Hour))
+
+			addFile("first")
+			clock.Step(30 * time.Minute)
+			addFile("second")
+			clock.Step(45 * time.Minute)
+		})
+
+		It("removes idle entries on the next access", func() {
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
+
+			cache.RecordAccess("second")
+
+			_, ok := cache.EntryInfo("first")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo("second")
+			Ω(ok).Should(BeTrue())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+
+			_, _, evictions := cache.Usage()
+			Ω(evictions).Should(Equal(uint64(1)))
+		})
+
+		It("removes idle entries when a file is added", func() {
+			addFile("third")
+
+			_, ok := cache.EntryInfo("first")
+			Ω(ok).Should(BeFalse())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(2))
+		})
+
+		It("keeps entries that are accessed within the idle time", func() {
+			cache.RecordAccess("second")
+			clock.Step(45 * time.Minute)
+			cache.RecordAccess("second")
+
+			_, ok := cache.EntryInfo("second")
+			Ω(ok).Should(BeTrue())
+		})
+
+		It("removes an idle entry even when it is the one being accessed", func() {
+			cache.RecordAccess("first")
+
+			_, ok := cache.EntryInfo("first")
+			Ω(ok).Should(BeFalse())
+		})
+	})
+
+	Describe("when the number of entries is known up front", func() {
+		It("holds as many entries as expected", func() {
+			cache = NewCache(cacheDir, 123424, WithExpectedEntries(100))
+
+			for i := 0; i < 100; i++ {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.Close()
+
+				added, err := cache.Add(fmt.Sprintf("key-%d", i), sourceFile.Name(), 1, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(added).Should(BeTrue())
+			}
+
+			Ω(cache.Entries()).Should(HaveLen(100))
+		})
+	})
+
+	Describe("when descriptors are shared", func() {
+		BeforeEach(func() {
+			cache = NewCache(cacheDir, 123424, WithSharedDescriptors())
+
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString("the-file-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		})
+
+		It("reads the file with independent offsets through one descriptor", func() {
+			first, _, err := cache.Get("the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+			second, _, err := cache.Get("the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(SharedDescriptors(cache)).Should(Equal(1))
+
+			buffer := make([]byte, 4)
+			_, err = io.ReadFull(first, buffer)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(buffer)).Should(Equal("the-"))
+
+			Ω(ioutil.ReadAll(second)).Should(Equal([]byte("the-file-content")))
+			Ω(ioutil.ReadAll(first)).Should(Equal([]byte("file-content")))
+
+			first.Close()
+			Ω(SharedDescriptors(cache)).Should(Equal(1))
+			second.Close()
+			Ω(SharedDescriptors(cache)).Should(Equal(0))
+		})
+
+		It("deletes a replaced file once its last reader is closed", func() {
+			first, _, err := cache.Get("the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+			second, _, err := cache.Get("the-cache-key")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			cache.RemoveEntry("the-cache-key")
+			first.Close()
+			Ω(first.Close()).ShouldNot(Succeed())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+
+			second.Close()
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+	})
+
+	Describe("removing an entry whose file is already gone", func() {
+		BeforeEach(func() {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add("the-cache-key", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+
+			paths, err := filepath.Glob(filepath.Join(cacheDir, "the-cache-key-*"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(paths).Should(HaveLen(1))
+			Ω(os.RemoveAll(paths[0])).Should(Succeed())
+		})
+
+		It("leaves the empty cache directory in place", func() {
+			// On Windows os.Remove of a missing file removes its directory
+			// instead if that is empty
+			cache.RemoveEntry("the-cache-key")
+			Ω(cacheDir).Should(BeADirectory())
+		})
+	})
+
+	Describe("when there is an overflow tier", func() {
+		var overflowDir string
+
+		add := func(cacheKey string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString(cacheKey + "-content")
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), 60, CachingInfoType{ETag: cacheKey + "-etag"})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		read := func(cacheKey string) string {
+			reader, _, err := cache.Get(cacheKey)
+			Ω(err).ShouldNot(HaveOccurred())
+			defer reader.Close()
+			content, err := ioutil.ReadAll(reader)
+			Ω(err).ShouldNot(HaveOccurred())
+			return string(content)
+		}
+
+		BeforeEach(func() {
+			overflowDir, err = ioutil.TempDir("", "overflow-test")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			cache = NewCache(cacheDir, 100, WithOverflowTier(overflowDir, 1000))
+			add("a")
+			add("b")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(overflowDir)
+		})
+
+		It("demotes evicted entries instead of deleting them", func() {
+			Ω(cache.Entries()).Should(HaveLen(1))
+			Ω(cache.Entries()[0].CacheKey).Should(Equal("b"))
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+			Ω(filenamesInDir(overflowDir)).Should(HaveLen(1))
+		})
+
+		It("promotes demoted entries back when they are accessed", func() {
+			Ω(read("a")).Should(Equal("a-content"))
+			Ω(cache.Info("a").ETag).Should(Equal("a-etag"))
+
+			By("demoting the entry that made room for them")
+			Ω(cache.Entries()).Should(HaveLen(1))
+			Ω(cache.Entries()[0].CacheKey).Should(Equal("a"))
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+			Ω(filenamesInDir(overflowDir)).Should(HaveLen(1))
+			Ω(read("b")).Should(Equal("b-content"))
+		})
+
+		It("keeps demoted files readable for readers that have them open", func() {
+			reader, _, err := cache.Get("b")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer reader.Close()
+
+			Ω(read("a")).Should(Equal("a-content"))
+			Ω(ioutil.ReadAll(reader)).Should(Equal([]byte("b-content")))
+		})
+
+		It("removes entries from both tiers", func() {
+			cache.RemoveEntry("a")
+			Ω(filenamesInDir(overflowDir)).Should(BeEmpty())
+
+			_, _, err := cache.Get("a")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Describe("when content is deduplicated", func() {
+		add := func(cacheKey string, content string) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString(content)
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), int64(len(content)), CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		fileFor := func(cacheKey string) os.FileInfo {
+			paths, err := filepath.Glob(filepath.Join(cacheDir, cacheKey+"-*"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(paths).Should(HaveLen(1))
+			info, err := os.Stat(paths[0])
+			Ω(err).ShouldNot(HaveOccurred())
+			return info
+		}
+
+		BeforeEach(func() {
+			cache = NewCache(cacheDir, 30, WithContentDeduplication())
+			add("a", "twelve bytes")
+			add("b", "twelve bytes")
+		})
+
+		It("links entries with the same content to one file", func() {
+			Ω(os.SameFile(fileFor("a"), fileFor("b"))).Should(BeTrue())
+
+			_, bytes, _ := cache.Usage()
+			Ω(bytes).Should(Equal(int64(12)))
+		})
+
+		It("keeps entries with different content apart", func() {
+			add("c", "other bytes!")
+			Ω(os.SameFile(fileFor("a"), fileFor("c"))).Should(BeFalse())
+		})
+
+		It("does not need room for duplicates", func() {
+			add("c", "other bytes!")
+			add("d", "twelve bytes")
+
+			Ω(cache.Entries()).Should(HaveLen(4))
+		})
+
+		It("keeps the content until the last entry linked to it is removed", func() {
+			cache.RemoveEntry("a")
+
+			reader, _, err := cache.Get("b")
+			Ω(err).ShouldNot(HaveOccurred())
+			defer reader.Close()
+			Ω(ioutil.ReadAll(reader)).Should(Equal([]byte("twelve bytes")))
+		})
+	})
+
+	Describe("EvictionOrder", func() {
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"a", "b", "c"} {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.Close()
+				defer os.RemoveAll(sourceFile.Name())
+
+				added, err := cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(added).Should(BeTrue())
+			}
+		})
+
+		cacheKeys := func(infos []CacheEntryInfo) []string {
+			keys := []string{}
+			for _, info := range infos {
+				keys = append(keys, info.CacheKey)
+			}
+			return keys
+		}
+
+		It("lists the least recently accessed entries first", func() {
+			cache.RecordAccess("a")
+			Ω(cacheKeys(cache.EvictionOrder())).Should(Equal([]string{"b", "c", "a"}))
+		})
+
+		It("matches the order entries are evicted in", func() {
+			cache.RecordAccess("b")
+			order := cacheKeys(cache.EvictionOrder())
+
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			_, err = cache.Add("d", sourceFile.Name(), 123424-200, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, ok := cache.EntryInfo(order[0])
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo(order[2])
+			Ω(ok).Should(BeTrue())
+		})
+	})
+
+	Describe("EvictToSize", func() {
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"a", "b", "c"} {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.Close()
+				defer os.RemoveAll(sourceFile.Name())
+
+				added, err := cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(added).Should(BeTrue())
+			}
+		})
+
+		It("evicts the least recently accessed entries until the cache fits", func() {
+			cache.RecordAccess("a")
+
+			freed, err := cache.EvictToSize(150)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(freed).Should(BeEquivalentTo(200))
+
+			_, ok := cache.EntryInfo("a")
+			Ω(ok).Should(BeTrue())
+			_, ok = cache.EntryInfo("b")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo("c")
+			Ω(ok).Should(BeFalse())
+
+			_, _, evictions := cache.Usage()
+			Ω(evictions).Should(BeEquivalentTo(2))
+		})
+
+		It("frees nothing when the cache already fits", func() {
+			freed, err := cache.EvictToSize(300)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(freed).Should(BeZero())
+			Ω(cache.Entries()).Should(HaveLen(3))
+		})
+
+		It("empties the cache for a target of zero", func() {
+			freed, err := cache.EvictToSize(0)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(freed).Should(BeEquivalentTo(300))
+			Ω(cache.Entries()).Should(BeEmpty())
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+
+		It("keeps the size limit", func() {
+			_, err := cache.EvictToSize(0)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add("d", sourceFile.Name(), 123424, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		})
+
+		It("rejects a negative target", func() {
+			_, err := cache.EvictToSize(-1)
+			Ω(err).Should(HaveOccurred())
+			Ω(cache.Entries()).Should(HaveLen(3))
+		})
+	})
+
+	Describe("Reset", func() {
+		It("removes every entry and zeroes the eviction count", func() {
+			for _, cacheKey := range []string{"a", "b"} {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.Close()
+				defer os.RemoveAll(sourceFile.Name())
+
+				_, err = cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+			}
+			_, err := cache.EvictToSize(100)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			cache.Reset()
+			Ω(cache.Entries()).Should(BeEmpty())
+			entries, bytes, evictions := cache.Usage()
+			Ω(entries).Should(BeZero())
+			Ω(bytes).Should(BeZero())
+			Ω(evictions).Should(BeZero())
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+	})
+
+	Describe("Verify", func() {
+		var orphanPath string
+
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"a", "b"} {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.WriteString(cacheKey + "-content")
+				sourceFile.Close()
+				defer os.RemoveAll(sourceFile.Name())
+
+				added, err := cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(added).Should(BeTrue())
+			}
+
+			paths, err := filepath.Glob(filepath.Join(cacheDir, "a-*"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(paths).Should(HaveLen(1))
+			Ω(os.Remove(paths[0])).Should(Succeed())
+
+			orphanPath = filepath.Join(cacheDir, "orphan")
+			Ω(ioutil.WriteFile(orphanPath, []byte("orphan"), 0644)).Should(Succeed())
+		})
+
+		It("reports dangling entries and orphaned files", func() {
+			report, err := cache.Verify(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report.DanglingEntries).Should(Equal([]string{"a"}))
+			Ω(report.OrphanedFiles).Should(Equal([]string{orphanPath}))
+
+			By("leaving them alone")
+			Ω(orphanPath).Should(BeAnExistingFile())
+			_, ok := cache.EntryInfo("a")
+			Ω(ok).Should(BeTrue())
+		})
+
+		It("repairs them when asked to", func() {
+			_, err := cache.Verify(true)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(orphanPath).ShouldNot(BeAnExistingFile())
+			_, ok := cache.EntryInfo("a")
+			Ω(ok).Should(BeFalse())
+			_, ok = cache.EntryInfo("b")
+			Ω(ok).Should(BeTrue())
+
+			report, err := cache.Verify(false)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(report).Should(Equal(VerifyReport{}))
+		})
+	})
+
+	Describe("Migrate", func() {
+		var newDir string
+		var openReader io.ReadCloser
+
+		BeforeEach(func() {
+			for _, cacheKey := range []string{"a", "b"} {
+				sourceFile, err := ioutil.TempFile("", "cache-test-file")
+				Ω(err).ShouldNot(HaveOccurred())
+				sourceFile.WriteString(cacheKey + "-content")
+				sourceFile.Close()
+				defer os.RemoveAll(sourceFile.Name())
+
+				added, err := cache.Add(cacheKey, sourceFile.Name(), 100, CachingInfoType{})
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(added).Should(BeTrue())
+			}
+
+			openReader, _, err = cache.Get("a")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			newDir, err = ioutil.TempDir("", "cache-test-migrated")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			openReader.Close()
+			os.RemoveAll(newDir)
+		})
+
+		It("moves every entry to the new directory", func() {
+			Ω(cache.Migrate(newDir)).Should(Succeed())
+
+			Ω(filenamesInDir(newDir)).Should(HaveLen(2))
+			for _, cacheKey := range []string{"a", "b"} {
+				reader, _, err := cache.Get(cacheKey)
+				Ω(err).ShouldNot(HaveOccurred())
+				content, err := ioutil.ReadAll(reader)
+				reader.Close()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(content)).Should(Equal(cacheKey + "-content"))
+			}
+		})
+
+		It("keeps open files readable and removes them from the old directory once closed", func() {
+			Ω(cache.Migrate(newDir)).Should(Succeed())
+			Ω(filenamesInDir(cacheDir)).Should(HaveLen(1))
+
+			content, err := ioutil.ReadAll(openReader)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(content)).Should(Equal("a-content"))
+
+			Ω(openReader.Close()).Should(Succeed())
+			Ω(filenamesInDir(cacheDir)).Should(BeEmpty())
+		})
+
+		It("admits new entries into the new directory", func() {
+			Ω(cache.Migrate(newDir)).Should(Succeed())
+
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			_, err = cache.Add("c", sourceFile.Name(), 100, CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(filenamesInDir(newDir)).Should(HaveLen(3))
+		})
+
+		It("reports the entries it could not move and keeps serving them", func() {
+			Ω(os.RemoveAll(newDir)).Should(Succeed())
+
+			err := cache.Migrate(newDir)
+			Ω(err).Should(HaveOccurred())
+			migrateErr, ok := err.(*MigrateError)
+			Ω(ok).Should(BeTrue())
+			Ω(migrateErr.Failures).Should(HaveLen(2))
+			Ω(migrateErr.Failures).Should(HaveKey("a"))
+
+			reader, _, err := cache.Get("b")
+			Ω(err).ShouldNot(HaveOccurred())
+			reader.Close()
+		})
+	})
+
+	Describe("histograms", func() {
+		var clock *fakeClock
+
+		add := func(cacheKey string, size int) {
+			sourceFile, err := ioutil.TempFile("", "cache-test-file")
+			Ω(err).ShouldNot(HaveOccurred())
+			sourceFile.WriteString(strings.Repeat("x", size))
+			sourceFile.Close()
+			defer os.RemoveAll(sourceFile.Name())
+
+			added, err := cache.Add(cacheKey, sourceFile.Name(), int64(size), CachingInfoType{})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(added).Should(BeTrue())
+		}
+
+		BeforeEach(func() {
+			clock = &fakeClock{now: time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)}
+			cache = NewCache(cacheDir, 123424, WithClock(clock), WithAgeBuckets([]time.Duration{time.Hour, time.Minute}), WithSizeBuckets([]int64{10, 100}))
+
+			add("old", 5)
+			clock.Step(30 * time.Minute)
+			add("recent", 50)
+			add("large", 500)
+			clock.Step(time.Minute)
+		})
+
+		It("buckets the entries by age", func() {
+			Ω(cache.AgeHistogram()).Should(Equal([]AgeBucket{
+				{Max: time.Minute, Entries: 2, Bytes: 550},
+				{Max: time.Hour, Entries: 1, Bytes: 5},
+				{Max: 0, Entries: 0, Bytes: 0},
+			}))
+		})
+
+		It("buckets the entries by size", func() {
+			Ω(cache.SizeHistogram()).Should(Equal([]SizeBucket{
+				{Max: 10, Entries: 1, Bytes: 5},
+				{Max: 100, Entries: 1, Bytes: 50},
+				{Max: 0, Entries: 1, Bytes: 500},
+			}))
 		})
 	})
 })
@@ -138,3 +1155,20 @@ func filenamesInDir(dir string) []string {
 
 	return result
 }
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Step(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
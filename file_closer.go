@@ -8,15 +8,35 @@ import (
 
 type fileCloser struct {
 	file    *os.File
+	reader  io.ReadSeeker
 	onClose func(string)
+
+	// shared is true if file is shared with other readers, which read it
+	// through their own section reader and leave closing it to onClose
+	shared bool
+	closed bool
 }
 
 func NewFileCloser(file *os.File, onClose func(string)) io.ReadCloser {
-	fc := &fileCloser{
+	return newFileCloser(&fileCloser{
 		file:    file,
+		reader:  file,
 		onClose: onClose,
-	}
+	})
+}
 
+// newSharedFileCloser reads the first size bytes of a file other readers
+// also use, with an offset of its own.
+func newSharedFileCloser(file *os.File, size int64, onClose func(string)) *fileCloser {
+	return newFileCloser(&fileCloser{
+		file:    file,
+		reader:  io.NewSectionReader(file, 0, size),
+		onClose: onClose,
+		shared:  true,
+	})
+}
+
+func newFileCloser(fc *fileCloser) *fileCloser {
 	runtime.SetFinalizer(fc, func(f *fileCloser) {
 		f.Close()
 	})
@@ -25,14 +45,26 @@ func NewFileCloser(file *os.File, onClose func(string)) io.ReadCloser {
 }
 
 func (fw *fileCloser) Read(p []byte) (int, error) {
-	return fw.file.Read(p)
+	return fw.reader.Read(p)
+}
+
+// Seek lets callers such as http.ServeContent serve ranges of the file.
+func (fw *fileCloser) Seek(offset int64, whence int) (int64, error) {
+	return fw.reader.Seek(offset, whence)
 }
 
 func (fw *fileCloser) Close() error {
-	err := fw.file.Close()
-	if err != nil {
-		return err
+	if fw.closed {
+		return os.ErrClosed
+	}
+
+	if !fw.shared {
+		err := fw.file.Close()
+		if err != nil {
+			return err
+		}
 	}
+	fw.closed = true
 	fw.onClose(fw.file.Name())
 	runtime.SetFinalizer(fw, nil)
 	return nil
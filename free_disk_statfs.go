@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux
+// +build darwin dragonfly freebsd linux
+
+package cacheddownloader
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir.
+func freeDiskSpace(dir string) (int64, bool, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(dir, &st)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true, nil
+}
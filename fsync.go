@@ -0,0 +1,47 @@
+package cacheddownloader
+
+import (
+	"os"
+	"runtime"
+)
+
+// FsyncPolicy says how hard the cache works to keep admitted files across a
+// power failure. See WithFsyncPolicy.
+type FsyncPolicy int
+
+const (
+	// FsyncNever leaves flushing admitted files to the operating system. A
+	// crash may lose recently admitted entries or leave them truncated.
+	FsyncNever FsyncPolicy = iota
+	// FsyncOnAdmission syncs each file before it is renamed into the cache.
+	FsyncOnAdmission
+	// FsyncOnAdmissionAndDir also syncs the cache directory once a file has
+	// been renamed into it, so the new directory entry survives a crash too.
+	// Windows cannot sync directories, so there it is FsyncOnAdmission.
+	FsyncOnAdmissionAndDir
+)
+
+// syncFile flushes the file or directory at path to disk.
+func syncFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	flag := os.O_RDONLY
+	if runtime.GOOS == "windows" {
+		if info.IsDir() {
+			return nil
+		}
+		// FlushFileBuffers needs a handle with write access
+		flag = os.O_RDWR
+	}
+
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,102 @@
+package cacheddownloader
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultAgeBuckets are the upper bounds of the AgeHistogram buckets unless
+// WithAgeBuckets says otherwise.
+var DefaultAgeBuckets = []time.Duration{time.Minute, 10 * time.Minute, time.Hour, 6 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// DefaultSizeBuckets are the upper bounds of the SizeHistogram buckets unless
+// WithSizeBuckets says otherwise.
+var DefaultSizeBuckets = []int64{4 << 10, 64 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30}
+
+// AgeBucket counts the entries downloaded at most Max ago, and longer ago
+// than the Max of the bucket before. The last bucket has no upper bound and a
+// Max of zero.
+type AgeBucket struct {
+	Max     time.Duration
+	Entries int
+	Bytes   int64
+}
+
+// SizeBucket counts the entries of at most Max bytes, and larger than the Max
+// of the bucket before. The last bucket has no upper bound and a Max of zero.
+type SizeBucket struct {
+	Max     int64
+	Entries int
+	Bytes   int64
+}
+
+func sortedDurations(bounds []time.Duration) []time.Duration {
+	sorted := append([]time.Duration{}, bounds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func sortedSizes(bounds []int64) []int64 {
+	sorted := append([]int64{}, bounds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// AgeHistogram buckets the entries by how long ago they were downloaded, for
+// instance to tell whether the TTL is longer than entries tend to live.
+func (c *FileCache) AgeHistogram() []AgeBucket {
+	return c.ageHistogram("")
+}
+
+// ageHistogram is AgeHistogram for the entries whose keys start with
+// keyPrefix.
+func (c *FileCache) ageHistogram(keyPrefix string) []AgeBucket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buckets := make([]AgeBucket, len(c.ageBuckets)+1)
+	for i, max := range c.ageBuckets {
+		buckets[i].Max = max
+	}
+
+	now := c.clock.Now()
+	for cacheKey, f := range c.entries {
+		if !strings.HasPrefix(cacheKey, keyPrefix) {
+			continue
+		}
+		age := now.Sub(f.downloaded)
+		i := sort.Search(len(c.ageBuckets), func(i int) bool { return age <= c.ageBuckets[i] })
+		buckets[i].Entries++
+		buckets[i].Bytes += f.size
+	}
+	return buckets
+}
+
+// SizeHistogram buckets the entries by size, for instance to tell how many
+// more entries a larger cache would hold.
+func (c *FileCache) SizeHistogram() []SizeBucket {
+	return c.sizeHistogram("")
+}
+
+// sizeHistogram is SizeHistogram for the entries whose keys start with
+// keyPrefix.
+func (c *FileCache) sizeHistogram(keyPrefix string) []SizeBucket {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	buckets := make([]SizeBucket, len(c.sizeBuckets)+1)
+	for i, max := range c.sizeBuckets {
+		buckets[i].Max = max
+	}
+
+	for cacheKey, f := range c.entries {
+		if !strings.HasPrefix(cacheKey, keyPrefix) {
+			continue
+		}
+		i := sort.Search(len(c.sizeBuckets), func(i int) bool { return f.size <= c.sizeBuckets[i] })
+		buckets[i].Entries++
+		buckets[i].Bytes += f.size
+	}
+	return buckets
+}
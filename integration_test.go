@@ -47,6 +47,9 @@ var _ = Describe("Integration", func() {
 	})
 
 	AfterEach(func() {
+		if downloader != nil {
+			downloader.Close()
+		}
 		os.RemoveAll(serverPath)
 		os.RemoveAll(cachedPath)
 		os.RemoveAll(uncachedPath)
@@ -78,10 +81,12 @@ var _ = Describe("Integration", func() {
 
 	Describe("Cached Downloader", func() {
 		BeforeEach(func() {
-			downloader = cacheddownloader.New(cachedPath, uncachedPath, cacheMaxSizeInBytes, downloadTimeout)
+			var err error
+			downloader, err = cacheddownloader.New(cachedPath, uncachedPath, cacheMaxSizeInBytes, downloadTimeout)
+			Ω(err).ShouldNot(HaveOccurred())
 
 			// touch a file on disk
-			err := ioutil.WriteFile(filepath.Join(serverPath, "file"), []byte("a"), 0666)
+			err = ioutil.WriteFile(filepath.Join(serverPath, "file"), []byte("a"), 0666)
 			Ω(err).ShouldNot(HaveOccurred())
 		})
 
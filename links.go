@@ -0,0 +1,115 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrNotCached is returned by FetchAndLinkAtomic when the file was not
+// cached, e.g. because the response had no validators, it is too large for
+// the cache or cacheKey is empty, so there is no cached file to link to.
+var ErrNotCached = errors.New("File was not cached")
+
+// FetchAndLinkAtomic fetches the file and points the symlink at symlinkPath
+// at it, replacing whatever is there in a single rename, so a deployment can
+// switch a "current" link between artifacts without anything seeing a
+// missing or half-written one. The file stays on disk, even if it is evicted,
+// until symlinkPath is linked to another file through the downloader or the
+// downloader is closed. Each link counts against WithMaxOpenFiles like an
+// open reader. If the file is not cached it returns ErrNotCached and leaves
+// the symlink alone.
+func (c *cachedDownloader) FetchAndLinkAtomic(url *url.URL, cacheKey string, symlinkPath string) error {
+	linkPath, err := filepath.Abs(symlinkPath)
+	if err != nil {
+		return err
+	}
+
+	reader, result, err := c.fetch(url, cacheKey, downloadRequest{})
+	if err != nil {
+		return err
+	}
+
+	// Any other file is a temporary one that is already removed
+	fc, ok := reader.(*fileCloser)
+	if !ok || !result.Shared {
+		reader.Close()
+		return ErrNotCached
+	}
+
+	target, err := filepath.Abs(fc.file.Name())
+	if err == nil {
+		err = replaceSymlink(target, linkPath)
+	}
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	c.links.replace(linkPath, reader)
+	return nil
+}
+
+// replaceSymlink points linkPath at target through a temporary symlink next
+// to it.
+func replaceSymlink(target string, linkPath string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(linkPath), "."+filepath.Base(linkPath)+"-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+
+	// Use os.RemoveAll because on windows, os.Remove will remove
+	// the dir of the file if the file doesn't exist and the dir of the file is
+	// empty.
+	defer os.RemoveAll(tmpPath)
+
+	// The temporary file only reserved a name for the symlink
+	os.RemoveAll(tmpPath)
+	err = os.Symlink(target, tmpPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, linkPath)
+}
+
+// linkSet holds the reader of the file each symlink made by
+// FetchAndLinkAtomic points at, which keeps the file on disk.
+type linkSet struct {
+	lock    sync.Mutex
+	readers map[string]io.Closer
+}
+
+func newLinkSet() *linkSet {
+	return &linkSet{readers: map[string]io.Closer{}}
+}
+
+// replace holds reader for linkPath and releases the file it pointed at
+// before.
+func (s *linkSet) replace(linkPath string, reader io.Closer) {
+	s.lock.Lock()
+	previous := s.readers[linkPath]
+	s.readers[linkPath] = reader
+	s.lock.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+}
+
+func (s *linkSet) releaseAll() {
+	s.lock.Lock()
+	readers := s.readers
+	s.readers = map[string]io.Closer{}
+	s.lock.Unlock()
+
+	for _, reader := range readers {
+		reader.Close()
+	}
+}
@@ -0,0 +1,30 @@
+package cacheddownloader
+
+import "sync"
+
+// Logger receives warnings about problems the cache works around, such as an
+// upstream that defeats caching. *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+// hostSet remembers which hosts have been warned about, so a misbehaving
+// upstream is reported once rather than on every fetch.
+type hostSet struct {
+	lock  sync.Mutex
+	hosts map[string]bool
+}
+
+func (s *hostSet) add(host string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.hosts[host] {
+		return false
+	}
+	s.hosts[host] = true
+	return true
+}
@@ -0,0 +1,140 @@
+package cacheddownloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ChunkHash is one entry of a chunk manifest: the size of a chunk and the
+// hex encoded SHA-256 of its contents. Chunks follow each other from the
+// start of the file.
+type ChunkHash struct {
+	Size   int64
+	SHA256 string
+}
+
+// DownloadWithManifest downloads the file at url as range requests, one per
+// chunk of the manifest, and verifies each chunk as it arrives. A chunk that
+// fails to download or does not match its hash is refetched on its own, up to
+// MAX_DOWNLOAD_ATTEMPTS times. The server must support range requests.
+//
+// Chunks destinationFile already holds that match their hash are kept, so
+// calling it again with the same file resumes a download that failed. The
+// circuit breaker applies to every range request, but scheme handlers do
+// not, and fetches through CachedDownloader do not use manifests.
+func (downloader *Downloader) DownloadWithManifest(url *url.URL, destinationFile *os.File, manifest []ChunkHash) (int64, error) {
+	url = downloader.rewriteURL(url)
+	if !downloader.allowedHosts.allows(url.Hostname()) {
+		return 0, ErrHostNotAllowed
+	}
+	timeout := downloader.currentTimeout()
+
+	expected := make([][]byte, len(manifest))
+	size := int64(0)
+	for i, chunk := range manifest {
+		sum, err := hex.DecodeString(chunk.SHA256)
+		if err != nil || len(sum) != sha256.Size {
+			return 0, fmt.Errorf("Invalid manifest: chunk %d has malformed hash %q", i, chunk.SHA256)
+		}
+		if chunk.Size <= 0 {
+			return 0, fmt.Errorf("Invalid manifest: chunk %d has size %d", i, chunk.Size)
+		}
+		expected[i] = sum
+		size += chunk.Size
+	}
+
+	info, err := destinationFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Size() > size {
+		err = destinationFile.Truncate(size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	parallel := downloader.parallelChunks
+	if parallel < 1 {
+		parallel = 1
+	}
+	slots := make(chan struct{}, parallel)
+
+	errs := make([]error, len(manifest))
+	wg := sync.WaitGroup{}
+	start := int64(0)
+	for i, chunk := range manifest {
+		wg.Add(1)
+		go func(i int, start, length int64) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			if chunkMatches(destinationFile, start, length, expected[i]) {
+				return
+			}
+			errs[i] = downloader.fetchVerifiedChunk(req, destinationFile, start, length, expected[i], timeout)
+		}(i, start, chunk.Size)
+		start += chunk.Size
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	info, err = destinationFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if info.Size() != size {
+		return 0, fmt.Errorf("Download failed: expected %d bytes, got %d", size, info.Size())
+	}
+
+	return size, nil
+}
+
+func (downloader *Downloader) fetchVerifiedChunk(req *http.Request, destinationFile *os.File, start, length int64, expected []byte, timeout time.Duration) error {
+	var err error
+	for attempt := 0; attempt < MAX_DOWNLOAD_ATTEMPTS; attempt++ {
+		if !downloader.circuits.allow(req.URL.Host) {
+			return ErrCircuitOpen
+		}
+
+		checksum := sha256.New()
+		err = downloader.fetchChunk(req, destinationFile, start, length, "", timeout, checksum)
+		downloader.circuits.record(req.URL.Host, upstreamFailure(err))
+		if err == nil && !bytes.Equal(checksum.Sum(nil), expected) {
+			err = fmt.Errorf("Download failed: chunk at offset %d does not match its hash", start)
+		}
+		if err == nil {
+			break
+		}
+	}
+
+	return err
+}
+
+// chunkMatches reports whether destinationFile already holds the chunk at
+// start, e.g. from an earlier call that failed on another chunk.
+func chunkMatches(destinationFile *os.File, start, length int64, expected []byte) bool {
+	checksum := sha256.New()
+	n, err := io.Copy(checksum, io.NewSectionReader(destinationFile, start, length))
+	return err == nil && n == length && bytes.Equal(checksum.Sum(nil), expected)
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package cacheddownloader
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile cannot map files on this platform, so it reads the file into
+// memory instead. It reads at offsets, leaving the offset of file alone for
+// other readers sharing it.
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(file, 0, size), data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return nil }, nil
+}
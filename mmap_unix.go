@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package cacheddownloader
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of file read-only into memory.
+func mapFile(file *os.File, size int64) ([]byte, func() error, error) {
+	if size == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,50 @@
+package cacheddownloader
+
+import "strings"
+
+// Namespace returns a view of the downloader whose cache keys are kept apart
+// from those of the downloader and of every other namespace, e.g. one per
+// tenant. The view shares the cache directory, size limit and eviction with
+// the downloader, but List, EvictionOrder, Walk and the histograms only see
+// the entries stored through it. Stats, Events, Verify, EvictToSize, Reset,
+// Migrate and Close act on the whole downloader. A namespace of a view is
+// separate from the view too, and the view does not list its entries.
+func (c *cachedDownloader) Namespace(name string) CachedDownloader {
+	view := *c
+	view.keyPrefix = hashCacheKey(c.keyPrefix+"\x00"+name) + "-"
+	view.root = c.rootDownloader()
+	return &view
+}
+
+func (c *cachedDownloader) rootDownloader() *cachedDownloader {
+	if c.root == nil {
+		return c
+	}
+	return c.root
+}
+
+// hashKey is the key the entry for cacheKey is stored under. Entries of a
+// namespace start with its prefix, so the view can tell them apart.
+func (c *cachedDownloader) hashKey(cacheKey string) string {
+	return c.keyPrefix + hashCacheKey(cacheKey)
+}
+
+func (c *cachedDownloader) inNamespace(entries []CacheEntryInfo) []CacheEntryInfo {
+	if c.keyPrefix == "" {
+		return entries
+	}
+
+	filtered := []CacheEntryInfo{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.CacheKey, c.keyPrefix) {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered
+}
+
+// namespacePrefix returns the prefix of the namespace hashedKey belongs to,
+// which variants of the entry keep.
+func namespacePrefix(hashedKey string) string {
+	return hashedKey[:strings.LastIndexByte(hashedKey, '-')+1]
+}
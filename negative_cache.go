@@ -0,0 +1,123 @@
+package cacheddownloader
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxNegativeCacheKeys bounds how many failed downloads WithNegativeCache
+// remembers.
+const maxNegativeCacheKeys = 1024
+
+type negativeEntry struct {
+	err     error
+	expires time.Time
+}
+
+// negativeCache remembers downloads that failed with one of statusCodes for
+// ttl, forgetting the oldest beyond max. A nil negativeCache remembers
+// nothing.
+type negativeCache struct {
+	lock        sync.Mutex
+	ttl         time.Duration
+	statusCodes map[int]bool
+	clock       Clock
+	max         int
+	entries     map[string]negativeEntry
+	order       []string
+}
+
+func newNegativeCache(ttl time.Duration, statusCodes []int, clock Clock, max int) *negativeCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if len(statusCodes) == 0 {
+		statusCodes = []int{http.StatusNotFound}
+	}
+
+	n := &negativeCache{
+		ttl:         ttl,
+		statusCodes: map[int]bool{},
+		clock:       clock,
+		max:         max,
+		entries:     map[string]negativeEntry{},
+	}
+	for _, code := range statusCodes {
+		n.statusCodes[code] = true
+	}
+	return n
+}
+
+func (n *negativeCache) reset() {
+	if n == nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.entries = map[string]negativeEntry{}
+	n.order = nil
+}
+
+// get returns the error key failed with if it is still remembered.
+func (n *negativeCache) get(key string) error {
+	if n == nil {
+		return nil
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	entry, ok := n.entries[key]
+	if !ok {
+		return nil
+	}
+	if !n.clock.Now().Before(entry.expires) {
+		n.unsafelyForget(key)
+		return nil
+	}
+	return entry.err
+}
+
+// record remembers err for key if it is one of the status codes, and forgets
+// key once a download of it succeeds.
+func (n *negativeCache) record(key string, err error) {
+	if n == nil {
+		return
+	}
+
+	var status statusCodeError
+	remember := errors.As(err, &status) && n.statusCodes[int(status)]
+	if err != nil && !remember {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if _, ok := n.entries[key]; ok {
+		n.unsafelyForget(key)
+	}
+	if !remember {
+		return
+	}
+
+	n.entries[key] = negativeEntry{err: err, expires: n.clock.Now().Add(n.ttl)}
+	n.order = append(n.order, key)
+
+	for len(n.order) > n.max {
+		n.unsafelyForget(n.order[0])
+	}
+}
+
+func (n *negativeCache) unsafelyForget(key string) {
+	delete(n.entries, key)
+	for i, k := range n.order {
+		if k == key {
+			n.order = append(n.order[:i], n.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package cacheddownloader
+
+import "sync"
+
+// openFileBudget counts the readers handed out to callers. A max of 0 means
+// there is no limit.
+type openFileBudget struct {
+	lock sync.Mutex
+	max  int
+	open int
+}
+
+func (b *openFileBudget) acquire() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.max > 0 && b.open >= b.max {
+		return false
+	}
+	b.open++
+	return true
+}
+
+func (b *openFileBudget) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.open--
+}
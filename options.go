@@ -0,0 +1,619 @@
+package cacheddownloader
+
+import (
+	"crypto/x509"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Option configures optional behaviour of a CachedDownloader or Downloader.
+type Option func(*options)
+
+type options struct {
+	dialAddressFamily AddressFamily
+	dnsCacheTTL       time.Duration
+	urlRewriter       func(*url.URL) *url.URL
+	urlRefresher      func(cacheKey string) (*url.URL, error)
+
+	circuitFailures       int
+	circuitWindow         time.Duration
+	circuitCooldown       time.Duration
+	staleWhileCircuitOpen bool
+
+	parallelChunks       int
+	parallelChunkMinSize int64
+
+	fileMode os.FileMode
+	dirMode  os.FileMode
+
+	cacheRoot string
+
+	ttl time.Duration
+
+	minRevalidationInterval time.Duration
+
+	expectedEntries int
+
+	ageBuckets  []time.Duration
+	sizeBuckets []int64
+
+	minFreeDisk   int64
+	freeDiskSpace func(dir string) (int64, bool, error)
+
+	fetchBytesLimit int64
+
+	clock Clock
+
+	maxIdleTime time.Duration
+
+	tempPrefix string
+
+	cacheWithoutValidatorsTTL time.Duration
+
+	negativeCacheTTL         time.Duration
+	negativeCacheStatusCodes []int
+
+	minContentLength int64
+
+	minCachedSize int64
+	maxCachedSize int64
+
+	responseBodyLimit     int64
+	contentTypeSizeLimits map[string]int64
+
+	overflowPath     string
+	overflowMaxBytes int64
+
+	maxOpenFiles           int
+	sharedDescriptors      bool
+	contentDeduplication   bool
+	maxSingleflightWaiters int
+
+	logger Logger
+
+	fetchObserver func(cacheKey string, result FetchResult, duration time.Duration, err error)
+
+	http2           bool
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+
+	tlsPins []string
+	rootCAs *x509.CertPool
+
+	insecureSkipVerify bool
+
+	allowedHosts []string
+
+	schemeHandlers map[string]SchemeHandler
+
+	sidecarVerifiers map[string]SidecarVerifier
+
+	repanic bool
+
+	progress func(*url.URL, Progress)
+
+	eventBufferSize int
+
+	copyBufferSize int
+
+	fsyncPolicy FsyncPolicy
+
+	rename   func(oldpath, newpath string) error
+	copyFile func(dst io.Writer, src io.Reader) (int64, error)
+	fsync    func(path string) error
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		freeDiskSpace:   freeDiskSpace,
+		fetchBytesLimit: DefaultFetchBytesLimit,
+		copyBufferSize:  DefaultCopyBufferSize,
+		ageBuckets:      DefaultAgeBuckets,
+		sizeBuckets:     DefaultSizeBuckets,
+		clock:           realClock{},
+		tempPrefix:      DefaultTempPrefix,
+		logger:          nopLogger{},
+		rename:          os.Rename,
+		copyFile:        io.Copy,
+		fsync:           syncFile,
+		http2:           true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithDialAddressFamily selects which address family is tried first when a
+// host resolves to both IPv4 and IPv6 addresses.
+func WithDialAddressFamily(family AddressFamily) Option {
+	return func(o *options) {
+		o.dialAddressFamily = family
+	}
+}
+
+// WithDNSCache caches the addresses host names resolve to for ttl, so
+// repeated downloads from the same host do not each hit the resolver.
+func WithDNSCache(ttl time.Duration) Option {
+	return func(o *options) {
+		o.dnsCacheTTL = ttl
+	}
+}
+
+// WithURLRewriter transforms every URL before it is downloaded, e.g. to send
+// requests to an internal mirror. The rewriter receives a copy of the URL and
+// may return nil to leave it unchanged. Cache keys are not affected, so
+// entries stay valid when the mirror changes.
+func WithURLRewriter(rewriter func(*url.URL) *url.URL) Option {
+	return func(o *options) {
+		o.urlRewriter = rewriter
+	}
+}
+
+// WithURLRefresher is called for a new URL when a fetch fails with a 401 or
+// 403, as happens once a presigned URL expires, and the fetch is retried once
+// with the URL it returns. The entry stays under the same cache key, so it
+// can still be revalidated rather than downloaded again.
+func WithURLRefresher(refresher func(cacheKey string) (*url.URL, error)) Option {
+	return func(o *options) {
+		o.urlRefresher = refresher
+	}
+}
+
+// WithCircuitBreaker stops sending requests to a host after failures
+// consecutive failed attempts within window, including retries, and fails
+// downloads from it with ErrCircuitOpen instead. After cooldown one probe
+// request is let through: the circuit closes if it succeeds and opens again
+// if it fails. Connection errors and 5xx responses count as failures; other
+// responses reset the count.
+func WithCircuitBreaker(failures int, window, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.circuitFailures = failures
+		o.circuitWindow = window
+		o.circuitCooldown = cooldown
+	}
+}
+
+// WithStaleWhileCircuitOpen serves the cached entry, however stale, when its
+// host's circuit is open, rather than failing with ErrCircuitOpen.
+func WithStaleWhileCircuitOpen() Option {
+	return func(o *options) {
+		o.staleWhileCircuitOpen = true
+	}
+}
+
+// WithParallelChunks downloads files larger than minFileSize as n concurrent
+// byte ranges when the server advertises "Accept-Ranges: bytes". Other
+// downloads use a single stream.
+func WithParallelChunks(n int, minFileSize int64) Option {
+	return func(o *options) {
+		o.parallelChunks = n
+		o.parallelChunkMinSize = minFileSize
+	}
+}
+
+// WithFileMode sets the permissions of files admitted into the cache, e.g. to
+// make them readable by a process running as a different user.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.fileMode = mode
+	}
+}
+
+// WithDirMode sets the permissions of the cache directory created by New.
+// It defaults to 0770 minus the process umask.
+func WithDirMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.dirMode = mode
+	}
+}
+
+// WithCacheRoot makes New and Migrate refuse, with ErrCacheOutsideRoot, a
+// cache directory that does not resolve to root or a directory below it once
+// symlinks are followed. New removes everything in the cache directory, so
+// this guards against a misconfigured path or a stray symlink wiping an
+// unrelated directory. The overflow tier is checked too.
+func WithCacheRoot(root string) Option {
+	return func(o *options) {
+		o.cacheRoot = root
+	}
+}
+
+// WithTTL trusts a cache entry for ttl after it was downloaded or last
+// revalidated. Fetches within that window are served straight from disk
+// without a conditional request: a warm hit costs a single open(2), where a
+// revalidation also creates, closes and removes a temp file and makes an HTTP
+// round trip.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithMinRevalidationInterval serves an entry straight from disk for
+// interval after it was downloaded or last revalidated, even if the TTL or
+// the response's Expires header say it is stale, so callers fetching the
+// same key in a tight loop do not flood the server with conditional
+// requests. FetchForceRefresh still revalidates.
+func WithMinRevalidationInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.minRevalidationInterval = interval
+	}
+}
+
+// WithExpectedEntries sizes the cache's index for n entries up front, so a
+// large cache does not rehash it over and over as it warms up.
+func WithExpectedEntries(n int) Option {
+	return func(o *options) {
+		o.expectedEntries = n
+	}
+}
+
+// WithMinFreeDisk keeps at least bytes free on the filesystem holding the
+// cache directory, even when the cache is under its maximum size. Entries are
+// evicted to make room and a file is not admitted if that is not enough. Free
+// space is read with statfs(2); on platforms without it the guard is skipped.
+func WithMinFreeDisk(bytes int64) Option {
+	return func(o *options) {
+		o.minFreeDisk = bytes
+	}
+}
+
+// WithFetchBytesLimit sets the largest file, in bytes, that FetchBytes reads
+// into memory. It defaults to DefaultFetchBytesLimit.
+func WithFetchBytesLimit(limit int64) Option {
+	return func(o *options) {
+		o.fetchBytesLimit = limit
+	}
+}
+
+// WithMaxIdleTime removes entries that have not been accessed for d, to
+// reclaim disk space regardless of the size limit. Idle entries are swept
+// whenever the cache is accessed, so an entry that has been idle for too long
+// is downloaded again rather than served. Unlike WithTTL this is not about
+// freshness: an entry within its idle time may still be revalidated.
+func WithMaxIdleTime(d time.Duration) Option {
+	return func(o *options) {
+		o.maxIdleTime = d
+	}
+}
+
+// WithTempPrefix sets the prefix of the temporary files downloads are written
+// to in the uncached path. Temporary files are named
+// <prefix><cache key hash or "uncached">-<creation time in Unix nanoseconds>-<random>,
+// so leaked files can be attributed and cleaned up by age. It defaults to
+// DefaultTempPrefix.
+func WithTempPrefix(prefix string) Option {
+	return func(o *options) {
+		o.tempPrefix = prefix
+	}
+}
+
+// WithCacheWithoutValidators caches downloads that have neither an ETag nor a
+// Last-Modified header for ttl, unless they have an Expires header, instead of
+// downloading them again on every fetch. As they cannot be revalidated, they
+// are downloaded again in full once they expire.
+func WithCacheWithoutValidators(ttl time.Duration) Option {
+	return func(o *options) {
+		o.cacheWithoutValidatorsTTL = ttl
+	}
+}
+
+// WithMinContentLength stops files smaller than bytes from being cached. Some
+// CDNs answer with a 200 and a tiny error or placeholder page during
+// incidents, and caching it would keep serving it afterwards. Such files are
+// still returned, but an entry already in the cache is left in place.
+func WithMinContentLength(bytes int64) Option {
+	return func(o *options) {
+		o.minContentLength = bytes
+	}
+}
+
+// WithCacheSizeRange only caches files of at least min and at most max bytes,
+// e.g. to keep tiny files that are cheap to download again from taking up
+// entries, and huge ones from evicting everything else. Files outside the
+// range are returned from their temporary file, and replace any entry for
+// their key like files that do not fit in the cache. A max of zero leaves
+// only the cache size as the upper bound. Put returns
+// ErrOutsideCacheSizeRange for such contents.
+func WithCacheSizeRange(min, max int64) Option {
+	return func(o *options) {
+		o.minCachedSize = min
+		o.maxCachedSize = max
+	}
+}
+
+// WithResponseBodyLimit makes downloads larger than bytes fail with
+// ErrDownloadTooLarge, unless WithContentTypeSizeLimits sets a limit for
+// their content type. Zero, the default, means no limit.
+func WithResponseBodyLimit(bytes int64) Option {
+	return func(o *options) {
+		o.responseBodyLimit = bytes
+	}
+}
+
+// WithContentTypeSizeLimits sets the largest download, in bytes, for each
+// media type, such as "application/json", so small configuration files and
+// large images can be bounded differently. Parameters such as charset are
+// ignored when matching. Types that are not listed fall back to
+// WithResponseBodyLimit.
+func WithContentTypeSizeLimits(limits map[string]int64) Option {
+	return func(o *options) {
+		o.contentTypeSizeLimits = map[string]int64{}
+		for contentType, limit := range limits {
+			o.contentTypeSizeLimits[strings.ToLower(contentType)] = limit
+		}
+	}
+}
+
+// WithOverflowTier adds a second, usually larger and slower, cache tier in
+// path that holds up to maxBytes. Entries evicted from the primary tier to
+// make room are demoted to it rather than deleted, and promoted back when
+// they are accessed. Entries that are over their idle time or are replaced
+// are deleted from both tiers. New empties path like the primary directory.
+func WithOverflowTier(path string, maxBytes int64) Option {
+	return func(o *options) {
+		o.overflowPath = path
+		o.overflowMaxBytes = maxBytes
+	}
+}
+
+// WithContentDeduplication hardlinks entries with identical content, e.g. the
+// same artifact served from two URLs, to a single copy on disk. Each file is
+// hashed with SHA-256 when it is admitted, and shared bytes only count once
+// against the size limit. Where hardlinks are not supported the entry is
+// stored as a copy of its own.
+func WithContentDeduplication() Option {
+	return func(o *options) {
+		o.contentDeduplication = true
+	}
+}
+
+// WithCopyBufferSize sets the size of the buffer downloads are copied to disk
+// through. It defaults to DefaultCopyBufferSize.
+func WithCopyBufferSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.copyBufferSize = n
+		}
+	}
+}
+
+// WithFsyncPolicy trades admission throughput for crash consistency. It
+// defaults to FsyncNever, which is fine for a cache that is rebuilt from
+// scratch, but a cache that is kept across restarts may want its entries to
+// survive a power failure. Files that have to be copied into the cache are
+// always synced before they are renamed into place.
+func WithFsyncPolicy(policy FsyncPolicy) Option {
+	return func(o *options) {
+		o.fsyncPolicy = policy
+	}
+}
+
+// WithNegativeCache remembers for ttl that downloading a key from a URL
+// failed with one of statusCodes, 404 Not Found if none are given, and fails
+// further fetches of it with the same error without a request. Only the most
+// recent failures are remembered. A successful download, e.g. through
+// FetchForceRefresh, which always asks the server, forgets the failure.
+func WithNegativeCache(ttl time.Duration, statusCodes ...int) Option {
+	return func(o *options) {
+		o.negativeCacheTTL = ttl
+		o.negativeCacheStatusCodes = statusCodes
+	}
+}
+
+// WithAgeBuckets sets the upper bounds of the AgeHistogram buckets. It
+// defaults to DefaultAgeBuckets.
+func WithAgeBuckets(bounds []time.Duration) Option {
+	return func(o *options) {
+		o.ageBuckets = bounds
+	}
+}
+
+// WithSizeBuckets sets the upper bounds, in bytes, of the SizeHistogram
+// buckets. It defaults to DefaultSizeBuckets.
+func WithSizeBuckets(bounds []int64) Option {
+	return func(o *options) {
+		o.sizeBuckets = bounds
+	}
+}
+
+// WithEvents delivers downloads, admissions, evictions, hits and errors to
+// the channel returned by Events, which buffers up to bufferSize of them. The
+// cache never waits for the consumer: events that do not fit in the buffer
+// are dropped and counted in Stats.DroppedEvents.
+func WithEvents(bufferSize int) Option {
+	return func(o *options) {
+		o.eventBufferSize = bufferSize
+	}
+}
+
+// WithMaxOpenFiles limits how many readers returned by fetches may be open at
+// once. Fetches beyond the limit fail with ErrTooManyOpenFiles until readers
+// are closed, which turns a reader leak into an error instead of running the
+// process out of file descriptors.
+func WithMaxOpenFiles(n int) Option {
+	return func(o *options) {
+		o.maxOpenFiles = n
+	}
+}
+
+// WithSharedDescriptors makes all readers of a cached file share one
+// descriptor, each reading it with an offset of its own, rather than opening
+// the file for every fetch. The descriptor is closed when the last reader is.
+// This cuts the descriptors used by often fetched files.
+func WithSharedDescriptors() Option {
+	return func(o *options) {
+		o.sharedDescriptors = true
+	}
+}
+
+// WithMaxSingleflightWaiters limits how many fetches may wait for a download
+// of the same key that another fetch has already started. Fetches beyond the
+// limit fail with ErrTooManyWaiters, so a slow download of a popular key
+// cannot pile up an unbounded number of blocked goroutines.
+func WithMaxSingleflightWaiters(n int) Option {
+	return func(o *options) {
+		o.maxSingleflightWaiters = n
+	}
+}
+
+// WithSchemeHandler registers h for URLs of scheme, as
+// Downloader.RegisterSchemeHandler does.
+func WithSchemeHandler(scheme string, h SchemeHandler) Option {
+	return func(o *options) {
+		if o.schemeHandlers == nil {
+			o.schemeHandlers = map[string]SchemeHandler{}
+		}
+		o.schemeHandlers[scheme] = h
+	}
+}
+
+// WithSidecarVerifier makes FetchVerified check files against sidecar files
+// ending in suffix with verify, e.g. a ".sig" signature against a public key
+// the caller trusts. It replaces the built-in verifier for ".sha256".
+func WithSidecarVerifier(suffix string, verify SidecarVerifier) Option {
+	return func(o *options) {
+		if o.sidecarVerifiers == nil {
+			o.sidecarVerifiers = map[string]SidecarVerifier{}
+		}
+		o.sidecarVerifiers[suffix] = verify
+	}
+}
+
+// WithRepanic makes a fetch whose download panics panic again with the same
+// value, once the download's temporary file has been removed and fetches
+// waiting for it have been released, rather than return a
+// *DownloadPanicError.
+func WithRepanic() Option {
+	return func(o *options) {
+		o.repanic = true
+	}
+}
+
+// WithProgress calls callback as downloads progress, at most every 100ms and
+// once more when a download completes. It is called from the goroutine
+// doing the download, so it should return quickly.
+func WithProgress(callback func(url *url.URL, progress Progress)) Option {
+	return func(o *options) {
+		o.progress = callback
+	}
+}
+
+// WithHTTP2 sets whether the downloader negotiates HTTP/2 with servers that
+// support it, so concurrent requests share one connection. It is enabled by
+// default; WithHTTP2(false) restricts downloads to HTTP/1.1.
+func WithHTTP2(enabled bool) Option {
+	return func(o *options) {
+		o.http2 = enabled
+	}
+}
+
+// WithMaxIdleConns sets how many idle connections are kept open for reuse, in
+// total and per host, since downloads usually go to a single server.
+func WithMaxIdleConns(n int) Option {
+	return func(o *options) {
+		o.maxIdleConns = n
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle connection is kept open for reuse.
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idleConnTimeout = d
+	}
+}
+
+// WithTLSPins only accepts HTTPS servers whose verified chain has a
+// certificate, leaf or otherwise, whose public key is pinned. Certificates
+// outside the verified chain are ignored. Pins are base64 encoded SHA-256
+// hashes of the DER encoded SubjectPublicKeyInfo, optionally prefixed with
+// "sha256/". Downloads from other servers fail with ErrPinMismatch.
+func WithTLSPins(pins []string) Option {
+	return func(o *options) {
+		o.tlsPins = pins
+	}
+}
+
+// WithRootCAs trusts the certificates in pool instead of the system roots,
+// e.g. for an internal registry with its own certificate authority.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(o *options) {
+		o.rootCAs = pool
+	}
+}
+
+// WithInsecureSkipVerify accepts any certificate an HTTPS server presents,
+// which leaves downloads open to interception. It is meant for development
+// against servers with self-signed certificates, and every download logs a
+// warning while it is set so it does not go unnoticed in production. Prefer
+// WithRootCAs, which trusts such servers without giving up verification.
+func WithInsecureSkipVerify() Option {
+	return func(o *options) {
+		o.insecureSkipVerify = true
+	}
+}
+
+// WithAllowedHosts only downloads from the given hosts, failing downloads
+// from any other host, or redirects to one, with ErrHostNotAllowed. A host of
+// the form "*.example.com" allows every subdomain of example.com. Hosts are
+// matched after WithURLRewriter. This keeps URLs from untrusted input from
+// making the downloader fetch from internal services.
+func WithAllowedHosts(hosts []string) Option {
+	return func(o *options) {
+		o.allowedHosts = append([]string{}, hosts...)
+	}
+}
+
+// WithLogger sends warnings to logger. They are discarded by default.
+func WithLogger(logger Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithFetchObserver calls observer at the end of every fetch, whether it was
+// served from the cache or downloaded and whether or not it failed, with the
+// fetch's result and how long it took. FetchWithFallbackURLs fetches each URL
+// it tries. observer is called without any lock held, but it delays the
+// fetch's return, so it should be quick. For more detail see WithEvents.
+func WithFetchObserver(observer func(cacheKey string, result FetchResult, duration time.Duration, err error)) Option {
+	return func(o *options) {
+		o.fetchObserver = observer
+	}
+}
+
+// WithClock replaces the wall clock used for access times, TTLs and Expires
+// headers.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// withFileOps replaces the rename and copy used to move files into the cache,
+// so tests can inject failures.
+func withFileOps(rename func(oldpath, newpath string) error, copyFile func(dst io.Writer, src io.Reader) (int64, error)) Option {
+	return func(o *options) {
+		o.rename = rename
+		o.copyFile = copyFile
+	}
+}
+
+// withFsync replaces the sync used by WithFsyncPolicy, so tests can see what
+// is synced.
+func withFsync(fsync func(path string) error) Option {
+	return func(o *options) {
+		o.fsync = fsync
+	}
+}
+
+// withFreeDiskSpace replaces the statfs probe used by WithMinFreeDisk.
+func withFreeDiskSpace(probe func(dir string) (int64, bool, error)) Option {
+	return func(o *options) {
+		o.freeDiskSpace = probe
+	}
+}
@@ -0,0 +1,122 @@
+package cacheddownloader
+
+import (
+	"net/url"
+	"sync"
+	"time"
+)
+
+// progressInterval is the least time between two reports of a download's
+// progress, apart from the final one.
+const progressInterval = 100 * time.Millisecond
+
+// progressWindow is how far back the transfer rate is averaged over, so it
+// follows changes in speed without jumping with every read.
+const progressWindow = 5 * time.Second
+
+// Progress describes how far a download has got.
+type Progress struct {
+	Bytes int64
+	// TotalBytes is -1 if the server did not say how large the file is.
+	TotalBytes int64
+	// BytesPerSecond is the transfer rate over the last few seconds.
+	BytesPerSecond float64
+	// Remaining is the estimated time until the download completes. It is
+	// zero if TotalBytes or the rate is not known yet.
+	Remaining time.Duration
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// progressTracker counts the bytes of a download as they are written and
+// reports them to the callback. It is safe for concurrent use, as chunks are
+// written in parallel.
+type progressTracker struct {
+	callback func(*url.URL, Progress)
+	url      *url.URL
+	clock    Clock
+	total    int64
+
+	lock         sync.Mutex
+	bytes        int64
+	samples      []progressSample
+	lastReported int64
+}
+
+// newProgressTracker measures the rate from started, when the request was
+// sent, so that waiting for the response counts against it.
+func newProgressTracker(callback func(*url.URL, Progress), url *url.URL, clock Clock, started time.Time, total int64) *progressTracker {
+	return &progressTracker{
+		callback: callback,
+		url:      url,
+		clock:    clock,
+		total:    total,
+		samples:  []progressSample{{at: started}},
+	}
+}
+
+func (t *progressTracker) Write(p []byte) (int, error) {
+	if t.callback == nil {
+		return len(p), nil
+	}
+
+	t.lock.Lock()
+	t.bytes += int64(len(p))
+	progress, ok := t.unsafelySample(false)
+	t.lock.Unlock()
+
+	if ok {
+		t.callback(t.url, progress)
+	}
+	return len(p), nil
+}
+
+// finish reports the final byte count, unless it has been reported already.
+func (t *progressTracker) finish() {
+	if t.callback == nil {
+		return
+	}
+
+	t.lock.Lock()
+	progress, ok := t.unsafelySample(true)
+	t.lock.Unlock()
+
+	if ok {
+		t.callback(t.url, progress)
+	}
+}
+
+func (t *progressTracker) unsafelySample(final bool) (Progress, bool) {
+	now := t.clock.Now()
+	last := t.samples[len(t.samples)-1]
+	if final && t.bytes == t.lastReported {
+		return Progress{}, false
+	}
+	if !final && now.Sub(last.at) < progressInterval {
+		return Progress{}, false
+	}
+
+	t.samples = append(t.samples, progressSample{at: now, bytes: t.bytes})
+	for len(t.samples) > 2 && now.Sub(t.samples[1].at) >= progressWindow {
+		t.samples = t.samples[1:]
+	}
+	t.lastReported = t.bytes
+
+	progress := Progress{
+		Bytes:      t.bytes,
+		TotalBytes: t.total,
+	}
+
+	first := t.samples[0]
+	if elapsed := now.Sub(first.at); elapsed > 0 {
+		progress.BytesPerSecond = float64(t.bytes-first.bytes) / elapsed.Seconds()
+	}
+	if t.total >= t.bytes && progress.BytesPerSecond > 0 {
+		progress.Remaining = time.Duration(float64(t.total-t.bytes) / progress.BytesPerSecond * float64(time.Second))
+	}
+
+	return progress, true
+}
@@ -0,0 +1,89 @@
+// Package promcollector exports the counters of a cached downloader to
+// Prometheus. It lives in its own package so that the core package does not
+// depend on the Prometheus client.
+package promcollector
+
+import (
+	"github.com/pivotal-golang/cacheddownloader"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatsSource is satisfied by every CachedDownloader.
+type StatsSource interface {
+	Stats() cacheddownloader.Stats
+}
+
+// Collector implements prometheus.Collector by taking a snapshot of the
+// source's Stats on every scrape.
+type Collector struct {
+	source StatsSource
+
+	hits              *prometheus.Desc
+	misses            *prometheus.Desc
+	evictions         *prometheus.Desc
+	cacheBytes        *prometheus.Desc
+	entries           *prometheus.Desc
+	downloadDurations *prometheus.Desc
+
+	ineffectiveRevalidations *prometheus.Desc
+	droppedEvents            *prometheus.Desc
+
+	bytesDownloaded      *prometheus.Desc
+	bytesServedFromCache *prometheus.Desc
+}
+
+func New(namespace string, source StatsSource) *Collector {
+	name := func(metric string) string {
+		return prometheus.BuildFQName(namespace, "cached_downloader", metric)
+	}
+
+	return &Collector{
+		source: source,
+
+		hits:              prometheus.NewDesc(name("hits_total"), "Fetches served from the cache.", nil, nil),
+		misses:            prometheus.NewDesc(name("misses_total"), "Fetches that had to download the file.", nil, nil),
+		evictions:         prometheus.NewDesc(name("evictions_total"), "Entries evicted to make room in the cache.", nil, nil),
+		cacheBytes:        prometheus.NewDesc(name("cache_bytes"), "Bytes currently used by cached files.", nil, nil),
+		entries:           prometheus.NewDesc(name("entries"), "Entries currently in the cache.", nil, nil),
+		downloadDurations: prometheus.NewDesc(name("download_duration_seconds"), "Time spent downloading files.", nil, nil),
+
+		ineffectiveRevalidations: prometheus.NewDesc(name("ineffective_revalidations_total"), "Conditional requests answered with the unchanged file instead of 304.", nil, nil),
+		droppedEvents:            prometheus.NewDesc(name("dropped_events_total"), "Cache events dropped because the consumer fell behind.", nil, nil),
+
+		bytesDownloaded:      prometheus.NewDesc(name("downloaded_bytes_total"), "Bytes of files downloaded from the network.", nil, nil),
+		bytesServedFromCache: prometheus.NewDesc(name("served_from_cache_bytes_total"), "Bytes of files served from the cache.", nil, nil),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.evictions
+	ch <- c.cacheBytes
+	ch <- c.entries
+	ch <- c.downloadDurations
+	ch <- c.ineffectiveRevalidations
+	ch <- c.droppedEvents
+	ch <- c.bytesDownloaded
+	ch <- c.bytesServedFromCache
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.source.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(c.cacheBytes, prometheus.GaugeValue, float64(stats.CacheBytes))
+	ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(stats.Entries))
+	ch <- prometheus.MustNewConstHistogram(
+		c.downloadDurations,
+		stats.DownloadDurations.Count,
+		stats.DownloadDurations.Sum,
+		stats.DownloadDurations.Buckets,
+	)
+	ch <- prometheus.MustNewConstMetric(c.ineffectiveRevalidations, prometheus.CounterValue, float64(stats.IneffectiveRevalidations))
+	ch <- prometheus.MustNewConstMetric(c.droppedEvents, prometheus.CounterValue, float64(stats.DroppedEvents))
+	ch <- prometheus.MustNewConstMetric(c.bytesDownloaded, prometheus.CounterValue, float64(stats.BytesDownloaded))
+	ch <- prometheus.MustNewConstMetric(c.bytesServedFromCache, prometheus.CounterValue, float64(stats.BytesServedFromCache))
+}
@@ -0,0 +1,89 @@
+package promcollector_test
+
+import (
+	"github.com/pivotal-golang/cacheddownloader"
+	"github.com/pivotal-golang/cacheddownloader/promcollector"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeStatsSource struct {
+	stats cacheddownloader.Stats
+}
+
+func (f *fakeStatsSource) Stats() cacheddownloader.Stats {
+	return f.stats
+}
+
+var _ = Describe("Collector", func() {
+	var registry *prometheus.Registry
+	var source *fakeStatsSource
+
+	BeforeEach(func() {
+		source = &fakeStatsSource{
+			stats: cacheddownloader.Stats{
+				Hits:       3,
+				Misses:     2,
+				Evictions:  1,
+				CacheBytes: 1024,
+				Entries:    4,
+
+				IneffectiveRevalidations: 5,
+				DroppedEvents:            6,
+
+				BytesDownloaded:      700,
+				BytesServedFromCache: 2100,
+
+				DownloadDurations: cacheddownloader.Histogram{
+					Count:   2,
+					Sum:     1.5,
+					Buckets: map[float64]uint64{0.5: 1, 1: 1, 2.5: 2},
+				},
+			},
+		}
+
+		registry = prometheus.NewRegistry()
+		Ω(registry.Register(promcollector.New("agent", source))).Should(Succeed())
+	})
+
+	gather := func() map[string]*dto.Metric {
+		families, err := registry.Gather()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		metrics := map[string]*dto.Metric{}
+		for _, family := range families {
+			Ω(family.Metric).Should(HaveLen(1))
+			metrics[family.GetName()] = family.Metric[0]
+		}
+		return metrics
+	}
+
+	It("exports the counters and gauges", func() {
+		metrics := gather()
+		Ω(metrics["agent_cached_downloader_hits_total"].GetCounter().GetValue()).Should(Equal(3.0))
+		Ω(metrics["agent_cached_downloader_misses_total"].GetCounter().GetValue()).Should(Equal(2.0))
+		Ω(metrics["agent_cached_downloader_evictions_total"].GetCounter().GetValue()).Should(Equal(1.0))
+		Ω(metrics["agent_cached_downloader_cache_bytes"].GetGauge().GetValue()).Should(Equal(1024.0))
+		Ω(metrics["agent_cached_downloader_entries"].GetGauge().GetValue()).Should(Equal(4.0))
+		Ω(metrics["agent_cached_downloader_ineffective_revalidations_total"].GetCounter().GetValue()).Should(Equal(5.0))
+		Ω(metrics["agent_cached_downloader_dropped_events_total"].GetCounter().GetValue()).Should(Equal(6.0))
+		Ω(metrics["agent_cached_downloader_downloaded_bytes_total"].GetCounter().GetValue()).Should(Equal(700.0))
+		Ω(metrics["agent_cached_downloader_served_from_cache_bytes_total"].GetCounter().GetValue()).Should(Equal(2100.0))
+	})
+
+	It("exports the download duration histogram", func() {
+		histogram := gather()["agent_cached_downloader_download_duration_seconds"].GetHistogram()
+		Ω(histogram.GetSampleCount()).Should(Equal(uint64(2)))
+		Ω(histogram.GetSampleSum()).Should(Equal(1.5))
+		Ω(histogram.Bucket).Should(HaveLen(3))
+	})
+
+	It("takes a new snapshot on every scrape", func() {
+		gather()
+		source.stats.Hits = 10
+		Ω(gather()["agent_cached_downloader_hits_total"].GetCounter().GetValue()).Should(Equal(10.0))
+	})
+})
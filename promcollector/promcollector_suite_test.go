@@ -0,0 +1,13 @@
+package promcollector_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPromcollector(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Promcollector Suite")
+}
@@ -0,0 +1,73 @@
+package cacheddownloader
+
+import (
+	"net/http"
+	"sync"
+)
+
+// maxResponseHeaderKeys bounds how many keys LastResponseHeaders remembers.
+const maxResponseHeaderKeys = 1024
+
+// responseHeaders remembers the headers of the last response for each key,
+// forgetting the least recently recorded keys beyond max.
+type responseHeaders struct {
+	lock    sync.Mutex
+	max     int
+	headers map[string]http.Header
+	order   []string
+}
+
+func newResponseHeaders(max int) *responseHeaders {
+	return &responseHeaders{
+		max:     max,
+		headers: map[string]http.Header{},
+	}
+}
+
+func (r *responseHeaders) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.headers = map[string]http.Header{}
+	r.order = nil
+}
+
+func (r *responseHeaders) record(key string, header http.Header) {
+	if header == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.headers[key]; ok {
+		r.unsafelyForget(key)
+	}
+
+	r.headers[key] = header.Clone()
+	r.order = append(r.order, key)
+
+	for len(r.order) > r.max {
+		r.unsafelyForget(r.order[0])
+	}
+}
+
+func (r *responseHeaders) get(key string) (http.Header, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	header, ok := r.headers[key]
+	if !ok {
+		return nil, false
+	}
+	return header.Clone(), true
+}
+
+func (r *responseHeaders) unsafelyForget(key string) {
+	delete(r.headers, key)
+	for i, k := range r.order {
+		if k == key {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package s3handler downloads s3://bucket/key URLs for a cached downloader
+// through the AWS SDK. It lives in its own package so that the core package
+// does not depend on the SDK.
+package s3handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pivotal-golang/cacheddownloader"
+)
+
+// Handler implements cacheddownloader.SchemeHandler. The object's ETag is
+// used as the validator, so unchanged objects are revalidated with a
+// conditional GetObject rather than downloaded again.
+type Handler struct {
+	client  s3iface.S3API
+	timeout time.Duration
+}
+
+// New creates a handler with a session for config, which is where the region
+// and credentials are configured. A nil config uses the SDK's defaults from
+// the environment. GetObject calls whose response has not arrived within
+// timeout are cancelled, as for HTTP downloads; a zero timeout waits forever.
+func New(config *aws.Config, timeout time.Duration) (*Handler, error) {
+	if config == nil {
+		config = aws.NewConfig()
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWithClient(s3.New(sess), timeout), nil
+}
+
+// NewWithClient creates a handler that uses client, e.g. one shared with the
+// rest of the program.
+func NewWithClient(client s3iface.S3API, timeout time.Duration) *Handler {
+	return &Handler{
+		client:  client,
+		timeout: timeout,
+	}
+}
+
+func (h *Handler) Download(ctx context.Context, url *url.URL, destinationFile *os.File, cachingInfoIn cacheddownloader.CachingInfoType) (cacheddownloader.DownloadResult, error) {
+	if url.Scheme != "s3" || url.Host == "" {
+		return cacheddownloader.DownloadResult{}, fmt.Errorf("Download failed: %s is not an s3://bucket/key URL", url)
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(url.Host),
+		Key:    aws.String(strings.TrimPrefix(url.Path, "/")),
+	}
+	if cachingInfoIn.ETag != "" {
+		input.IfNoneMatch = aws.String(cachingInfoIn.ETag)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var responseTimer *time.Timer
+	if h.timeout > 0 {
+		responseTimer = time.AfterFunc(h.timeout, cancel)
+	}
+
+	output, err := h.client.GetObjectWithContext(ctx, input)
+	if responseTimer != nil && !responseTimer.Stop() && err == nil {
+		output.Body.Close()
+		err = fmt.Errorf("Download failed: timeout awaiting response")
+	}
+	if err != nil {
+		if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotModified {
+			return cacheddownloader.DownloadResult{CachingInfo: cachingInfoIn}, nil
+		}
+		return cacheddownloader.DownloadResult{}, err
+	}
+	defer output.Body.Close()
+
+	size, err := io.Copy(destinationFile, output.Body)
+	if err != nil {
+		return cacheddownloader.DownloadResult{}, err
+	}
+
+	cachingInfo := cacheddownloader.CachingInfoType{
+		ETag:        aws.StringValue(output.ETag),
+		ContentType: aws.StringValue(output.ContentType),
+	}
+	if output.LastModified != nil {
+		cachingInfo.LastModified = output.LastModified.UTC().Format(http.TimeFormat)
+	}
+
+	return cacheddownloader.DownloadResult{
+		DidDownload: true,
+		Size:        size,
+		CachingInfo: cachingInfo,
+	}, nil
+}
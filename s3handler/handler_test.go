@@ -0,0 +1,113 @@
+package s3handler_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	Url "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pivotal-golang/cacheddownloader"
+	"github.com/pivotal-golang/cacheddownloader/s3handler"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+
+	inputs []*s3.GetObjectInput
+	delay  time.Duration
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.inputs = append(f.inputs, input)
+
+	select {
+	case <-time.After(f.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if aws.StringValue(input.IfNoneMatch) == `"the-etag"` {
+		return nil, awserr.NewRequestFailure(awserr.New("NotModified", "Not Modified", nil), http.StatusNotModified, "request-id")
+	}
+
+	return &s3.GetObjectOutput{
+		Body:         ioutil.NopCloser(strings.NewReader("the-object")),
+		ETag:         aws.String(`"the-etag"`),
+		ContentType:  aws.String("application/octet-stream"),
+		LastModified: aws.Time(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)),
+	}, nil
+}
+
+var _ = Describe("Handler", func() {
+	var client *fakeS3
+	var handler *s3handler.Handler
+	var file *os.File
+	var url *Url.URL
+
+	BeforeEach(func() {
+		client = &fakeS3{}
+		handler = s3handler.NewWithClient(client, time.Second)
+
+		var err error
+		file, err = ioutil.TempFile("", "s3handler")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		url, err = Url.Parse("s3://my-bucket/path/to/object")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		file.Close()
+		os.RemoveAll(file.Name())
+	})
+
+	It("downloads the object with its ETag as the validator", func() {
+		result, err := handler.Download(context.Background(), url, file, cacheddownloader.CachingInfoType{})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(result.DidDownload).Should(BeTrue())
+		Ω(result.Size).Should(BeEquivalentTo(len("the-object")))
+		Ω(result.CachingInfo.ETag).Should(Equal(`"the-etag"`))
+		Ω(result.CachingInfo.LastModified).Should(Equal("Mon, 02 Jan 2006 15:04:05 GMT"))
+		Ω(result.CachingInfo.ContentType).Should(Equal("application/octet-stream"))
+		Ω(ioutil.ReadFile(file.Name())).Should(Equal([]byte("the-object")))
+
+		Ω(client.inputs).Should(HaveLen(1))
+		Ω(aws.StringValue(client.inputs[0].Bucket)).Should(Equal("my-bucket"))
+		Ω(aws.StringValue(client.inputs[0].Key)).Should(Equal("path/to/object"))
+		Ω(client.inputs[0].IfNoneMatch).Should(BeNil())
+	})
+
+	It("revalidates with IfNoneMatch", func() {
+		cachingInfo := cacheddownloader.CachingInfoType{ETag: `"the-etag"`}
+		result, err := handler.Download(context.Background(), url, file, cachingInfo)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(result.DidDownload).Should(BeFalse())
+		Ω(result.CachingInfo).Should(Equal(cachingInfo))
+	})
+
+	It("gives up when the response does not arrive within the timeout", func() {
+		client.delay = time.Second
+		handler = s3handler.NewWithClient(client, 10*time.Millisecond)
+
+		_, err := handler.Download(context.Background(), url, file, cacheddownloader.CachingInfoType{})
+		Ω(err).Should(HaveOccurred())
+	})
+
+	It("rejects URLs without a bucket", func() {
+		url, _ = Url.Parse("s3:///path/to/object")
+		_, err := handler.Download(context.Background(), url, file, cacheddownloader.CachingInfoType{})
+		Ω(err).Should(HaveOccurred())
+		Ω(client.inputs).Should(BeEmpty())
+	})
+})
@@ -0,0 +1,13 @@
+package s3handler_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestS3handler(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "S3handler Suite")
+}
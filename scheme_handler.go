@@ -0,0 +1,50 @@
+package cacheddownloader
+
+import (
+	"context"
+	"net/url"
+	"os"
+)
+
+// SchemeHandler downloads URLs of a scheme other than HTTP, such as file:// or
+// s3://, so the cache can front them without the core depending on their
+// SDKs. Download writes the file to destinationFile, which is empty, and may
+// use cachingInfoIn to skip downloads of unchanged files the way a 304 does.
+// Like HTTP responses, results are only cached if they carry an ETag or
+// Last-Modified validator.
+type SchemeHandler interface {
+	Download(ctx context.Context, url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (DownloadResult, error)
+}
+
+// RegisterSchemeHandler makes the downloader use h for URLs of scheme. A
+// handler registered for http or https replaces the built-in one, in which
+// case extra request headers, methods and bodies are not passed on.
+func (downloader *Downloader) RegisterSchemeHandler(scheme string, h SchemeHandler) {
+	downloader.lock.Lock()
+	defer downloader.lock.Unlock()
+	downloader.schemeHandlers[scheme] = h
+}
+
+func (downloader *Downloader) schemeHandler(scheme string) SchemeHandler {
+	downloader.lock.Lock()
+	defer downloader.lock.Unlock()
+	return downloader.schemeHandlers[scheme]
+}
+
+func (downloader *Downloader) fetchWithHandler(ctx context.Context, h SchemeHandler, url *url.URL, destinationFile *os.File, cachingInfoIn CachingInfoType) (DownloadResult, error) {
+	_, err := destinationFile.Seek(0, 0)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	err = destinationFile.Truncate(0)
+	if err != nil {
+		return DownloadResult{}, err
+	}
+
+	result, err := h.Download(ctx, url, destinationFile, cachingInfoIn)
+	if err == nil && result.CachingInfo.SourceURL == "" {
+		result.CachingInfo.SourceURL = sourceURL(url)
+	}
+	return result, err
+}
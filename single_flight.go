@@ -0,0 +1,146 @@
+package cacheddownloader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flight is a download of a cache key that other fetches of the same key wait
+// for rather than downloading it again.
+type flight struct {
+	done    chan struct{}
+	waiters int
+
+	// ctx is what the download runs under. It is cancelled once the leader's
+	// caller and every waiter have given up on the result.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	leaderGone bool
+
+	// deadline is the latest deadline of the fetches that have wanted the
+	// result, and unbounded is true once one of them had none. Retries of
+	// the download give up when they cannot finish before it.
+	deadline  time.Time
+	unbounded bool
+
+	// shared is true if the download left the file in the cache, where
+	// waiters can open it
+	shared bool
+	err    error
+}
+
+// flightGroup tracks the downloads in flight by cache key. A maxWaiters of 0
+// means any number of fetches may wait on one download.
+type flightGroup struct {
+	lock       sync.Mutex
+	maxWaiters int
+	flights    map[string]*flight
+}
+
+// join returns the flight for cacheKey, starting one led by the caller if
+// there is none. It returns ErrTooManyWaiters if the flight already has
+// maxWaiters waiting on it. ctx is the caller's, whose deadline the download
+// keeps to unless others want the result for longer.
+func (g *flightGroup) join(ctx context.Context, cacheKey string) (*flight, bool, error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f, ok := g.flights[cacheKey]; ok {
+		if g.maxWaiters > 0 && f.waiters >= g.maxWaiters {
+			return nil, false, ErrTooManyWaiters
+		}
+		f.waiters++
+		f.wantedUntil(ctx)
+		return f, false, nil
+	}
+
+	flightCtx, cancel := context.WithCancel(context.Background())
+	f := &flight{done: make(chan struct{}), ctx: flightCtx, cancel: cancel}
+	f.wantedUntil(ctx)
+	g.flights[cacheKey] = f
+	return f, true, nil
+}
+
+func (f *flight) wantedUntil(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		f.unbounded = true
+	} else if deadline.After(f.deadline) {
+		f.deadline = deadline
+	}
+}
+
+// deadline returns the deadline the download of f has to finish by, if any.
+func (g *flightGroup) deadline(f *flight) (time.Time, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if f.unbounded {
+		return time.Time{}, false
+	}
+	return f.deadline, true
+}
+
+// inFlight reports whether a download of cacheKey is in flight.
+func (g *flightGroup) inFlight(cacheKey string) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	_, ok := g.flights[cacheKey]
+	return ok
+}
+
+// leave records that the leader's caller, or one of the waiters, no longer
+// wants the result of f. When nobody does any more the download is
+// cancelled, and later fetches of cacheKey start a flight of their own.
+func (g *flightGroup) leave(cacheKey string, f *flight, leader bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if leader {
+		f.leaderGone = true
+	} else {
+		f.waiters--
+	}
+
+	if f.leaderGone && f.waiters == 0 {
+		if g.flights[cacheKey] == f {
+			delete(g.flights, cacheKey)
+		}
+		f.cancel()
+	}
+}
+
+// leaveWhenDone makes the leader leave f once ctx is done. The returned
+// function stops watching ctx and must be called when the download is over.
+func (g *flightGroup) leaveWhenDone(ctx context.Context, cacheKey string, f *flight) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			g.leave(cacheKey, f, true)
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
+
+// land records the outcome of the leader's download and releases the
+// waiters.
+func (g *flightGroup) land(cacheKey string, f *flight, shared bool, err error) {
+	g.lock.Lock()
+	if g.flights[cacheKey] == f {
+		delete(g.flights, cacheKey)
+	}
+	g.lock.Unlock()
+
+	f.shared = shared
+	f.err = err
+	close(f.done)
+	f.cancel()
+}
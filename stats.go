@@ -0,0 +1,135 @@
+package cacheddownloader
+
+import (
+	"sync"
+	"time"
+)
+
+// DownloadDurationBuckets are the upper bounds, in seconds, of the buckets
+// Stats uses for download durations.
+var DownloadDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Stats is a snapshot of a downloader's counters. Hits and Misses only count
+// fetches with a cache key. IneffectiveRevalidations counts conditional
+// requests the server answered with the same file instead of 304 Not
+// Modified, which means the upstream defeats caching.
+//
+// BytesDownloaded counts the bytes of files downloaded from the network, and
+// BytesServedFromCache the size of the files fetches were served from the
+// cache, whether or not callers read all of them. Their ratio is the
+// bandwidth the cache saves.
+type Stats struct {
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	CacheBytes int64
+	Entries    int
+
+	IneffectiveRevalidations uint64
+	// DroppedEvents counts events WithEvents dropped because the consumer
+	// fell behind.
+	DroppedEvents uint64
+
+	BytesDownloaded      uint64
+	BytesServedFromCache uint64
+
+	DownloadDurations Histogram
+}
+
+// Histogram is a cumulative histogram in the style of Prometheus: Buckets
+// maps each upper bound to the number of observations at or below it.
+type Histogram struct {
+	Count   uint64
+	Sum     float64
+	Buckets map[float64]uint64
+}
+
+type stats struct {
+	lock              *sync.Mutex
+	hits              uint64
+	misses            uint64
+	downloadDurations Histogram
+
+	ineffectiveRevalidations uint64
+
+	bytesDownloaded      uint64
+	bytesServedFromCache uint64
+}
+
+func newStats() *stats {
+	return &stats{
+		lock: &sync.Mutex{},
+		downloadDurations: Histogram{
+			Buckets: map[float64]uint64{},
+		},
+	}
+}
+
+func (s *stats) reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	*s = stats{
+		lock: s.lock,
+		downloadDurations: Histogram{
+			Buckets: map[float64]uint64{},
+		},
+	}
+}
+
+func (s *stats) recordFetch(fromCache bool, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if fromCache {
+		s.hits++
+		s.bytesServedFromCache += uint64(size)
+	} else {
+		s.misses++
+	}
+}
+
+func (s *stats) recordIneffectiveRevalidation() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ineffectiveRevalidations++
+}
+
+func (s *stats) recordDownload(duration time.Duration, size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.bytesDownloaded += uint64(size)
+
+	seconds := duration.Seconds()
+	s.downloadDurations.Count++
+	s.downloadDurations.Sum += seconds
+	for _, bound := range DownloadDurationBuckets {
+		if seconds <= bound {
+			s.downloadDurations.Buckets[bound]++
+		}
+	}
+}
+
+func (s *stats) snapshot() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	buckets := make(map[float64]uint64, len(DownloadDurationBuckets))
+	for _, bound := range DownloadDurationBuckets {
+		buckets[bound] = s.downloadDurations.Buckets[bound]
+	}
+
+	return Stats{
+		Hits:   s.hits,
+		Misses: s.misses,
+		DownloadDurations: Histogram{
+			Count:   s.downloadDurations.Count,
+			Sum:     s.downloadDurations.Sum,
+			Buckets: buckets,
+		},
+
+		IneffectiveRevalidations: s.ineffectiveRevalidations,
+
+		BytesDownloaded:      s.bytesDownloaded,
+		BytesServedFromCache: s.bytesServedFromCache,
+	}
+}
@@ -0,0 +1,37 @@
+package cacheddownloader
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrPinMismatch is returned when none of the certificates a server presents
+// has a public key pinned with WithTLSPins.
+var ErrPinMismatch = errors.New("TLS certificate does not match any pinned public key")
+
+// verifyTLSPins accepts a connection if the public key of a certificate in
+// one of the verified chains hashes to one of pins. It runs after, not
+// instead of, the usual chain verification. Certificates the server sends
+// that are not part of a verified chain do not count, so a connection
+// without verified chains, e.g. under WithInsecureSkipVerify, never matches.
+func verifyTLSPins(pins []string) func(tls.ConnectionState) error {
+	pinned := map[string]bool{}
+	for _, pin := range pins {
+		pinned[strings.TrimPrefix(pin, "sha256/")] = true
+	}
+
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pinned[base64.StdEncoding.EncodeToString(hash[:])] {
+					return nil
+				}
+			}
+		}
+		return ErrPinMismatch
+	}
+}
@@ -0,0 +1,46 @@
+package cacheddownloader
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Only a subset of Vary is supported. The values of the named headers are
+// taken from the headers the caller supplies, such as Accept for
+// FetchWithAccept; headers the transport adds itself, like Accept-Encoding,
+// are the same for every request and so never split the cache. "Vary: *"
+// makes a response uncacheable.
+
+// parseVary returns the canonical header names listed in vary, and false if
+// vary is "*".
+func parseVary(vary string) ([]string, bool) {
+	names := []string{}
+	for _, name := range strings.Split(vary, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "*" {
+			return nil, false
+		}
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+
+	sort.Strings(names)
+	return names, true
+}
+
+// varyCacheKey derives the key of the variant selected by header from the key
+// of the resource, in the same namespace.
+func varyCacheKey(cacheKey string, varyNames []string, header http.Header) string {
+	if len(varyNames) == 0 {
+		return cacheKey
+	}
+
+	variant := cacheKey
+	for _, name := range varyNames {
+		variant += "\x00" + name + ": " + strings.Join(header[name], ",")
+	}
+	return namespacePrefix(cacheKey) + hashCacheKey(variant)
+}